@@ -0,0 +1,71 @@
+package TorClient
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"../../keyLibrary"
+	"../../utils"
+)
+
+// how long to wait for one bridge before trying the next
+const bridgeDialTimeout = 10 * time.Second
+
+// PickBridge tries the configured bridge lines in random order and returns the first
+// one that answers with the key of its bridge line. The returned links dial the bridge
+// over its own transport, so it can be used as the first hop of the circuit.
+func PickBridge(bridgeLines []string, links utils.LinkConfig) (string, rsa.PublicKey, utils.LinkConfig, error) {
+	if len(bridgeLines) == 0 {
+		return "", rsa.PublicKey{}, links, errors.New("no bridges configured")
+	}
+
+	bridges := make([]utils.Bridge, 0, len(bridgeLines))
+	for _, line := range bridgeLines {
+		bridge, err := utils.ParseBridgeLine(line)
+		if err != nil {
+			return "", rsa.PublicKey{}, links, err
+		}
+		bridges = append(bridges, bridge)
+	}
+	rand.Seed(time.Now().UnixNano())
+	rand.Shuffle(len(bridges), func(i, j int) { bridges[i], bridges[j] = bridges[j], bridges[i] })
+
+	var lastErr error
+	for _, bridge := range bridges {
+		key, err := probeBridge(bridge)
+		if err != nil {
+			fmt.Printf("Client: Bridge %s unusable: %s\n", bridge.Addr, err)
+			lastErr = err
+			continue
+		}
+
+		bridgeLinks := utils.LinkConfig{
+			Transport:      links.Transport,
+			LinkTransports: map[string]utils.TransportConfig{bridge.Addr: bridge.Transport},
+		}
+		for addr, transport := range links.LinkTransports {
+			if addr != bridge.Addr {
+				bridgeLinks.LinkTransports[addr] = transport
+			}
+		}
+		return bridge.Addr, *key, bridgeLinks, nil
+	}
+	return "", rsa.PublicKey{}, links, fmt.Errorf("no bridge reachable, last error: %s", lastErr)
+}
+
+func probeBridge(bridge utils.Bridge) (*rsa.PublicKey, error) {
+	transport, err := utils.NewTransport(bridge.Transport)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := utils.DialLink(transport, bridge.Addr, bridge.Fingerprint, nil, bridgeDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return keyLibrary.PeerKey(conn.(*tls.Conn))
+}
@@ -0,0 +1,185 @@
+package TorClient
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CircuitState is how far a circuit of the client got
+type CircuitState string
+
+const (
+	CircuitLaunched CircuitState = "LAUNCHED" // being built
+	CircuitBuilt    CircuitState = "BUILT"    // carrying requests or a connection
+	CircuitFailed   CircuitState = "FAILED"   // could not be built, or broke while in use
+	CircuitClosed   CircuitState = "CLOSED"   // torn down after use
+)
+
+// what a circuit is for
+const (
+	PurposeRequest = "REQUEST" // a request to the data server, on its own circuit
+	PurposePooled  = "POOLED"  // built ahead of time for requests to the data server
+	PurposeExit    = "EXIT"    // a connection out of an exit, from Dial
+)
+
+// events kept for a subscriber that doesn't keep up, the ones after that are dropped
+const circuitEventBuffer = 64
+
+// CircuitInfo describes one of the client's circuits. Circuit events carry one too,
+// with the state the circuit moved to.
+type CircuitInfo struct {
+	ID      uint64
+	State   CircuitState
+	Path    []string // relays from the first hop to the last
+	Purpose string
+	Since   time.Time // when the circuit got to State
+	Reason  string    // why it failed, empty otherwise
+}
+
+// circuitTracker knows the circuits the client has open, and tells subscribers as they
+// are built, fail and close. Onion service circuits aren't tracked.
+type circuitTracker struct {
+	mu          sync.Mutex
+	nextID      uint64
+	open        map[uint64]*trackedCircuit
+	subscribers map[chan CircuitInfo]bool
+}
+
+type trackedCircuit struct {
+	info  CircuitInfo
+	close func() error // nil until the circuit is built
+}
+
+func newCircuitTracker() *circuitTracker {
+	return &circuitTracker{
+		open:        make(map[uint64]*trackedCircuit),
+		subscribers: make(map[chan CircuitInfo]bool),
+	}
+}
+
+// launch starts tracking a circuit about to be built through path, returns its ID
+func (t *circuitTracker) launch(purpose string, path []string) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nextID++
+	circuit := &trackedCircuit{info: CircuitInfo{ID: t.nextID, Path: append([]string(nil), path...), Purpose: purpose}}
+	t.open[circuit.info.ID] = circuit
+	t.moveTo(circuit, CircuitLaunched, "")
+	return circuit.info.ID
+}
+
+// built notes the outcome of building circuit id. A built circuit is torn down with close.
+func (t *circuitTracker) built(id uint64, err error, close func() error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	circuit, ok := t.open[id]
+	if !ok {
+		return
+	}
+	if err != nil {
+		delete(t.open, id)
+		t.moveTo(circuit, CircuitFailed, err.Error())
+		return
+	}
+	circuit.close = close
+	t.moveTo(circuit, CircuitBuilt, "")
+}
+
+// closed stops tracking circuit id, which failed when err isn't nil
+func (t *circuitTracker) closed(id uint64, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	circuit, ok := t.open[id]
+	if !ok {
+		return
+	}
+	delete(t.open, id)
+	if err != nil {
+		t.moveTo(circuit, CircuitFailed, err.Error())
+		return
+	}
+	t.moveTo(circuit, CircuitClosed, "")
+}
+
+// callers hold mu
+func (t *circuitTracker) moveTo(circuit *trackedCircuit, state CircuitState, reason string) {
+	circuit.info.State, circuit.info.Since, circuit.info.Reason = state, time.Now(), reason
+	for events := range t.subscribers {
+		event := circuit.info
+		event.Path = append([]string(nil), circuit.info.Path...)
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+func (t *circuitTracker) list() []CircuitInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	infos := make([]CircuitInfo, 0, len(t.open))
+	for _, circuit := range t.open {
+		info := circuit.info
+		info.Path = append([]string(nil), circuit.info.Path...)
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+func (t *circuitTracker) close(id uint64) error {
+	t.mu.Lock()
+	circuit, ok := t.open[id]
+	var closeCircuit func() error
+	if ok {
+		// built sets it under mu
+		closeCircuit = circuit.close
+	}
+	t.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no circuit %d", id)
+	}
+	if closeCircuit == nil {
+		return fmt.Errorf("circuit %d is still being built", id)
+	}
+	closeCircuit()
+	// the owner of the circuit notes it closed once it notices, it may be a while
+	t.closed(id, nil)
+	return nil
+}
+
+func (t *circuitTracker) subscribe() (<-chan CircuitInfo, func()) {
+	events := make(chan CircuitInfo, circuitEventBuffer)
+	t.mu.Lock()
+	t.subscribers[events] = true
+	t.mu.Unlock()
+	var once sync.Once
+	return events, func() {
+		once.Do(func() {
+			t.mu.Lock()
+			delete(t.subscribers, events)
+			t.mu.Unlock()
+			close(events)
+		})
+	}
+}
+
+// Circuits lists the circuits the client has open or is building, in the order they were
+// launched. Onion service circuits aren't listed.
+func (c *Client) Circuits() []CircuitInfo {
+	return c.circuits.list()
+}
+
+// CloseCircuit tears down the circuit with the given ID. A request on it is retried on
+// another circuit, a connection from Dial on it ends.
+func (c *Client) CloseCircuit(id uint64) error {
+	return c.circuits.close(id)
+}
+
+// CircuitEvents tells about every circuit the client launches, builds, closes or fails to
+// build from now on, until stop is called. Events are dropped while the channel is full.
+func (c *Client) CircuitEvents() (events <-chan CircuitInfo, stop func()) {
+	return c.circuits.subscribe()
+}
@@ -0,0 +1,701 @@
+package TorClient
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"../../cover"
+	"../../keyLibrary"
+	"../../utils"
+	"github.com/DistributedClocks/GoVector/govec"
+)
+
+const (
+	// how long a request may take altogether when the config doesn't say
+	defaultRequestTimeout = 10 * time.Second
+	// the relays from the DS are used for this long before asking again
+	directoryRefresh = 5 * time.Minute
+	// relays asked from the DS at once, circuits are picked among them
+	directoryFetchSize = 32
+	// how long the DS gets to answer a request without a deadline of its own
+	dsTimeout = 10 * time.Second
+)
+
+// Client reaches the data server and the rest of the internet through the tor network.
+// It keeps a list of relays from the DS and builds a new circuit for every request, or
+// takes one from its pool of circuits built ahead of time when CircuitPool is enabled.
+// Circuits enter the network through one of its entry guards, or a bridge when there
+// are bridges. Safe for concurrent use.
+type Client struct {
+	config          utils.ClientConfig
+	dsPublicKey     rsa.PublicKey
+	serverPublicKey *rsa.PublicKey // nil without ServerPublicKeyPath
+	vecLogger       *govec.GoLog
+	cover           *cover.Traffic
+	pool            *circuitPool // nil unless CircuitPool is enabled
+	guards          *guardSet
+	avoid           *avoidList
+	path            *pathRules
+	circuits        *circuitTracker
+	timeouts        *adaptiveTimeouts
+
+	fetching chan struct{} // held while the DS is asked for relays
+
+	mu        sync.Mutex
+	relays    map[string]rsa.PublicKey
+	exits     map[string]utils.ExitPorts
+	fetchedAt time.Time
+	identity  int        // counts NewIdentity calls
+	bridge    *bridgeHop // picked on first use
+	last      []string   // relays of the last circuit a request or connection went through
+}
+
+// the bridge a client enters the network through
+type bridgeHop struct {
+	addr  string
+	key   rsa.PublicKey
+	links utils.LinkConfig
+}
+
+// NewClient loads the keys named in config and the entry guards saved in its guard
+// state file, and starts cover traffic and the circuit pool if they are enabled. The DS
+// is contacted once a request, a cover onion or the pool needs relays; the pool starts
+// building circuits, and so fetching relays, right away.
+func NewClient(config utils.ClientConfig) (*Client, error) {
+	dsPublicKey, err := keyLibrary.LoadPublicKey(config.DSPublicKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("loading DS key: %w", err)
+	}
+	var serverPublicKey *rsa.PublicKey
+	if config.ServerPublicKeyPath != "" {
+		serverPublicKey, err = keyLibrary.LoadPublicKey(config.ServerPublicKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("loading server key: %w", err)
+		}
+	}
+	if config.MaxNumNodes == 0 {
+		config.MaxNumNodes = 1
+	}
+	path, err := newPathRules(config)
+	if err != nil {
+		return nil, fmt.Errorf("path rules: %w", err)
+	}
+	guards, err := loadGuards(config.Guards)
+	if err != nil {
+		return nil, fmt.Errorf("loading entry guards: %w", err)
+	}
+	timeouts, err := loadTimeouts(config.Timeouts)
+	if err != nil {
+		return nil, fmt.Errorf("loading circuit timeouts: %w", err)
+	}
+
+	vecLogger := govec.InitGoVector("Client-"+config.ID, "Client-"+config.ID, govec.GetDefaultConfig())
+	c := &Client{
+		config:          config,
+		dsPublicKey:     *dsPublicKey,
+		serverPublicKey: serverPublicKey,
+		vecLogger:       vecLogger,
+		guards:          guards,
+		path:            path,
+		circuits:        newCircuitTracker(),
+		timeouts:        timeouts,
+		avoid:           newAvoidList(time.Duration(config.Retry.AvoidMillis) * time.Millisecond),
+		fetching:        make(chan struct{}, 1),
+	}
+	c.cover = cover.Start(config.CoverTraffic, config.LinkConfig, c.coverRelays, "", log.New(os.Stdout, "Client: ", 0), vecLogger)
+	// onion services are reached through a rendezvous, not a circuit of ours to the server
+	if config.CircuitPool.Enabled && serverPublicKey != nil && !utils.IsOnionAddress(config.ServerIPPort) {
+		c.pool = newCircuitPool(config.CircuitPool, c.buildRequestCircuit)
+	}
+	return c, nil
+}
+
+// Close stops the client's cover traffic and tears down the circuits built ahead of
+// time. Connections from Dial stay open.
+func (c *Client) Close() error {
+	if c.cover != nil {
+		c.cover.Stop()
+	}
+	if c.pool != nil {
+		c.pool.close()
+	}
+	c.timeouts.close()
+	return nil
+}
+
+// Get fetches key from the data server at ServerIPPort, or from the onion service when
+// it is an onion address. The request gives up at ctx's deadline, or after
+// RequestTimeoutMillis when that comes first.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	// an onion service has no address to build a circuit to, we meet it at a rendezvous point
+	if utils.IsOnionAddress(c.config.ServerIPPort) {
+		var value string
+		err := c.untilDone(ctx, func() error {
+			var err error
+			value, err = FetchFromOnionService(c.config.ServerIPPort, key, c.config.DSIPPort, c.dsPublicKey, uint16(c.path.maxLength), c.config.LinkConfig, c.config.FlowControl, c.vecLogger)
+			return err
+		}, nil)
+		if err != nil {
+			return "", err
+		}
+		return value, nil
+	}
+	return c.exchange(ctx, "get "+key, utils.Request{Key: key})
+}
+
+// Put stores value under key at the data server at ServerIPPort, giving up like Get.
+// Onion services only answer gets.
+func (c *Client) Put(ctx context.Context, key string, value string) error {
+	_, err := c.exchange(ctx, "put "+key, utils.Request{Op: utils.RequestPut, Key: key, Value: value})
+	return err
+}
+
+// List returns the keys the data server at ServerIPPort holds, sorted. Gives up like Get.
+func (c *Client) List(ctx context.Context) ([]string, error) {
+	value, err := c.exchange(ctx, "list", utils.Request{Op: utils.RequestList})
+	if err != nil || value == "" {
+		return nil, err
+	}
+	return strings.Split(value, "\n"), nil
+}
+
+// sends req to the data server, on new circuits until one gets an answer
+func (c *Client) exchange(ctx context.Context, what string, req utils.Request) (string, error) {
+	if utils.IsOnionAddress(c.config.ServerIPPort) {
+		return "", errors.New("onion services only answer gets")
+	}
+	if c.serverPublicKey == nil {
+		return "", errors.New("no ServerPublicKeyPath configured")
+	}
+	deadline := c.deadline(ctx)
+	var value string
+	err := c.withRetries(ctx, what, deadline, func() ([]string, error) {
+		var path []string
+		var err error
+		if c.pool != nil {
+			value, path, err = c.exchangePooled(ctx, req, deadline)
+		} else {
+			value, path, err = c.exchangeOnce(ctx, req, deadline)
+		}
+		return path, err
+	})
+	if err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// sends the request on a new circuit, returns the value and the relays of the circuit
+func (c *Client) exchangeOnce(ctx context.Context, req utils.Request, deadline time.Time) (string, []string, error) {
+	dirCtx, cancel := context.WithDeadline(ctx, deadline)
+	relays, tnMap, links, err := c.circuit(dirCtx, 0)
+	cancel()
+	if err != nil {
+		return "", nil, err
+	}
+	nodeOrder := append(append([]string{}, relays...), c.config.ServerIPPort)
+	tnMap[c.config.ServerIPPort] = *c.serverPublicKey
+
+	onion, symmKeys, err := createRequestOnion(nodeOrder, tnMap, req, deadline)
+	if err != nil {
+		return "", relays, err
+	}
+	id := c.circuits.launch(PurposeRequest, relays)
+	// the circuit is built once the first part of the response is back
+	var reader *ResponseReader
+	var first string
+	err = c.timed(ctx, c.timeouts.firstResponse, func() error {
+		var err error
+		if reader, err = SendOnionMessageStream(nodeOrder, tnMap, onion, symmKeys, links, c.config.FlowControl, deadline, c.vecLogger); err != nil {
+			return err
+		}
+		if first, err = reader.Next(); err == io.EOF {
+			err = nil
+		}
+		return err
+	}, func() {
+		if reader != nil {
+			reader.Close()
+		}
+	})
+	if errors.Is(err, ErrCircuitTimeout) || err != nil && err == ctx.Err() {
+		// given up on, the reader is closed once the attempt is over
+		c.circuits.built(id, err, nil)
+		return "", relays, err
+	}
+	if reader != nil {
+		defer reader.Close()
+	}
+	c.guards.note(nodeOrder[0], err)
+	if err != nil {
+		c.circuits.built(id, err, nil)
+		return "", relays, err
+	}
+	// closing the connection under the reader makes the next read fail
+	c.circuits.built(id, nil, reader.conn.Close)
+
+	// cancelling ctx makes the next read fail
+	stop := context.AfterFunc(ctx, func() { reader.conn.SetDeadline(time.Now()) })
+	defer stop()
+	rest, err := readResponse(reader)
+	c.circuits.closed(id, err)
+	if err != nil && ctx.Err() != nil {
+		return "", relays, ctx.Err()
+	}
+	c.guards.note(nodeOrder[0], err)
+	return first + rest, relays, err
+}
+
+// sends the request on a circuit from the pool
+func (c *Client) exchangePooled(ctx context.Context, req utils.Request, deadline time.Time) (string, []string, error) {
+	rc, err := c.pool.take(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	value, err := rc.Exchange(ctx, c.config.ServerIPPort, *c.serverPublicKey, req, deadline)
+	if err != nil {
+		c.circuits.closed(rc.id, err)
+	}
+	c.guards.note(rc.relays[0], err)
+	c.pool.put(rc, err != nil)
+	return value, rc.Relays(), err
+}
+
+func (c *Client) buildRequestCircuit(ctx context.Context) (*RequestCircuit, error) {
+	nodeOrder, tnMap, links, err := c.circuit(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	id := c.circuits.launch(PurposePooled, nodeOrder)
+	var rc *RequestCircuit
+	err = c.timed(ctx, c.timeouts.build, func() error {
+		var err error
+		rc, err = OpenRequestCircuit(nodeOrder, tnMap, links, c.config.FlowControl, c.vecLogger)
+		c.guards.note(nodeOrder[0], err)
+		return err
+	}, func() {
+		if rc != nil {
+			rc.Close()
+		}
+	})
+	if err != nil {
+		c.circuits.built(id, err, nil)
+		return nil, err
+	}
+	rc.id, rc.onClose = id, func() { c.circuits.closed(id, nil) }
+	c.circuits.built(id, nil, rc.Close)
+	return rc, nil
+}
+
+// Dial opens a TCP connection to addr, a host:port, from an exit relay at the end of a
+// circuit whose policy allows the port. Bytes written to the connection come out of the
+// exit, which also resolves the host name. Gives up on the connection like Get gives up
+// on a request. A read that times out ends the connection.
+func (c *Client) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	port, err := utils.DestinationPort(addr)
+	if err != nil || port <= 0 {
+		return nil, fmt.Errorf("bad destination %q", addr)
+	}
+	deadline := c.deadline(ctx)
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	var conn net.Conn
+	err = c.withRetries(ctx, "dial "+addr, deadline, func() ([]string, error) {
+		nodeOrder, tnMap, links, err := c.circuit(ctx, port)
+		if err != nil {
+			return nil, err
+		}
+		return nodeOrder, c.untilDone(ctx, func() error {
+			id := c.circuits.launch(PurposeExit, nodeOrder)
+			var err error
+			conn, err = DialExit(nodeOrder, tnMap, addr, links, c.config.FlowControl, c.vecLogger)
+			c.guards.note(nodeOrder[0], err)
+			if err != nil {
+				c.circuits.built(id, err, nil)
+				return err
+			}
+			conn.(*exitConn).onClose = func() { c.circuits.closed(id, nil) }
+			c.circuits.built(id, nil, conn.Close)
+			return nil
+		}, func() {
+			if conn != nil {
+				conn.Close()
+			}
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Circuit is the relays of the circuit the last request or connection that got through
+// went through, nil before the first one
+func (c *Client) Circuit() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.last...)
+}
+
+// NewIdentity makes the requests and connections from now on look unrelated to the ones
+// before: circuits built ahead of time are torn down, and the relays are fetched from the
+// DS again and picked anew. The entry guards stay, like in Tor. Connections from Dial stay
+// open.
+func (c *Client) NewIdentity() {
+	c.mu.Lock()
+	c.relays, c.exits, c.last = nil, nil, nil
+	c.identity++
+	c.mu.Unlock()
+	c.avoid.clear()
+	if c.pool != nil {
+		c.pool.flush()
+	}
+	fmt.Println("Client: new identity, new circuits from now on")
+}
+
+func (c *Client) noteCircuit(path []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.last = append([]string(nil), path...)
+}
+
+// runs f, returning ctx's error early once ctx is done. f keeps running then, and
+// cleanup runs once it returns.
+func (c *Client) untilDone(ctx context.Context, f func() error, cleanup func()) error {
+	done := make(chan error, 1)
+	go func() { done <- f() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		go func() {
+			<-done
+			if cleanup != nil {
+				cleanup()
+			}
+		}()
+		return ctx.Err()
+	}
+}
+
+func (c *Client) deadline(ctx context.Context) time.Time {
+	timeout := defaultRequestTimeout
+	if c.config.RequestTimeoutMillis > 0 {
+		timeout = time.Duration(c.config.RequestTimeoutMillis) * time.Millisecond
+	}
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	return deadline
+}
+
+// picks the relays for a new circuit within the path rules, entering through the bridge
+// when there are bridges and through an entry guard otherwise, and ending at an exit
+// that allows exitPort when it isn't 0. A circuit of the exit alone has no guard. Relays
+// and links that failed lately are left out while enough others are left, and the
+// circuit is shorter than MaxLength when too few relays fit it. The DS is given up on
+// once ctx is done. Returns the path with the keys of its relays, and the links to dial
+// the first one with.
+func (c *Client) circuit(ctx context.Context, exitPort int) ([]string, map[string]rsa.PublicKey, utils.LinkConfig, error) {
+	links := c.config.LinkConfig
+	bridge, err := c.pickBridge()
+	if err != nil {
+		return nil, nil, links, err
+	}
+	minRelays, maxRelays := c.path.minLength, c.path.maxLength
+	if bridge != nil {
+		links = bridge.links
+		minRelays--
+		maxRelays--
+	}
+
+	exit := exitPort != 0
+	if exit && maxRelays == 0 {
+		minRelays, maxRelays = 1, 1
+	}
+	all, exits := map[string]rsa.PublicKey{}, map[string]utils.ExitPorts{}
+	if maxRelays > 0 {
+		if all, exits, err = c.directory(ctx, exitPort, false); err != nil {
+			return nil, nil, links, err
+		}
+	}
+	if bridge != nil {
+		delete(all, bridge.addr)
+	}
+	tnMap := c.avoid.filter(all)
+	if len(tnMap) < len(all) && !enoughRelays(tnMap, exits, maxRelays, exitPort) {
+		fmt.Println("Client: too few relays left without the ones that failed, fetching a fresh directory")
+		if all, exits, err = c.directory(ctx, exitPort, true); err != nil {
+			return nil, nil, links, err
+		}
+		if bridge != nil {
+			delete(all, bridge.addr)
+		}
+		if tnMap = c.avoid.filter(all); !enoughRelays(tnMap, exits, minRelays, exitPort) {
+			fmt.Println("Client: WARNING too few relays even so, trying the ones that failed again")
+			tnMap = all
+		}
+	}
+	if bridge != nil {
+		all[bridge.addr] = bridge.key
+	}
+
+	// the last relay of a request circuit talks to the data server, so ExitNodes say
+	// which relays may be it. A circuit of one relay has it picked as the guard.
+	terminal := ""
+	lastOfRequest := !exit && len(c.path.exit) > 0 && maxRelays > 0 && (bridge != nil || maxRelays > 1)
+	if exit || lastOfRequest {
+		candidates := []string{}
+		for addr := range tnMap {
+			if policy, isExit := exits[addr]; exit && !(isExit && policy.Allows(exitPort)) {
+				continue
+			}
+			if c.path.allows(exitPosition, addr) && (bridge == nil || !c.path.conflict(addr, bridge.addr, all)) {
+				candidates = append(candidates, addr)
+			}
+		}
+		if len(candidates) == 0 && exit {
+			return nil, nil, links, ErrNoExit
+		}
+		if len(candidates) == 0 {
+			return nil, nil, links, wrapError(ErrNotEnoughRelays, errors.New("none of the relays the DS lists is in ExitNodes"))
+		}
+		terminal = candidates[rand.Intn(len(candidates))]
+	}
+
+	// the first hop and the exit are picked before the middles
+	first := ""
+	if bridge != nil {
+		first = bridge.addr
+	} else if !(exit && maxRelays == 1) {
+		// guards are picked among all relays, so one left out isn't taken for gone
+		except := map[string]bool{}
+		for addr := range all {
+			_, usable := tnMap[addr]
+			notLast := !exit && maxRelays == 1 && !c.path.allows(exitPosition, addr)
+			if !usable || notLast || !c.path.allows(entryPosition, addr) || terminal != "" && c.path.conflict(addr, terminal, all) {
+				except[addr] = true
+			}
+		}
+		if first, err = c.guards.pick(all, except); err != nil {
+			return nil, nil, links, err
+		}
+	}
+	fixed := []string{}
+	for _, addr := range []string{first, terminal} {
+		if addr != "" {
+			fixed = append(fixed, addr)
+		}
+	}
+
+	// the middles are picked among the relays left
+	others := make(map[string]rsa.PublicKey, len(tnMap))
+	for addr, key := range tnMap {
+		if addr != first && addr != terminal {
+			others[addr] = key
+		}
+	}
+	length := len(fixed)
+	if bridge != nil {
+		length--
+	}
+	var nodeOrder []string
+	for draw := 1; ; draw++ {
+		middles := c.path.middles(others, fixed, maxRelays-length, all)
+		if length+len(middles) < minRelays {
+			return nil, nil, links, wrapError(ErrNotEnoughRelays, fmt.Errorf("a circuit needs at least %d relays, %d of those the DS lists meet the path rules", c.path.minLength, len(fixed)+len(middles)))
+		}
+		nodeOrder = []string{}
+		if first != "" {
+			nodeOrder = append(nodeOrder, first)
+		}
+		nodeOrder = append(nodeOrder, middles...)
+		if terminal != "" {
+			nodeOrder = append(nodeOrder, terminal)
+		}
+		// another draw may go around a link that failed
+		if draw == pathDraws || !c.avoid.avoids(nodeOrder) {
+			break
+		}
+	}
+	if len(nodeOrder) < c.path.maxLength {
+		fmt.Printf("Client: WARNING only %d relays fit the path rules, building a circuit of %d instead of %d\n", len(nodeOrder), len(nodeOrder), c.path.maxLength)
+	}
+	if err := ValidatePath(nodeOrder, all, c.path.subnetBits); err != nil {
+		return nil, nil, links, err
+	}
+
+	keys := make(map[string]rsa.PublicKey, len(nodeOrder))
+	for _, addr := range nodeOrder {
+		keys[addr] = all[addr]
+	}
+	return nodeOrder, keys, links, nil
+}
+
+// whether tnMap has the relays for a circuit of numRelays, with an exit to exitPort when
+// it isn't 0
+func enoughRelays(tnMap map[string]rsa.PublicKey, exits map[string]utils.ExitPorts, numRelays int, exitPort int) bool {
+	if len(tnMap) < numRelays {
+		return false
+	}
+	if exitPort == 0 {
+		return true
+	}
+	for addr, policy := range exits {
+		if _, ok := tnMap[addr]; ok && policy.Allows(exitPort) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) pickBridge() (*bridgeHop, error) {
+	if len(c.config.Bridges) == 0 {
+		return nil, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.bridge == nil {
+		addr, key, links, err := PickBridge(c.config.Bridges, c.config.LinkConfig)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println("Client: entering through bridge: ", addr)
+		c.bridge = &bridgeHop{addr: addr, key: key, links: links}
+	}
+	return c.bridge, nil
+}
+
+// the bridge went down, the next circuit picks one again
+func (c *Client) dropBridge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bridge = nil
+}
+
+// the relays we know of and the policies of the exits among them, from the DS when the
+// list is stale, fresh is set or no exit we know allows exitPort. The DS is asked one
+// fetch at a time without holding mu, and given up on once ctx is done. The maps are
+// the caller's to change.
+func (c *Client) directory(ctx context.Context, exitPort int, fresh bool) (map[string]rsa.PublicKey, map[string]utils.ExitPorts, error) {
+	c.mu.Lock()
+	asked := c.fetchedAt
+	c.mu.Unlock()
+	select {
+	case c.fetching <- struct{}{}:
+		defer func() { <-c.fetching }()
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+
+	c.mu.Lock()
+	// a list fetched while we waited is as fresh as the one we would fetch
+	stale := c.relays == nil || fresh && c.fetchedAt.Equal(asked) || time.Since(c.fetchedAt) > directoryRefresh
+	relays, exits := copyDirectory(c.relays, c.exits)
+	identity := c.identity
+	c.mu.Unlock()
+
+	fetchedAt := time.Time{}
+	if stale {
+		relays, exits, fetchedAt = map[string]rsa.PublicKey{}, map[string]utils.ExitPorts{}, time.Now()
+		if err := c.fetchDirectory(ctx, 0, relays, exits); err != nil {
+			return nil, nil, err
+		}
+	}
+	exitFetched := exitPort != 0 && !knowsExitTo(exits, exitPort)
+	if exitFetched {
+		if err := c.fetchDirectory(ctx, exitPort, relays, exits); err != nil {
+			return nil, nil, err
+		}
+	}
+	if stale || exitFetched {
+		c.mu.Lock()
+		// relays fetched for the identity before the last NewIdentity are not kept
+		if c.identity == identity {
+			c.relays, c.exits = copyDirectory(relays, exits)
+			if stale {
+				c.fetchedAt = fetchedAt
+			}
+		}
+		c.mu.Unlock()
+	}
+	return relays, exits, nil
+}
+
+func copyDirectory(relays map[string]rsa.PublicKey, exits map[string]utils.ExitPorts) (map[string]rsa.PublicKey, map[string]utils.ExitPorts) {
+	relaysCopy := make(map[string]rsa.PublicKey, len(relays))
+	for addr, key := range relays {
+		relaysCopy[addr] = key
+	}
+	exitsCopy := make(map[string]utils.ExitPorts, len(exits))
+	for addr, policy := range exits {
+		exitsCopy[addr] = policy
+	}
+	return relaysCopy, exitsCopy
+}
+
+// cover circuits come from the relays requests use, the DS isn't asked for every cover onion
+func (c *Client) coverRelays() (map[string]rsa.PublicKey, error) {
+	relays, _, err := c.directory(context.Background(), 0, false)
+	return relays, err
+}
+
+// asks the DS for relays including an exit to exitPort, and adds them to relays and
+// exits. The DS isn't told which relays are our entry guards: while one we hold is
+// missing, we ask for a larger sample until it turns up or the DS has listed them all.
+func (c *Client) fetchDirectory(ctx context.Context, exitPort int, relays map[string]rsa.PublicKey, exits map[string]utils.ExitPorts) error {
+	for numNodes := directoryFetchSize; ; numNodes *= 2 {
+		if numNodes > math.MaxUint16 {
+			numNodes = math.MaxUint16
+		}
+		request := utils.DsRequest{NumNodes: uint16(numNodes), Exit: true, ExitPort: exitPort}
+		response, err := dsExchange(ctx, c.config.DSIPPort, request, nil, c.dsPublicKey, c.vecLogger)
+		if err != nil {
+			return err
+		}
+		if len(response.DnMap) == 0 {
+			return wrapError(ErrBadDSResponse, errors.New("no tor nodes"))
+		}
+		for addr, key := range response.DnMap {
+			relays[addr] = key
+		}
+		for _, addr := range response.Exits {
+			exits[addr] = response.ExitPorts[addr]
+		}
+		// fewer relays than asked for are all the DS has
+		if len(response.DnMap) < numNodes || numNodes == math.MaxUint16 || listsAll(relays, c.guards.addrs()) {
+			return nil
+		}
+	}
+}
+
+func listsAll(relays map[string]rsa.PublicKey, addrs []string) bool {
+	for _, addr := range addrs {
+		if _, ok := relays[addr]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func knowsExitTo(exits map[string]utils.ExitPorts, port int) bool {
+	for _, policy := range exits {
+		if policy.Allows(port) {
+			return true
+		}
+	}
+	return false
+}
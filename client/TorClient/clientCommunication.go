@@ -1,94 +1,358 @@
 package TorClient
 
 import (
+	"context"
 	"crypto/rsa"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strings"
+	"sync"
+	"time"
 
 	"../../keyLibrary"
 	"../../utils"
 	"github.com/DistributedClocks/GoVector/govec"
 )
 
+// ContactDsSerer asks the DS for numNodes tor nodes, by address with their keys
 func ContactDsSerer(DSIp string, numNodes uint16, dsPublicKey rsa.PublicKey, vecLogger *govec.GoLog) (map[string]rsa.PublicKey, error) {
+	response, err := dsExchange(context.Background(), DSIp, utils.DsRequest{NumNodes: numNodes}, nil, dsPublicKey, vecLogger)
+	if err != nil {
+		return nil, err
+	}
+	return response.DnMap, nil
+}
 
-	conn, connErr := getTCPConnection(DSIp)
+// FetchServiceDescriptor looks up the descriptor of an onion service and checks its signature
+func FetchServiceDescriptor(DSIp string, address string, dsPublicKey rsa.PublicKey, vecLogger *govec.GoLog) (*utils.ServiceDescriptor, error) {
+	response, err := dsExchange(context.Background(), DSIp, utils.DsRequest{Service: address}, nil, dsPublicKey, vecLogger)
+	if err != nil {
+		return nil, err
+	}
+	if response.Descriptor == nil {
+		return nil, fmt.Errorf("DS has no descriptor for %s", address)
+	}
+	if err := response.Descriptor.Verify(address); err != nil {
+		return nil, fmt.Errorf("%w: descriptor for %s: %v", ErrBadDSResponse, address, err)
+	}
+	return response.Descriptor, nil
+}
 
-	if connErr != nil {
-		return nil, connErr
+// PublishServiceDescriptor hands a signed descriptor to the DS
+func PublishServiceDescriptor(DSIp string, descriptor utils.ServiceDescriptor, dsPublicKey rsa.PublicKey, vecLogger *govec.GoLog) error {
+	body, err := utils.Marshall(descriptor)
+	if err != nil {
+		return err
+	}
+	response, err := dsExchange(context.Background(), DSIp, utils.DsRequest{Publish: true}, body, dsPublicKey, vecLogger)
+	if err != nil {
+		return err
+	}
+	if !response.Published {
+		return errors.New("DS rejected the descriptor")
+	}
+	return nil
+}
+
+// one request to the DS, body goes along encrypted with the request key. It is over by
+// ctx's deadline, or dsTimeout from now without one, and gives up once ctx is done.
+// Network failures are ErrDSUnreachable, an answer we can't read ErrBadDSResponse.
+func dsExchange(ctx context.Context, DSIp string, request utils.DsRequest, body []byte, dsPublicKey rsa.PublicKey, vecLogger *govec.GoLog) (response utils.DsResponse, err error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(dsTimeout)
+	}
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return response, ErrDeadlineExceeded
+	}
+	conn, err := utils.DialTLS(DSIp, fingerprint(dsPublicKey), nil, timeout)
+	if err != nil {
+		return response, wrapError(ErrDSUnreachable, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+	// cancelling ctx makes the next read or write fail
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}()
+
+	request.SymmKey = keyLibrary.GenerateSymmKey()
+	reqBytes, err := utils.Marshall(request)
+	if err != nil {
+		return response, err
+	}
+	encryptedReq, err := keyLibrary.PubKeyEncrypt(&dsPublicKey, reqBytes)
+	if err != nil {
+		return response, err
+	}
+	if _, err := utils.TCPWrite(conn, encryptedReq, vecLogger, "Sending request to dir_server"); err != nil {
+		return response, wrapError(ErrDSUnreachable, err)
+	}
+	if body != nil {
+		encryptedBody, err := keyLibrary.SymmKeyEncryptBase64(body, request.SymmKey)
+		if err != nil {
+			return response, err
+		}
+		if _, err := utils.TCPWrite(conn, encryptedBody, vecLogger, "Sending request body to dir_server"); err != nil {
+			return response, wrapError(ErrDSUnreachable, err)
+		}
 	}
 
-	symmKey := sendReqToDs(numNodes, dsPublicKey, conn, vecLogger)
+	buf, err := utils.TCPRead(conn, vecLogger, "Received response from dir_server")
+	if err != nil {
+		return response, wrapError(ErrDSUnreachable, err)
+	}
+	decrypted, err := keyLibrary.SymmKeyDecryptBase64(buf, request.SymmKey)
+	if err != nil {
+		return response, wrapError(ErrBadDSResponse, err)
+	}
+	if err := utils.UnMarshall(decrypted, &response); err != nil {
+		return response, wrapError(ErrBadDSResponse, err)
+	}
+	return response, nil
+}
+
+// nodeOrder is the circuit the onion was built for, from T1 to the data server, with
+// their keys in tnMap. links picks the transport to T1. deadline is the one the onion
+// was built with, the zero time for none.
+func SendOnionMessage(nodeOrder []string, tnMap map[string]rsa.PublicKey, onion []byte, symmKeys [][]byte, links utils.LinkConfig, flowControl utils.FlowControlConfig, deadline time.Time, vecLogger *govec.GoLog) (string, error) {
 
-	return readResFromDs(conn, symmKey, vecLogger), nil
+	reader, err := SendOnionMessageStream(nodeOrder, tnMap, onion, symmKeys, links, flowControl, deadline, vecLogger)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
 
+	return readResponse(reader)
 }
 
-func SendOnionMessage(t1 string, onion []byte, symmKeys [][]byte, vecLogger *govec.GoLog) (string, error) {
+// SendOnionMessageStream sends the onion and returns a reader for the response frames as they arrive
+func SendOnionMessageStream(nodeOrder []string, tnMap map[string]rsa.PublicKey, onion []byte, symmKeys [][]byte, links utils.LinkConfig, flowControl utils.FlowControlConfig, deadline time.Time, vecLogger *govec.GoLog) (*ResponseReader, error) {
 
-	conn, connErr := getTCPConnection(t1)
+	transport, transportErr := links.TransportFor(nodeOrder[0])
+	if transportErr != nil {
+		return nil, transportErr
+	}
+	var dialTimeout time.Duration
+	if !deadline.IsZero() {
+		dialTimeout = time.Until(deadline)
+		if dialTimeout <= 0 {
+			return nil, ErrDeadlineExceeded
+		}
+	}
+	conn, connErr := utils.DialLink(transport, nodeOrder[0], fingerprint(tnMap[nodeOrder[0]]), nil, dialTimeout)
 
 	if connErr != nil {
-		return "", connErr
+		return nil, &HopError{Hop: 0, Addr: nodeOrder[0], Reason: utils.ReasonUnreachable}
 	}
+	// T1 reports a timeout just before this, we only stop waiting when it doesn't
+	conn.SetReadDeadline(deadline)
 	fmt.Printf("Client: Sending %d bytes onion message\n", len(onion))
 
-	utils.TCPWrite(conn, onion, vecLogger, "Sending onion request to Tor network")
+	_, werr := utils.WriteData(conn, onion, vecLogger, "Sending onion request to Tor network")
+	if werr != nil {
+		conn.Close()
+		return nil, &HopError{Hop: 0, Addr: nodeOrder[0], Reason: utils.ReasonConnectionClosed}
+	}
+
+	digests := make([]*utils.RunningDigest, len(symmKeys))
+	for i, symmKey := range symmKeys {
+		digests[i] = utils.NewRunningDigest(symmKey)
+	}
 
-	return readResponse(conn, symmKeys, vecLogger), nil
+	return &ResponseReader{
+		conn:      conn,
+		nodeOrder: nodeOrder,
+		symmKeys:  symmKeys,
+		digests:   digests,
+		window:    utils.NewReceiveWindow(flowControl),
+		vecLogger: vecLogger,
+	}, nil
 }
 
-func readResponse(conn *net.TCPConn, symmKeys [][]byte, vecLogger *govec.GoLog) string {
+// ResponseReader decrypts a server response one frame at a time, and acknowledges
+// frames with sendmes so the server keeps sending
+type ResponseReader struct {
+	conn      net.Conn
+	nodeOrder []string
+	symmKeys  [][]byte
+	digests   []*utils.RunningDigest // one per hop, the data server's last
+	window    *utils.ReceiveWindow
+	vecLogger *govec.GoLog
+	done      bool       // guarded by writeMu, Close may come from another goroutine than Next
+	writeMu   sync.Mutex // cells to T1 come from Next and from whoever sends frames on the circuit
+}
+
+// Next returns the next part of the response, io.EOF once the server has sent all of it
+func (r *ResponseReader) Next() (string, error) {
+	if r.finished() {
+		return "", io.EOF
+	}
 
-	bytesRead, err := utils.TCPRead(conn, vecLogger, "Received onion response from Tor network")
+	cell, err := utils.ReadCell(r.conn, r.vecLogger, "Received onion response from Tor network")
 
+	if timeoutErr, ok := err.(net.Error); ok && timeoutErr.Timeout() {
+		r.finish()
+		return "", ErrDeadlineExceeded
+	}
+	if err == io.EOF {
+		// T1 hung up without a word
+		r.finish()
+		return "", &HopError{Hop: 0, Addr: r.nodeOrder[0], Reason: utils.ReasonConnectionClosed}
+	}
 	if err != nil {
-		panic("can not read response from connection")
+		r.finish()
+		return "", err
 	}
 
-	return DecryptServerResponse(bytesRead, symmKeys)
-}
+	switch cell.Command {
+	case utils.CellEnd:
+		r.finish()
+		return "", io.EOF
+	case utils.CellDestroy:
+		r.finish()
+		return "", traceDestroy(cell, r.nodeOrder, r.symmKeys)
+	}
 
-func sendReqToDs(numNodes uint16, dsPublicKey rsa.PublicKey, conn *net.TCPConn, vecLogger *govec.GoLog) []byte {
-	symmKey := keyLibrary.GenerateSymmKey()
+	// a failed sendme is not fatal: the server may be done already, and a broken
+	// circuit shows up on the next read
+	for _, streamID := range r.window.Delivered(cell.StreamID) {
+		r.writeCell(utils.Cell{Command: utils.CellSendme, StreamID: streamID}, "Sendme sent to Tor network")
+	}
 
-	request := utils.DsRequest{numNodes, symmKey}
-	reqBytes, err := utils.Marshall(request)
+	return r.openFrame(cell.Payload)
+}
+
+// peel a response frame, checking the running digest of every hop on the way. A layer
+// that doesn't decrypt or verify was altered, dropped or reordered after that hop sent
+// it, the circuit is torn down.
+func (r *ResponseReader) openFrame(frame []byte) (string, error) {
+	last := len(r.symmKeys) - 1
+	for i := 0; i < last; i++ {
+		decrypted, err := keyLibrary.SymmKeyDecrypt(frame, r.symmKeys[i])
+		var layer utils.Onion
+		if err == nil {
+			err = utils.UnMarshall(decrypted, &layer)
+		}
+		if err != nil {
+			return "", r.frameFailed(i, utils.ReasonDecryptFailed)
+		}
+		if !r.digests[i].Verify(layer.Payload, layer.Digest) {
+			return "", r.frameFailed(i, utils.ReasonIntegrity)
+		}
+		frame = layer.Payload
+	}
 
+	decrypted, err := keyLibrary.SymmKeyDecrypt(frame, r.symmKeys[last])
+	var response utils.Response
+	if err == nil {
+		err = utils.UnMarshall(decrypted, &response)
+	}
 	if err != nil {
-		fmt.Println("Bad marshalling")
+		return "", r.frameFailed(last, utils.ReasonDecryptFailed)
 	}
+	if !r.digests[last].Verify([]byte(response.Value), response.Digest) {
+		return "", r.frameFailed(last, utils.ReasonIntegrity)
+	}
+	return response.Value, nil
+}
 
-	encryptedBytes, _ := keyLibrary.PubKeyEncrypt(&dsPublicKey, reqBytes)
-	utils.TCPWrite(conn, encryptedBytes, vecLogger, "Contact dir_server for tor nodes")
+// tears the circuit down over a frame whose layer of hop did not open
+func (r *ResponseReader) frameFailed(hop int, reason utils.DestroyReason) error {
+	r.finish()
+	r.writeCell(utils.Cell{Command: utils.CellDestroy, Reason: reason}, "Circuit destroyed by client")
+	return &HopError{Hop: hop, Addr: r.nodeOrder[hop], Reason: reason}
+}
 
-	return symmKey
+// Close tears down the circuit if the response is not complete yet
+func (r *ResponseReader) Close() error {
+	if !r.finish() {
+		r.writeCell(utils.Cell{Command: utils.CellDestroy, Reason: utils.ReasonRequested}, "Circuit closed by client")
+	}
+	return r.conn.Close()
 }
 
-func readResFromDs(conn *net.TCPConn, symmKey []byte, vecLogger *govec.GoLog) map[string]rsa.PublicKey {
-	buf, err := utils.TCPRead(conn, vecLogger, "Received tor nodes from dir_server")
+// finish marks the response complete, and tells whether it already was
+func (r *ResponseReader) finish() bool {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	wasDone := r.done
+	r.done = true
+	return wasDone
+}
 
-	if err != nil {
-		panic("can not read response from DS connection")
-	}
+func (r *ResponseReader) finished() bool {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	return r.done
+}
 
-	decryptedBytes, err := keyLibrary.SymmKeyDecryptBase64(buf, symmKey)
-	if err != nil {
-		fmt.Println(err)
-		panic("can not decrypt response from DS")
-	}
+func (r *ResponseReader) writeCell(cell utils.Cell, vecMsg string) error {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	_, err := utils.WriteCell(r.conn, cell, r.vecLogger, vecMsg)
+	return err
+}
 
-	var dsResponse utils.DsResponse
-	err = utils.UnMarshall(decryptedBytes, &dsResponse)
-	if err != nil {
-		fmt.Println(err)
-		panic("readResFromDs: Unmarshalling failed")
+// peel the destroy payload one layer at a time until the layer of the relay that sent it.
+// An empty payload comes from T1 before it had a circuit key.
+func traceDestroy(cell *utils.Cell, nodeOrder []string, symmKeys [][]byte) *HopError {
+	hopError := &HopError{Hop: 0, Reason: cell.Reason}
+	payload := cell.Payload
+
+	if len(payload) > 0 {
+		hopError.Hop = -1
+		for i := 0; i < len(symmKeys); i++ {
+			decrypted, err := keyLibrary.SymmKeyDecrypt(payload, symmKeys[i])
+			if err != nil {
+				break
+			}
+			var layer utils.Onion
+			if utils.UnMarshall(decrypted, &layer) != nil {
+				break
+			}
+
+			// the other layers hold ciphertext, which never parses as JSON
+			var info utils.DestroyInfo
+			if utils.UnMarshall(layer.Payload, &info) == nil {
+				hopError.Hop, hopError.Reason = i, info.Reason
+				if info.NextHop {
+					hopError.Hop++
+				}
+				break
+			}
+			payload = layer.Payload
+		}
 	}
 
-	return dsResponse.DnMap
+	if hopError.Hop >= len(nodeOrder) {
+		hopError.Hop = len(nodeOrder) - 1
+	}
+	if hopError.Hop >= 0 {
+		hopError.Addr = nodeOrder[hopError.Hop]
+	}
+	return hopError
 }
 
-func getTCPConnection(ip string) (*net.TCPConn, error) {
-	raddr, _ := net.ResolveTCPAddr("tcp", ip)
-	return net.DialTCP("tcp", nil, raddr)
+// read the whole response
+func readResponse(reader *ResponseReader) (string, error) {
+
+	var response strings.Builder
+	for {
+		part, err := reader.Next()
+		if err == io.EOF {
+			return response.String(), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		response.WriteString(part)
+	}
 }
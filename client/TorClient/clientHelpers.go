@@ -2,97 +2,122 @@ package TorClient
 
 import (
 	"crypto/rsa"
+	"fmt"
 	"math/rand"
 	"time"
 	"../../keyLibrary"
 	"../../utils"
 )
 
-const byteSize = 150
-
 //returns a list of symmetrical keys from T1 to Tn
-//and the onion message
-func CreateOnionMessage(nodeOrder []string, tnMap map[string]rsa.PublicKey, reqKey string) ([]byte, [][]byte) {
+//and the onion message. Every hop gets the request deadline, see utils.HopDeadline
+func CreateOnionMessage(nodeOrder []string, tnMap map[string]rsa.PublicKey, reqKey string, deadline time.Time) ([]byte, [][]byte, error) {
+	return createRequestOnion(nodeOrder, tnMap, utils.Request{Key: reqKey}, deadline)
+}
+
+// like CreateOnionMessage, for any request to the data server
+func createRequestOnion(nodeOrder []string, tnMap map[string]rsa.PublicKey, req utils.Request, deadline time.Time) ([]byte, [][]byte, error) {
 
 	var onionMessage []byte
 	var symKeys [][]byte
 
-	ServerSymKey := keyLibrary.GenerateSymmKey()
-
-	request, _ := utils.Marshall(utils.Request{Key: reqKey, SymmKey: ServerSymKey})
+	marshalledRequest, ServerSymKey, err := sealRequest(req, tnMap[nodeOrder[len(nodeOrder)-1]], utils.HopDeadline(deadline, len(nodeOrder)-1))
+	if err != nil {
+		return nil, nil, err
+	}
 
 	symKeys = append(symKeys, ServerSymKey)
 
-	encryptedRequest := EncryptPayload(request, tnMap[nodeOrder[len(nodeOrder)-1]])
-
-	marshalledRequest, _ := utils.Marshall(encryptedRequest)
-
 	for i := len(nodeOrder) - 2; i > -1; i-- {
 		var outerOnionMessage utils.Onion
 
 		symmKey := keyLibrary.GenerateSymmKey()
 
 		outerOnionMessage.SymmKey = symmKey
+		outerOnionMessage.Deadline = utils.HopDeadline(deadline, i)
 		symKeys = append([][]byte{symmKey}, symKeys...)
 
 		if i == len(nodeOrder)-2 {
 			//this is onion message to the server
 			outerOnionMessage.NextIpPort = nodeOrder[len(nodeOrder)-1]
+			outerOnionMessage.NextFingerprint = fingerprint(tnMap[nodeOrder[len(nodeOrder)-1]])
 
 			outerOnionMessage.Payload = marshalledRequest
-
-			marshalledOnion, _ := utils.Marshall(outerOnionMessage)
-
-			encryptedOnion := EncryptPayload(marshalledOnion, tnMap[nodeOrder[len(nodeOrder)-2]])
-
-			finalMarshalledOnion, _ := utils.Marshall(encryptedOnion)
-
-			onionMessage = finalMarshalledOnion
-
 		} else {
 
 			outerOnionMessage.NextIpPort = nodeOrder[i+1]
-
-			nodePublicKey := tnMap[nodeOrder[i]]
+			outerOnionMessage.NextFingerprint = fingerprint(tnMap[nodeOrder[i+1]])
 
 			outerOnionMessage.Payload = onionMessage
-			marshalledOnion, _ := utils.Marshall(outerOnionMessage)
-
-			encryptedOnion := EncryptPayload(marshalledOnion, nodePublicKey)
-
-			finalMarshalledOnion, _ := utils.Marshall(encryptedOnion)
-
-			onionMessage = finalMarshalledOnion
+		}
+		outerOnionMessage.Digest = utils.LayerDigest(outerOnionMessage)
 
+		onionMessage, err = sealLayer(outerOnionMessage, tnMap[nodeOrder[i]])
+		if err != nil {
+			return nil, nil, err
 		}
 	}
 
-	return onionMessage, symKeys
+	return onionMessage, symKeys, nil
 
 }
 
-func EncryptPayload(onionBytes []byte, key rsa.PublicKey) [][]byte {
-	var encryptedPayload [][]byte
-
-	counter := 0
-
-	for counter+byteSize-1 < len(onionBytes) {
-
-		encryptedSlice, _ := keyLibrary.PubKeyEncrypt(&key, onionBytes[counter:counter+byteSize])
-
-		encryptedPayload = append(encryptedPayload, encryptedSlice)
+// the data server's layer, carrying req. Returns it with the key the server encrypts
+// its response with.
+func sealRequest(req utils.Request, serverKey rsa.PublicKey, deadline int64) ([]byte, []byte, error) {
+	symmKey := keyLibrary.GenerateSymmKey()
+	req.SymmKey, req.Deadline = symmKey, deadline
+	request, err := utils.Marshall(req)
+	if err != nil {
+		return nil, nil, wrapError(ErrOnionBuild, err)
+	}
+	encryptedRequest, err := EncryptPayload(request, serverKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	marshalledRequest, err := utils.Marshall(encryptedRequest)
+	if err != nil {
+		return nil, nil, wrapError(ErrOnionBuild, err)
+	}
+	return marshalledRequest, symmKey, nil
+}
 
-		counter += byteSize
+// marshals a layer and encrypts it to the key of the relay that peels it
+func sealLayer(layer utils.Onion, key rsa.PublicKey) ([]byte, error) {
+	sealed, err := utils.SealLayer(layer, key)
+	if err != nil {
+		return nil, wrapError(ErrOnionBuild, err)
 	}
+	return sealed, nil
+}
 
-	lastEncryptedSlice, _ := keyLibrary.PubKeyEncrypt(&key, onionBytes[counter:])
+// wraps the layer of the last relay, which has no next hop, in the layers of the
+// relays before it. returns the onion and the symmetric keys from T1 to Tn
+func createRelayOnion(nodeOrder []string, tnMap map[string]rsa.PublicKey, innerOnion utils.Onion) ([]byte, [][]byte, error) {
+	onion, symmKeys, err := utils.WrapRelayOnion(nodeOrder, tnMap, innerOnion)
+	if err != nil {
+		return nil, nil, wrapError(ErrOnionBuild, err)
+	}
+	return onion, symmKeys, nil
+}
 
-	encryptedPayload = append(encryptedPayload, lastEncryptedSlice)
+// the next hop verifies its TLS link against this
+func fingerprint(key rsa.PublicKey) string {
+	return keyLibrary.KeyFingerprint(&key)
+}
 
-	return encryptedPayload
+// EncryptPayload encrypts onionBytes to key in chunks small enough for RSA
+func EncryptPayload(onionBytes []byte, key rsa.PublicKey) ([][]byte, error) {
+	encryptedPayload, err := utils.EncryptChunks(onionBytes, key)
+	if err != nil {
+		return nil, wrapError(ErrOnionBuild, err)
+	}
+	return encryptedPayload, nil
 }
 
-func DecryptServerResponse(onionBytes []byte, symmKeys [][]byte) string {
+// DecryptServerResponse peels a whole response with the circuit keys, the data server's
+// last. Fails with ErrDecryptFailed.
+func DecryptServerResponse(onionBytes []byte, symmKeys [][]byte) (string, error) {
 
 	currBytes := onionBytes
 
@@ -101,14 +126,14 @@ func DecryptServerResponse(onionBytes []byte, symmKeys [][]byte) string {
 		decryptedOnionBytes, err := keyLibrary.SymmKeyDecrypt(currBytes, symmKeys[i])
 
 		if err != nil {
-			panic("can not decrypt onion using symmKey")
+			return "", fmt.Errorf("%w: layer of hop %d: %v", ErrDecryptFailed, i, err)
 		}
 
 		var unmarshalledOnion utils.Onion
 		err = utils.UnMarshall(decryptedOnionBytes, &unmarshalledOnion)
 
 		if err != nil {
-			panic("can not unmarshal onion")
+			return "", fmt.Errorf("%w: layer of hop %d: %v", ErrDecryptFailed, i, err)
 		}
 
 		currBytes = unmarshalledOnion.Payload
@@ -116,31 +141,25 @@ func DecryptServerResponse(onionBytes []byte, symmKeys [][]byte) string {
 
 	decryptedResponse, err  := keyLibrary.SymmKeyDecrypt(currBytes, symmKeys[len(symmKeys) - 1])
 	if err != nil {
-		panic("cant decrypt server response")
+		return "", fmt.Errorf("%w: server response: %v", ErrDecryptFailed, err)
 	}
 
 	var resObj utils.Response
-	utils.UnMarshall(decryptedResponse, &resObj)
+	err = utils.UnMarshall(decryptedResponse, &resObj)
+	if err != nil {
+		return "", fmt.Errorf("%w: server response: %v", ErrDecryptFailed, err)
+	}
 
-	return resObj.Value
+	return resObj.Value, nil
 }
 
+// DetermineTnOrder returns the relays of tnMap in random order, none when it is empty
 func DetermineTnOrder(tnMap map[string]rsa.PublicKey) []string {
 
-	keys := getKeysFromMap(tnMap)
-
-	order := make([]string, 0)
-
-	rand.Seed(time.Now().Unix())
-	for len(keys) > 1 {
-		i := rand.Intn(len(keys) - 1)
-		order = append(order, keys[i])
-
-		keys[i] = keys[len(keys)-1]
-		keys = keys[:len(keys)-1]
-	}
+	order := getKeysFromMap(tnMap)
+	rand.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
 
-	return append(order, keys[0])
+	return order
 }
 
 func getKeysFromMap(m map[string]rsa.PublicKey) []string {
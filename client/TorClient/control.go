@@ -0,0 +1,216 @@
+package TorClient
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	controlCookieBytes = 32
+	// a controller that hasn't authenticated by then is hung up on
+	controlAuthTimeout = 30 * time.Second
+)
+
+// ServeControl accepts controllers on listener and answers them in a subset of Tor's
+// control protocol, one command per line:
+//
+//	PROTOCOLINFO                the ways to authenticate
+//	AUTHENTICATE "password"     or the cookie from CookieFile in hex, before anything else
+//	GETINFO circuit-status      the circuits with their states and hops
+//	CLOSECIRCUIT ID             tears a circuit down
+//	SIGNAL NEWNYM               new circuits for everything from now on, see NewIdentity
+//	SETEVENTS [CIRC]            circuit events as 650 lines, none without CIRC
+//	QUIT
+//
+// Controllers authenticate with the Password or the cookie of the ControlPort config.
+// A new cookie is written to CookieFile first. Returns once accepting fails, or right
+// away when the config has no way to authenticate.
+func (c *Client) ServeControl(listener net.Listener) error {
+	config := c.config.ControlPort
+	if config.Password == "" && config.CookieFile == "" {
+		return errors.New("the control port needs a Password or a CookieFile")
+	}
+	var cookie []byte
+	if config.CookieFile != "" {
+		cookie = make([]byte, controlCookieBytes)
+		if _, err := rand.Read(cookie); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(config.CookieFile, cookie, 0600); err != nil {
+			return fmt.Errorf("writing the control cookie: %w", err)
+		}
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go c.serveControlConn(conn, cookie)
+	}
+}
+
+// one controller's connection
+type controlConn struct {
+	conn    net.Conn
+	writeMu sync.Mutex // events are written while commands are answered
+}
+
+// writes a reply of one or more lines, each ending in CRLF
+func (cc *controlConn) reply(lines ...string) error {
+	cc.writeMu.Lock()
+	defer cc.writeMu.Unlock()
+	_, err := cc.conn.Write([]byte(strings.Join(lines, "\r\n") + "\r\n"))
+	return err
+}
+
+func (c *Client) serveControlConn(conn net.Conn, cookie []byte) {
+	defer conn.Close()
+	cc := &controlConn{conn: conn}
+	authenticated := false
+	var stopEvents func()
+	defer func() {
+		if stopEvents != nil {
+			stopEvents()
+		}
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(controlAuthTimeout))
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command, args := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			command, args = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		command = strings.ToUpper(command)
+
+		switch {
+		case command == "PROTOCOLINFO":
+			err = cc.reply("250-PROTOCOLINFO 1", c.controlAuthMethods(), "250 OK")
+		case command == "AUTHENTICATE":
+			if !c.controlAuthenticates(args, cookie) {
+				cc.reply("515 Authentication failed")
+				return
+			}
+			authenticated = true
+			conn.SetReadDeadline(time.Time{})
+			err = cc.reply("250 OK")
+		case command == "QUIT":
+			cc.reply("250 closing connection")
+			return
+		case !authenticated:
+			cc.reply("514 Authentication required")
+			return
+		case command == "GETINFO":
+			err = c.controlGetInfo(cc, args)
+		case command == "CLOSECIRCUIT":
+			// Tor takes flags after the ID, we have none
+			fields := strings.Fields(args)
+			var id uint64
+			parseErr := errors.New("no ID")
+			if len(fields) > 0 {
+				id, parseErr = strconv.ParseUint(fields[0], 10, 64)
+			}
+			if parseErr != nil {
+				err = cc.reply("512 Syntax error: CLOSECIRCUIT ID")
+			} else if closeErr := c.CloseCircuit(id); closeErr != nil {
+				err = cc.reply("552 " + closeErr.Error())
+			} else {
+				err = cc.reply("250 OK")
+			}
+		case command == "SIGNAL":
+			if strings.ToUpper(args) != "NEWNYM" {
+				err = cc.reply("552 Unrecognized signal " + args)
+				break
+			}
+			c.NewIdentity()
+			err = cc.reply("250 OK")
+		case command == "SETEVENTS":
+			events := strings.ToUpper(args)
+			if events != "" && events != "CIRC" {
+				err = cc.reply("552 Unrecognized event " + args)
+				break
+			}
+			if stopEvents != nil {
+				stopEvents()
+				stopEvents = nil
+			}
+			if events == "CIRC" {
+				var circuitEvents <-chan CircuitInfo
+				circuitEvents, stopEvents = c.CircuitEvents()
+				go cc.forwardEvents(circuitEvents)
+			}
+			err = cc.reply("250 OK")
+		default:
+			err = cc.reply(fmt.Sprintf("510 Unrecognized command %q", command))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *Client) controlAuthMethods() string {
+	methods := []string{}
+	if c.config.ControlPort.Password != "" {
+		methods = append(methods, "PASSWORD")
+	}
+	if c.config.ControlPort.CookieFile != "" {
+		methods = append(methods, "COOKIE COOKIEFILE="+strconv.Quote(c.config.ControlPort.CookieFile))
+	}
+	return "250-AUTH METHODS=" + strings.Join(methods, ",")
+}
+
+// a quoted argument is the password, anything else the cookie in hex
+func (c *Client) controlAuthenticates(arg string, cookie []byte) bool {
+	if strings.HasPrefix(arg, "\"") {
+		password, err := strconv.Unquote(arg)
+		want := c.config.ControlPort.Password
+		return err == nil && want != "" && subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1
+	}
+	given, err := hex.DecodeString(arg)
+	return err == nil && cookie != nil && subtle.ConstantTimeCompare(given, cookie) == 1
+}
+
+func (c *Client) controlGetInfo(cc *controlConn, key string) error {
+	if key != "circuit-status" {
+		return cc.reply("552 Unrecognized key " + strconv.Quote(key))
+	}
+	lines := []string{"250+circuit-status="}
+	for _, info := range c.Circuits() {
+		lines = append(lines, circuitLine(info))
+	}
+	return cc.reply(append(lines, ".", "250 OK")...)
+}
+
+// passes circuit events on until events is closed or the controller is gone
+func (cc *controlConn) forwardEvents(events <-chan CircuitInfo) {
+	for event := range events {
+		if cc.reply("650 CIRC "+circuitLine(event)) != nil {
+			return
+		}
+	}
+}
+
+// ID STATE hop,hop PURPOSE=... TIME=... [REASON="..."], like Tor's circuit-status lines
+func circuitLine(info CircuitInfo) string {
+	line := fmt.Sprintf("%d %s %s PURPOSE=%s TIME=%s", info.ID, info.State, strings.Join(info.Path, ","), info.Purpose, info.Since.UTC().Format(time.RFC3339Nano))
+	if info.Reason != "" {
+		line += " REASON=" + strconv.Quote(info.Reason)
+	}
+	return line
+}
@@ -0,0 +1,81 @@
+package TorClient
+
+import (
+	"errors"
+	"fmt"
+
+	"../../utils"
+)
+
+// Every TorClient function returns its errors instead of panicking. Match them with
+// errors.Is against the sentinels below, or errors.As with *HopError for a circuit
+// that a hop tore down.
+
+// the DS could not be dialed, or hung up before it answered
+var ErrDSUnreachable = errors.New("directory server unreachable")
+
+// the DS answered with something that doesn't decrypt or parse, or doesn't verify
+var ErrBadDSResponse = errors.New("bad response from directory server")
+
+// the DS knows no exit relay that allows the destination to Dial through
+var ErrNoExit = errors.New("no exit relay available")
+
+// the directory has too few relays for a circuit of MinLength that meets the path rules
+var ErrNotEnoughRelays = errors.New("not enough relays for a circuit")
+
+// a path has a relay twice, or two relays in one subnet
+var ErrInvalidPath = errors.New("invalid circuit path")
+
+// a relay on the circuit was out of capacity and rejected it, try again later or on another circuit
+var ErrRelayOverloaded = errors.New("relay overloaded")
+
+// the request deadline passed before the response was complete
+var ErrDeadlineExceeded = errors.New("request deadline exceeded")
+
+// the circuit took longer to build than the timeout the client learned, see ParetoTimeout
+var ErrCircuitTimeout = errors.New("circuit timed out")
+
+// a response could not be decrypted with the circuit keys, or a hop could not decrypt
+// its layer of the onion
+var ErrDecryptFailed = errors.New("response decryption failed")
+
+// an onion could not be built, the keys or addresses it was given are unusable
+var ErrOnionBuild = errors.New("could not build onion")
+
+// HopError is returned when a hop tore the circuit down, so callers can route around it.
+// Hop indexes the circuit the onion was built for, the data server being the last hop;
+// it is -1 when the destroy could not be traced back to a hop. With ReasonIntegrity or
+// ReasonDecryptFailed from the client it is the hop whose layer of a response failed to
+// verify or decrypt, the tampering happened between it and the client.
+type HopError struct {
+	Hop    int
+	Addr   string
+	Reason utils.DestroyReason
+}
+
+func (e *HopError) Error() string {
+	if e.Hop < 0 {
+		return fmt.Sprintf("circuit destroyed at unknown hop: %s", e.Reason)
+	}
+	return fmt.Sprintf("circuit destroyed at hop %d (%s): %s", e.Hop, e.Addr, e.Reason)
+}
+
+// errors.Is(err, ErrRelayOverloaded) holds for an overloaded hop,
+// errors.Is(err, ErrDeadlineExceeded) for a hop that gave up on the deadline, and
+// errors.Is(err, ErrDecryptFailed) for a layer that did not decrypt on either side
+func (e *HopError) Is(target error) bool {
+	switch target {
+	case ErrRelayOverloaded:
+		return e.Reason == utils.ReasonOverloaded
+	case ErrDeadlineExceeded:
+		return e.Reason == utils.ReasonTimeout
+	case ErrDecryptFailed:
+		return e.Reason == utils.ReasonDecryptFailed
+	}
+	return false
+}
+
+// wraps err under one of the sentinels, keeping both in the message
+func wrapError(sentinel error, err error) error {
+	return fmt.Errorf("%w: %v", sentinel, err)
+}
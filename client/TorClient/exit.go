@@ -0,0 +1,145 @@
+package TorClient
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"../../utils"
+	"github.com/DistributedClocks/GoVector/govec"
+)
+
+// bytes sent to the exit in one frame
+const exitFrameBytes = 4096
+
+// DialExit opens a TCP connection to addr from the last relay of nodeOrder, which must
+// be an exit. The returned conn carries bytes both ways through the circuit.
+func DialExit(nodeOrder []string, tnMap map[string]rsa.PublicKey, addr string, links utils.LinkConfig, flowControl utils.FlowControlConfig, vecLogger *govec.GoLog) (net.Conn, error) {
+	circuit, err := OpenServiceCircuit(nodeOrder, tnMap, utils.ServiceCell{Command: utils.ServiceConnect, Address: addr}, links, flowControl, vecLogger)
+	if err != nil {
+		return nil, err
+	}
+	// a destroy from past the exit is about addr
+	circuit.reader.nodeOrder = append(circuit.reader.nodeOrder, addr)
+	if err := circuit.ExpectFrame(utils.ServiceConnect); err != nil {
+		circuit.Close()
+		return nil, err
+	}
+	return &exitConn{circuit: circuit, exit: nodeOrder[len(nodeOrder)-1], addr: addr}, nil
+}
+
+// exitConn is a TCP connection opened by an exit relay, seen through the circuit to it
+type exitConn struct {
+	circuit *ServiceCircuit
+	exit    string
+	addr    string
+
+	readMu  sync.Mutex
+	pending []byte // read from a frame but not handed out yet
+	readErr error
+
+	onClose   func() // tells the client's circuit list, nil outside a client
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func (c *exitConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for len(c.pending) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		c.pending, c.readErr = c.nextData()
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// the next data frame from the exit, skipping keepalives. io.EOF once the target hung up.
+func (c *exitConn) nextData() ([]byte, error) {
+	for {
+		value, err := c.circuit.reader.Next()
+		if err != nil {
+			return nil, err
+		}
+		var frame utils.ServiceFrame
+		if err := utils.UnMarshall([]byte(value), &frame); err != nil {
+			return nil, err
+		}
+		switch frame.Command {
+		case utils.ServiceData:
+			return frame.Data, nil
+		case utils.ServiceKeepalive:
+		default:
+			return nil, fmt.Errorf("expected exit data, received service frame %d", frame.Command)
+		}
+	}
+}
+
+func (c *exitConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		end := written + exitFrameBytes
+		if end > len(b) {
+			end = len(b)
+		}
+		if err := c.circuit.SendData(b[written:end]); err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
+}
+
+// CloseWrite tells the exit we are done sending, it half-closes the target connection
+func (c *exitConn) CloseWrite() error {
+	return c.circuit.SendEnd()
+}
+
+// Close tears the circuit down once, both directions of a splice close the conn
+func (c *exitConn) Close() error {
+	c.closeOnce.Do(func() {
+		if c.onClose != nil {
+			c.onClose()
+		}
+		c.closeErr = c.circuit.Close()
+	})
+	return c.closeErr
+}
+
+func (c *exitConn) LocalAddr() net.Addr {
+	return circuitAddr(c.circuit.reader.conn.LocalAddr().String())
+}
+
+// the target, as far as we know it, the exit resolves the name
+func (c *exitConn) RemoteAddr() net.Addr {
+	return circuitAddr(c.addr)
+}
+
+func (c *exitConn) SetDeadline(t time.Time) error {
+	return c.circuit.reader.conn.SetDeadline(t)
+}
+
+func (c *exitConn) SetReadDeadline(t time.Time) error {
+	return c.circuit.reader.conn.SetReadDeadline(t)
+}
+
+func (c *exitConn) SetWriteDeadline(t time.Time) error {
+	return c.circuit.reader.conn.SetWriteDeadline(t)
+}
+
+// an address at the other end of a circuit
+type circuitAddr string
+
+func (a circuitAddr) Network() string {
+	return "tor"
+}
+
+func (a circuitAddr) String() string {
+	return string(a)
+}
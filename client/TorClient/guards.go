@@ -0,0 +1,289 @@
+package TorClient
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"../../utils"
+)
+
+const (
+	defaultNumGuards     = 3
+	defaultGuardLifetime = 60 * 24 * time.Hour
+	// an unreachable guard isn't tried again for this long, unless every guard is down
+	guardRetryInterval = 10 * time.Minute
+	// a guard that was unreachable or left the network this long ago is replaced
+	guardDropAfter = 7 * 24 * time.Hour
+	// guards kept at most, per guard wanted. Relays going down can't make us try the whole
+	// network as entry that way.
+	guardSampleFactor = 2
+)
+
+// DefaultGuardStateFile is where the client commands keep the guards of the client
+// configured in configPath, next to it
+func DefaultGuardStateFile(configPath string) string {
+	return strings.TrimSuffix(configPath, filepath.Ext(configPath)) + ".guards.json"
+}
+
+// a guard as saved in the state file
+type entryGuard struct {
+	Addr             string
+	Fingerprint      string // of the key it had when picked, another key at the address is another relay
+	AddedAt          time.Time
+	ExpiresAt        time.Time
+	UnreachableSince time.Time // zero while it is reachable
+	LastTried        time.Time // last time it was used while unreachable
+	UnlistedSince    time.Time // zero while the DS lists it
+}
+
+// guardSet is the client's entry guards. Circuits enter the network through the first
+// guard that is listed and reachable, so only a few relays ever see the client's address.
+type guardSet struct {
+	path      string
+	numGuards int
+	lifetime  time.Duration
+
+	mu     sync.Mutex
+	guards []entryGuard // in order of preference
+}
+
+// loads the guards saved at config.StateFile, if any
+func loadGuards(config utils.GuardConfig) (*guardSet, error) {
+	g := &guardSet{
+		path:      config.StateFile,
+		numGuards: config.NumGuards,
+		lifetime:  time.Duration(config.LifetimeDays) * 24 * time.Hour,
+	}
+	if g.numGuards <= 0 {
+		g.numGuards = defaultNumGuards
+	}
+	if g.lifetime <= 0 {
+		g.lifetime = defaultGuardLifetime
+	}
+	if g.path == "" {
+		return g, nil
+	}
+	raw, err := ioutil.ReadFile(g.path)
+	if os.IsNotExist(err) {
+		return g, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &g.guards); err != nil {
+		return nil, fmt.Errorf("%s: %w", g.path, err)
+	}
+	return g, nil
+}
+
+// addrs are the guards we have, every directory fetch looks for them
+func (g *guardSet) addrs() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	addrs := make([]string, 0, len(g.guards))
+	for _, guard := range g.guards {
+		addrs = append(addrs, guard.Addr)
+	}
+	return addrs
+}
+
+// pick returns the guard for a new circuit: the first one relays lists that isn't
+// waiting to be tried again and not in except, like the relay the circuit ends at.
+// Guards are added from relays until numGuards of them are listed. When all of them are
+// down, a few more are added, and after that the one tried longest ago is tried again.
+func (g *guardSet) pick(relays map[string]rsa.PublicKey, except map[string]bool) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	changed := g.refresh(relays, now)
+	defer func() {
+		if changed {
+			g.save()
+		}
+	}()
+
+	for g.listed(relays) < g.numGuards && len(g.guards) < g.numGuards*guardSampleFactor && g.add(relays, except, now) {
+		changed = true
+	}
+	for {
+		if i := g.firstUsable(relays, except, now); i >= 0 {
+			if !g.guards[i].UnreachableSince.IsZero() {
+				g.guards[i].LastTried = now
+				changed = true
+			}
+			return g.guards[i].Addr, nil
+		}
+		if len(g.guards) >= g.numGuards*guardSampleFactor || !g.add(relays, except, now) {
+			break
+		}
+		changed = true
+	}
+
+	retry := -1
+	for i, guard := range g.guards {
+		if _, ok := relays[guard.Addr]; ok && !except[guard.Addr] && (retry < 0 || guard.LastTried.Before(g.guards[retry].LastTried)) {
+			retry = i
+		}
+	}
+	if retry < 0 {
+		return "", wrapError(ErrNotEnoughRelays, errors.New("no relay to use as entry guard"))
+	}
+	g.guards[retry].LastTried = now
+	changed = true
+	return g.guards[retry].Addr, nil
+}
+
+// note tells the guards whether a circuit got through the relay at addr, the first hop
+// of a circuit built with err as the outcome
+func (g *guardSet) note(addr string, err error) {
+	var hopErr *HopError
+	isHopErr := errors.As(err, &hopErr)
+	down := isHopErr && hopErr.Hop == 0 && (hopErr.Reason == utils.ReasonUnreachable || hopErr.Reason == utils.ReasonConnectionClosed)
+	up := err == nil || isHopErr && hopErr.Hop > 0
+	if !down && !up {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for i := range g.guards {
+		guard := &g.guards[i]
+		if guard.Addr != addr {
+			continue
+		}
+		switch {
+		case down && guard.UnreachableSince.IsZero():
+			fmt.Printf("Client: entry guard %s unreachable\n", addr)
+			guard.UnreachableSince, guard.LastTried = time.Now(), time.Now()
+		case up && !guard.UnreachableSince.IsZero():
+			fmt.Printf("Client: entry guard %s reachable again\n", addr)
+			guard.UnreachableSince, guard.LastTried = time.Time{}, time.Time{}
+		default:
+			return
+		}
+		g.save()
+		return
+	}
+}
+
+// drops the guards that expired, have been down too long, or whose address relays now
+// lists with another key, and notes which ones relays doesn't list. Callers hold mu.
+func (g *guardSet) refresh(relays map[string]rsa.PublicKey, now time.Time) bool {
+	changed := false
+	kept := g.guards[:0]
+	for _, guard := range g.guards {
+		key, listed := relays[guard.Addr]
+		reason := ""
+		switch {
+		case now.After(guard.ExpiresAt):
+			reason = "rotated out"
+		case listed && fingerprint(key) != guard.Fingerprint:
+			reason = "has a new key"
+		case !guard.UnreachableSince.IsZero() && now.Sub(guard.UnreachableSince) > guardDropAfter:
+			reason = "unreachable for too long"
+		case !guard.UnlistedSince.IsZero() && now.Sub(guard.UnlistedSince) > guardDropAfter:
+			reason = "out of the network for too long"
+		}
+		if reason != "" {
+			fmt.Printf("Client: dropping entry guard %s, %s\n", guard.Addr, reason)
+			changed = true
+			continue
+		}
+		if listed != guard.UnlistedSince.IsZero() {
+			guard.UnlistedSince = time.Time{}
+			if !listed {
+				guard.UnlistedSince = now
+			}
+			changed = true
+		}
+		kept = append(kept, guard)
+	}
+	g.guards = kept
+	return changed
+}
+
+// guards relays lists. Callers hold mu.
+func (g *guardSet) listed(relays map[string]rsa.PublicKey) int {
+	listed := 0
+	for _, guard := range g.guards {
+		if _, ok := relays[guard.Addr]; ok {
+			listed++
+		}
+	}
+	return listed
+}
+
+// index of the first guard relays lists that isn't waiting to be tried again, -1 when
+// there is none. Callers hold mu.
+func (g *guardSet) firstUsable(relays map[string]rsa.PublicKey, except map[string]bool, now time.Time) int {
+	for i, guard := range g.guards {
+		if _, ok := relays[guard.Addr]; !ok || except[guard.Addr] {
+			continue
+		}
+		if guard.UnreachableSince.IsZero() || now.Sub(guard.LastTried) >= guardRetryInterval {
+			return i
+		}
+	}
+	return -1
+}
+
+// adds a random relay that isn't a guard yet and not in except as the least preferred
+// guard. Its lifetime is drawn at random, so guards picked together don't all rotate out
+// together. Returns false when there is no such relay. Callers hold mu.
+func (g *guardSet) add(relays map[string]rsa.PublicKey, except map[string]bool, now time.Time) bool {
+	candidates := make([]string, 0, len(relays))
+	for addr := range relays {
+		if !g.has(addr) && !except[addr] {
+			candidates = append(candidates, addr)
+		}
+	}
+	if len(candidates) == 0 {
+		return false
+	}
+	addr := candidates[rand.Intn(len(candidates))]
+	lifetime := g.lifetime + time.Duration(rand.Int63n(int64(g.lifetime/2)+1))
+	g.guards = append(g.guards, entryGuard{
+		Addr:        addr,
+		Fingerprint: fingerprint(relays[addr]),
+		AddedAt:     now,
+		ExpiresAt:   now.Add(lifetime),
+	})
+	fmt.Printf("Client: new entry guard %s\n", addr)
+	return true
+}
+
+func (g *guardSet) has(addr string) bool {
+	for _, guard := range g.guards {
+		if guard.Addr == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// writes the guards to the state file, through a temporary file so a crash can't leave
+// half of it. Callers hold mu.
+func (g *guardSet) save() {
+	if g.path == "" {
+		return
+	}
+	raw, err := json.MarshalIndent(g.guards, "", "\t")
+	if err == nil {
+		tmp := g.path + ".tmp"
+		if err = ioutil.WriteFile(tmp, raw, 0600); err == nil {
+			err = os.Rename(tmp, g.path)
+		}
+	}
+	if err != nil {
+		fmt.Printf("Client: WARNING could not save entry guards: %s\n", err)
+	}
+}
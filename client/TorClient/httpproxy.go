@@ -0,0 +1,183 @@
+package TorClient
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"../../utils"
+)
+
+const (
+	// a proxy client connection with no request for this long is closed
+	httpProxyIdle = 2 * time.Minute
+	// a destination that doesn't start answering a request in time gets a 504
+	httpResponseTimeout = 30 * time.Second
+)
+
+// headers that only concern the link to the proxy, they are not passed on
+var hopByHopHeaders = []string{"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Te", "Trailer", "Upgrade"}
+
+// ServeHTTPProxy accepts HTTP proxy clients on listener. A CONNECT is tunnelled through
+// a connection from dial like a SOCKS connect. A plain request with an absolute URI is
+// sent on through a connection to its host, which later requests to the same host reuse.
+// Requests to another host get their own connection, so no circuit carries the streams
+// of two destinations. Returns once accepting fails.
+func ServeHTTPProxy(listener net.Listener, dial DialFunc) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go serveHTTPProxyConn(conn, dial)
+	}
+}
+
+// a connection to one destination, kept for the requests of one proxy client
+type httpUpstream struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func serveHTTPProxyConn(conn net.Conn, dial DialFunc) {
+	defer conn.Close()
+	upstreams := make(map[string]*httpUpstream)
+	defer func() {
+		for _, upstream := range upstreams {
+			upstream.conn.Close()
+		}
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(httpProxyIdle))
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			if err != io.EOF {
+				fmt.Printf("Client: WARNING bad proxy request: %s\n", err)
+			}
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+
+		if req.Method == http.MethodConnect {
+			proxyConnect(conn, reader, req, dial)
+			return
+		}
+		if !proxyRequest(conn, req, upstreams, dial) {
+			return
+		}
+	}
+}
+
+// tunnels the rest of conn to the host of a CONNECT
+func proxyConnect(conn net.Conn, reader *bufio.Reader, req *http.Request, dial DialFunc) {
+	addr := req.Host
+	fmt.Println("Client: HTTP connect to ", addr)
+	target, err := dial(context.Background(), addr)
+	if err != nil {
+		fmt.Printf("Client: WARNING could not connect to %s for error: %s\n", addr, err)
+		writeProxyError(conn, httpStatusFor(err), err)
+		return
+	}
+	defer target.Close()
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	// the client may have sent more than the request already
+	if buffered := reader.Buffered(); buffered > 0 {
+		data, _ := reader.Peek(buffered)
+		if _, err := target.Write(data); err != nil {
+			return
+		}
+	}
+	splice(conn, target)
+}
+
+// sends a request with an absolute URI to its host and copies the response back. Returns
+// whether conn can take another request.
+func proxyRequest(conn net.Conn, req *http.Request, upstreams map[string]*httpUpstream, dial DialFunc) bool {
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		writeProxyError(conn, http.StatusBadRequest, fmt.Errorf("not an absolute http URI: %s", req.RequestURI))
+		return false
+	}
+	addr := req.URL.Host
+	if req.URL.Port() == "" {
+		addr = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+	for _, header := range hopByHopHeaders {
+		req.Header.Del(header)
+	}
+	closeAfter := req.Close
+	req.Close = false
+
+	upstream, ok := upstreams[addr]
+	if !ok {
+		fmt.Println("Client: HTTP request to ", addr)
+		target, err := dial(context.Background(), addr)
+		if err != nil {
+			fmt.Printf("Client: WARNING could not connect to %s for error: %s\n", addr, err)
+			writeProxyError(conn, httpStatusFor(err), err)
+			return !closeAfter
+		}
+		upstream = &httpUpstream{conn: target, reader: bufio.NewReader(target)}
+		upstreams[addr] = upstream
+	}
+
+	resp, err := roundTrip(upstream, req)
+	if err != nil {
+		upstream.conn.Close()
+		delete(upstreams, addr)
+		fmt.Printf("Client: WARNING request to %s failed: %s\n", addr, err)
+		writeProxyError(conn, httpStatusFor(err), err)
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.Close {
+		upstream.conn.Close()
+		delete(upstreams, addr)
+	}
+	// without a length, the end of the body is the end of the connection, for the client too
+	resp.Close = closeAfter || resp.ContentLength < 0 && len(resp.TransferEncoding) == 0
+	if err := resp.Write(conn); err != nil {
+		return false
+	}
+	return !resp.Close
+}
+
+func roundTrip(upstream *httpUpstream, req *http.Request) (*http.Response, error) {
+	if err := req.Write(upstream.conn); err != nil {
+		return nil, err
+	}
+	upstream.conn.SetReadDeadline(time.Now().Add(httpResponseTimeout))
+	resp, err := http.ReadResponse(upstream.reader, req)
+	upstream.conn.SetReadDeadline(time.Time{})
+	return resp, err
+}
+
+func writeProxyError(conn net.Conn, status int, err error) {
+	body := fmt.Sprintf("%d %s: %s\n", status, http.StatusText(status), err)
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Type: text/plain\r\nContent-Length: %d\r\n\r\n%s", status, http.StatusText(status), len(body), body)
+}
+
+// the status that tells the application best why the circuit failed
+func httpStatusFor(err error) int {
+	var hopErr *HopError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrNoExit):
+		return http.StatusForbidden
+	case errors.Is(err, ErrDeadlineExceeded), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout
+	case errors.As(err, &hopErr) && hopErr.Reason == utils.ReasonRefused:
+		return http.StatusForbidden
+	}
+	return http.StatusBadGateway
+}
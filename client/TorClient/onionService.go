@@ -0,0 +1,288 @@
+package TorClient
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"sync"
+	"time"
+
+	"../../keyLibrary"
+	"../../utils"
+	"github.com/DistributedClocks/GoVector/govec"
+)
+
+const rendezvousCookieBytes = 20
+
+// ServiceCircuit is a circuit to a relay acting for an onion service, an introduction
+// point or a rendezvous point, or to an exit. Once the rendezvous is joined it carries
+// values end-to-end between the client and the service.
+type ServiceCircuit struct {
+	reader     *ResponseReader
+	relayKeys  [][]byte
+	forward    []*utils.RunningDigest // one per relay, of every frame we send
+	e2eKey     []byte
+	sendDigest *utils.RunningDigest
+	sendMu     sync.Mutex // frames go out in the order their digests were taken
+}
+
+// CreateServiceOnion builds an onion through the given relays, asking the last one to
+// act for an onion service. returns the onion and the symmetric keys from T1 to Tn
+func CreateServiceOnion(nodeOrder []string, tnMap map[string]rsa.PublicKey, cell utils.ServiceCell) ([]byte, [][]byte, error) {
+	return createRelayOnion(nodeOrder, tnMap, utils.Onion{Service: &cell})
+}
+
+func OpenServiceCircuit(nodeOrder []string, tnMap map[string]rsa.PublicKey, cell utils.ServiceCell, links utils.LinkConfig, flowControl utils.FlowControlConfig, vecLogger *govec.GoLog) (*ServiceCircuit, error) {
+	onion, symmKeys, err := CreateServiceOnion(nodeOrder, tnMap, cell)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := SendOnionMessageStream(append([]string{}, nodeOrder...), tnMap, onion, symmKeys, links, flowControl, time.Time{}, vecLogger)
+	if err != nil {
+		return nil, err
+	}
+
+	forward := make([]*utils.RunningDigest, len(symmKeys))
+	for i, symmKey := range symmKeys {
+		forward[i] = utils.NewRunningDigest(symmKey)
+	}
+	return &ServiceCircuit{
+		reader:    reader,
+		relayKeys: append([][]byte{}, symmKeys...),
+		forward:   forward,
+	}, nil
+}
+
+// ReadFrame returns the next frame from the relay, skipping keepalives
+func (c *ServiceCircuit) ReadFrame() (utils.ServiceFrame, error) {
+	for {
+		var frame utils.ServiceFrame
+		value, err := c.reader.Next()
+		if err == io.EOF {
+			return frame, errors.New("relay closed the circuit")
+		}
+		if err != nil {
+			return frame, err
+		}
+		if err := utils.UnMarshall([]byte(value), &frame); err != nil {
+			return frame, err
+		}
+		if frame.Command != utils.ServiceKeepalive {
+			return frame, nil
+		}
+	}
+}
+
+// ExpectFrame reads the relay's answer to a command
+func (c *ServiceCircuit) ExpectFrame(command utils.ServiceCommand) error {
+	frame, err := c.ReadFrame()
+	if err != nil {
+		return err
+	}
+	if frame.Command != command {
+		return fmt.Errorf("expected service frame %d, received %d", command, frame.Command)
+	}
+	return nil
+}
+
+// Join switches the circuit over to the other side of the rendezvous, which shares
+// e2eKey with us. peer names the other side in errors.
+func (c *ServiceCircuit) Join(e2eKey []byte, peer string) {
+	c.reader.symmKeys = append(c.reader.symmKeys, e2eKey)
+	c.reader.digests = append(c.reader.digests, utils.NewRunningDigest(e2eKey))
+	c.reader.nodeOrder = append(c.reader.nodeOrder, peer)
+	c.e2eKey = e2eKey
+	c.sendDigest = utils.NewRunningDigest(e2eKey)
+}
+
+// Next returns the next value the other side sent, io.EOF once it ended the circuit
+func (c *ServiceCircuit) Next() (string, error) {
+	return c.reader.Next()
+}
+
+// Send passes a value to the other side of the rendezvous, wrapped in a layer for
+// every relay on our circuit
+func (c *ServiceCircuit) Send(value string) error {
+	if c.e2eKey == nil {
+		return errors.New("circuit is not joined to a rendezvous")
+	}
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	response, err := utils.Marshall(utils.Response{Value: value, Digest: c.sendDigest.Add([]byte(value))})
+	if err != nil {
+		return err
+	}
+	payload, err := keyLibrary.SymmKeyEncrypt(response, c.e2eKey)
+	if err != nil {
+		return err
+	}
+	return c.sendFrame(payload, "Frame sent to rendezvous")
+}
+
+// SendData passes bytes to the last relay itself, like an exit, wrapped in a layer for
+// every relay on our circuit
+func (c *ServiceCircuit) SendData(data []byte) error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	return c.sendFrame(data, "Frame sent to exit")
+}
+
+func (c *ServiceCircuit) sendFrame(payload []byte, vecMsg string) error {
+	var err error
+	for i := len(c.relayKeys) - 1; i >= 0 && err == nil; i-- {
+		var layer []byte
+		layer, err = utils.Marshall(utils.Onion{Payload: payload, Digest: c.forward[i].Add(payload)})
+		if err == nil {
+			payload, err = keyLibrary.SymmKeyEncrypt(layer, c.relayKeys[i])
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.reader.writeCell(utils.Cell{Command: utils.CellData, StreamID: utils.DEFAULT_STREAM_ID, Payload: payload}, vecMsg)
+}
+
+// SendEnd tells the other side nothing more will follow
+func (c *ServiceCircuit) SendEnd() error {
+	return c.reader.writeCell(utils.Cell{Command: utils.CellEnd}, "End sent on service circuit")
+}
+
+func (c *ServiceCircuit) Close() error {
+	return c.reader.Close()
+}
+
+// CircuitTo picks a random path of length relays from tnMap, ending at terminal
+func CircuitTo(terminal string, tnMap map[string]rsa.PublicKey, length uint16) ([]string, error) {
+	others := make(map[string]rsa.PublicKey)
+	for addr, key := range tnMap {
+		if addr != terminal {
+			others[addr] = key
+		}
+	}
+	if length < 1 {
+		length = 1
+	}
+	if len(others) < int(length)-1 {
+		return nil, fmt.Errorf("not enough tor nodes for a circuit to %s: needed %d, have %d", terminal, length, len(others)+1)
+	}
+
+	path := []string{}
+	if length > 1 {
+		path = DetermineTnOrder(others)[:length-1]
+	}
+	return append(path, terminal), nil
+}
+
+// FetchFromOnionService fetches reqKey from the onion service at address. Neither side
+// learns the other's address: the client waits at a rendezvous point it picked, and
+// tells the service where through one of the service's introduction points.
+// circuitLength is the number of relays on each of the client's circuits.
+func FetchFromOnionService(address string, reqKey string, dsIPPort string, dsPublicKey rsa.PublicKey, circuitLength uint16, links utils.LinkConfig, flowControl utils.FlowControlConfig, vecLogger *govec.GoLog) (string, error) {
+	descriptor, err := FetchServiceDescriptor(dsIPPort, address, dsPublicKey, vecLogger)
+	if err != nil {
+		return "", err
+	}
+	tnMap, err := ContactDsSerer(dsIPPort, circuitLength+uint16(len(descriptor.IntroPoints)), dsPublicKey, vecLogger)
+	if err != nil {
+		return "", err
+	}
+	if len(tnMap) == 0 {
+		return "", errors.New("DS didn't send any tor nodes")
+	}
+
+	rendezvousPoint := pickRendezvousPoint(tnMap, descriptor.IntroPoints)
+	path, err := CircuitTo(rendezvousPoint, tnMap, circuitLength)
+	if err != nil {
+		return "", err
+	}
+	cookie := make([]byte, rendezvousCookieBytes)
+	rand.Read(cookie)
+
+	fmt.Println("Client: waiting for the service at rendezvous point: ", rendezvousPoint)
+	rendezvous, err := OpenServiceCircuit(path, tnMap, utils.ServiceCell{Command: utils.ServiceEstablishRendezvous, Cookie: cookie}, links, flowControl, vecLogger)
+	if err != nil {
+		return "", err
+	}
+	defer rendezvous.Close()
+	if err := rendezvous.ExpectFrame(utils.ServiceEstablishRendezvous); err != nil {
+		return "", err
+	}
+
+	e2eKey := keyLibrary.GenerateSymmKey()
+	rawIntroduction, err := utils.Marshall(utils.Introduction{
+		RendezvousIPPort: rendezvousPoint,
+		RendezvousKey:    tnMap[rendezvousPoint],
+		Cookie:           cookie,
+		SymmKey:          e2eKey,
+	})
+	if err != nil {
+		return "", err
+	}
+	introduction, err := EncryptPayload(rawIntroduction, descriptor.ServiceKey)
+	if err != nil {
+		return "", err
+	}
+	if err := introduce(address, introduction, descriptor.IntroPoints, tnMap, circuitLength, links, flowControl, vecLogger); err != nil {
+		return "", err
+	}
+
+	if err := rendezvous.ExpectFrame(utils.ServiceJoinRendezvous); err != nil {
+		return "", err
+	}
+	rendezvous.Join(e2eKey, address)
+	if err := rendezvous.Send(reqKey); err != nil {
+		return "", err
+	}
+	return readResponse(rendezvous.reader)
+}
+
+// the rendezvous point is best kept apart from the introduction points
+func pickRendezvousPoint(tnMap map[string]rsa.PublicKey, introPoints map[string]rsa.PublicKey) string {
+	candidates := make([]string, 0, len(tnMap))
+	for addr := range tnMap {
+		if _, ok := introPoints[addr]; !ok {
+			candidates = append(candidates, addr)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = getKeysFromMap(tnMap)
+	}
+	return candidates[mathrand.Intn(len(candidates))]
+}
+
+// tries the introduction points in random order until one passes the introduction on
+func introduce(address string, introduction [][]byte, introPoints map[string]rsa.PublicKey, tnMap map[string]rsa.PublicKey, circuitLength uint16, links utils.LinkConfig, flowControl utils.FlowControlConfig, vecLogger *govec.GoLog) error {
+	relays := make(map[string]rsa.PublicKey)
+	for addr, key := range tnMap {
+		relays[addr] = key
+	}
+	for addr, key := range introPoints {
+		relays[addr] = key
+	}
+
+	var lastErr error
+	addrs := getKeysFromMap(introPoints)
+	for _, i := range mathrand.Perm(len(addrs)) {
+		introPoint := addrs[i]
+		path, err := CircuitTo(introPoint, relays, circuitLength)
+		var circuit *ServiceCircuit
+		if err == nil {
+			circuit, err = OpenServiceCircuit(path, relays, utils.ServiceCell{Command: utils.ServiceIntroduce, Address: address, Introduction: introduction}, links, flowControl, vecLogger)
+		}
+		if err == nil {
+			err = circuit.ExpectFrame(utils.ServiceIntroduce)
+			circuit.Close()
+		}
+		if err == nil {
+			fmt.Println("Client: introduced to the service through: ", introPoint)
+			return nil
+		}
+		fmt.Printf("Client: introduction point %s failed: %s\n", introPoint, err)
+		lastErr = err
+	}
+	return fmt.Errorf("no introduction point reached the service, last error: %s", lastErr)
+}
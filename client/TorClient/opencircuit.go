@@ -0,0 +1,183 @@
+package TorClient
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"../../keyLibrary"
+	"../../utils"
+	"github.com/DistributedClocks/GoVector/govec"
+)
+
+// RequestCircuit is a circuit built ahead of time. Its last relay passes the requests
+// sent on it to data servers one at a time, so a request only costs the data server's
+// layer instead of a layer for every hop and new connections.
+type RequestCircuit struct {
+	circuit *ServiceCircuit
+	relays  []string
+	built   time.Time
+	uses    int
+	epoch   int // of the pool when it was built, see circuitPool.flush
+	id      uint64
+	onClose func() // tells the client's circuit list, nil outside a client
+
+	frames    chan utils.ServiceFrame // from the last relay, closed once the circuit is gone
+	readErr   error                   // why frames was closed
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// OpenRequestCircuit builds a circuit through nodeOrder, whose last relay holds it open
+func OpenRequestCircuit(nodeOrder []string, tnMap map[string]rsa.PublicKey, links utils.LinkConfig, flowControl utils.FlowControlConfig, vecLogger *govec.GoLog) (*RequestCircuit, error) {
+	circuit, err := OpenServiceCircuit(nodeOrder, tnMap, utils.ServiceCell{Command: utils.ServiceOpen}, links, flowControl, vecLogger)
+	if err != nil {
+		return nil, err
+	}
+	if err := circuit.ExpectFrame(utils.ServiceOpen); err != nil {
+		circuit.Close()
+		return nil, err
+	}
+	// the data server of a request, which a destroy from past the last relay is blamed on
+	circuit.reader.nodeOrder = append(circuit.reader.nodeOrder, "")
+
+	rc := &RequestCircuit{
+		circuit: circuit,
+		relays:  append([]string{}, nodeOrder...),
+		built:   time.Now(),
+		frames:  make(chan utils.ServiceFrame),
+		closed:  make(chan struct{}),
+	}
+	go rc.readFrames()
+	return rc, nil
+}
+
+// reads all along, so keepalives and sendmes keep flowing while the circuit is idle
+func (rc *RequestCircuit) readFrames() {
+	for {
+		frame, err := rc.circuit.ReadFrame()
+		if err != nil {
+			rc.readErr = err
+			close(rc.frames)
+			return
+		}
+		select {
+		case rc.frames <- frame:
+		case <-rc.closed:
+		}
+	}
+}
+
+// Request fetches reqKey from the data server at server, whose key is serverKey. It gives
+// up at deadline or once ctx is done, and the circuit can't be used again after that or
+// any other error.
+func (rc *RequestCircuit) Request(ctx context.Context, server string, serverKey rsa.PublicKey, reqKey string, deadline time.Time) (string, error) {
+	return rc.Exchange(ctx, server, serverKey, utils.Request{Key: reqKey}, deadline)
+}
+
+// Exchange is Request for any request to the data server, like a put
+func (rc *RequestCircuit) Exchange(ctx context.Context, server string, serverKey rsa.PublicKey, req utils.Request, deadline time.Time) (string, error) {
+	hops := len(rc.relays)
+	request, symmKey, err := sealRequest(req, serverKey, utils.HopDeadline(deadline, hops))
+	if err != nil {
+		return "", err
+	}
+	layer, err := utils.Marshall(utils.Onion{
+		NextIpPort:      server,
+		NextFingerprint: fingerprint(serverKey),
+		Payload:         request,
+		Deadline:        utils.HopDeadline(deadline, hops-1),
+	})
+	if err != nil {
+		return "", wrapError(ErrOnionBuild, err)
+	}
+	if err := rc.circuit.SendData(layer); err != nil {
+		return "", &HopError{Hop: 0, Addr: rc.relays[0], Reason: utils.ReasonConnectionClosed}
+	}
+	rc.uses++
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	digest := utils.NewRunningDigest(symmKey)
+	var value strings.Builder
+	for {
+		select {
+		case frame, ok := <-rc.frames:
+			if !ok {
+				return "", rc.blame(rc.readErr, server)
+			}
+			switch frame.Command {
+			case utils.ServiceData:
+				decrypted, err := keyLibrary.SymmKeyDecrypt(frame.Data, symmKey)
+				var response utils.Response
+				if err == nil {
+					err = utils.UnMarshall(decrypted, &response)
+				}
+				if err != nil {
+					return "", &HopError{Hop: hops, Addr: server, Reason: utils.ReasonDecryptFailed}
+				}
+				if !digest.Verify([]byte(response.Value), response.Digest) {
+					return "", &HopError{Hop: hops, Addr: server, Reason: utils.ReasonIntegrity}
+				}
+				value.WriteString(response.Value)
+			case utils.ServiceDone:
+				return value.String(), nil
+			default:
+				return "", fmt.Errorf("expected a response, received service frame %d", frame.Command)
+			}
+		case <-timer.C:
+			return "", ErrDeadlineExceeded
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// names the data server in a destroy that came from it
+func (rc *RequestCircuit) blame(err error, server string) error {
+	var hopErr *HopError
+	if errors.As(err, &hopErr) && hopErr.Hop == len(rc.relays) {
+		return &HopError{Hop: hopErr.Hop, Addr: server, Reason: hopErr.Reason}
+	}
+	return err
+}
+
+// Relays is the path of the circuit, not counting the data servers it reaches
+func (rc *RequestCircuit) Relays() []string {
+	return append([]string{}, rc.relays...)
+}
+
+// Alive tells whether the circuit is still up, as far as we know
+func (rc *RequestCircuit) Alive() bool {
+	select {
+	case frame, ok := <-rc.frames:
+		if ok {
+			// the relay has nothing to say between requests
+			fmt.Printf("Client: WARNING unexpected service frame %d on idle circuit\n", frame.Command)
+			rc.Close()
+		}
+		return false
+	default:
+		return true
+	}
+}
+
+// Close tears the circuit down. readFrames is still reading, so unlike
+// ResponseReader.Close this leaves the reader's state alone.
+func (rc *RequestCircuit) Close() error {
+	var err error
+	rc.closeOnce.Do(func() {
+		close(rc.closed)
+		if rc.onClose != nil {
+			rc.onClose()
+		}
+		reader := rc.circuit.reader
+		reader.writeCell(utils.Cell{Command: utils.CellDestroy, Reason: utils.ReasonRequested}, "Circuit closed by client")
+		err = reader.conn.Close()
+	})
+	return err
+}
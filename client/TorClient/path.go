@@ -0,0 +1,209 @@
+package TorClient
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"net"
+
+	"../../utils"
+)
+
+const (
+	defaultSubnetBits = 16
+	// IPv6 relays are compared by the subnets a single site usually gets
+	ipv6SubnetBits = 32
+)
+
+// where a relay is on a circuit
+type position int
+
+const (
+	entryPosition position = iota
+	middlePosition
+	exitPosition
+)
+
+// pathRules decide how long the client's circuits are and which relays may go where on
+// them, from MaxNumNodes and the Path settings of the client config
+type pathRules struct {
+	minLength  int
+	maxLength  int
+	entry      []relayPattern
+	middle     []relayPattern
+	exit       []relayPattern
+	exclude    []relayPattern
+	subnetBits int // 0 when relays may share subnets
+}
+
+// a relay address, or the IPs of a subnet
+type relayPattern struct {
+	addr   string
+	subnet *net.IPNet
+}
+
+func newPathRules(config utils.ClientConfig) (*pathRules, error) {
+	path := config.Path
+	r := &pathRules{minLength: path.MinLength, maxLength: path.MaxLength, subnetBits: path.SubnetBits}
+	if r.maxLength == 0 {
+		r.maxLength = int(config.MaxNumNodes)
+	}
+	if r.minLength == 0 {
+		r.minLength = r.maxLength
+	}
+	if r.maxLength < 1 || r.minLength < 1 || r.minLength > r.maxLength {
+		return nil, fmt.Errorf("MinLength %d and MaxLength %d make no circuit", r.minLength, r.maxLength)
+	}
+	switch {
+	case r.subnetBits == 0:
+		r.subnetBits = defaultSubnetBits
+	case r.subnetBits < 0:
+		r.subnetBits = 0
+	case r.subnetBits > 8*net.IPv4len:
+		return nil, fmt.Errorf("SubnetBits %d is more than an IPv4 address has", r.subnetBits)
+	}
+
+	var err error
+	for _, nodes := range []struct {
+		patterns *[]relayPattern
+		config   []string
+	}{{&r.entry, path.EntryNodes}, {&r.middle, path.MiddleNodes}, {&r.exit, path.ExitNodes}, {&r.exclude, path.ExcludeNodes}} {
+		if *nodes.patterns, err = parseRelayPatterns(nodes.config); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func parseRelayPatterns(nodes []string) ([]relayPattern, error) {
+	patterns := make([]relayPattern, 0, len(nodes))
+	for _, node := range nodes {
+		if _, subnet, err := net.ParseCIDR(node); err == nil {
+			patterns = append(patterns, relayPattern{subnet: subnet})
+		} else if ip := net.ParseIP(node); ip != nil {
+			bits := 8 * len(ip)
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			patterns = append(patterns, relayPattern{subnet: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}})
+		} else if _, _, err := net.SplitHostPort(node); err == nil {
+			patterns = append(patterns, relayPattern{addr: node})
+		} else {
+			return nil, fmt.Errorf("%q is no relay address, IP or subnet", node)
+		}
+	}
+	return patterns, nil
+}
+
+func (p relayPattern) matches(addr string) bool {
+	if p.subnet == nil {
+		return p.addr == addr
+	}
+	ip := relayIP(addr)
+	return ip != nil && p.subnet.Contains(ip)
+}
+
+// the IP of a relay address, nil when its host is a name
+func relayIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// allows tells whether the relay at addr may be at pos on a circuit
+func (r *pathRules) allows(pos position, addr string) bool {
+	for _, pattern := range r.exclude {
+		if pattern.matches(addr) {
+			return false
+		}
+	}
+	patterns := r.middle
+	switch pos {
+	case entryPosition:
+		patterns = r.entry
+	case exitPosition:
+		patterns = r.exit
+	}
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if pattern.matches(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// conflict tells whether the relays at a and b can't be on one circuit
+func (r *pathRules) conflict(a, b string, tnMap map[string]rsa.PublicKey) bool {
+	return samePathError(a, b, tnMap, r.subnetBits) != nil
+}
+
+// ValidatePath checks that no relay is on path twice, under its address or its key, and
+// that no two relays of path share an IPv4 subnet of subnetBits bits, or an IPv6 /32.
+// subnetBits 0 leaves subnets unchecked. Loopback relays are never in a subnet with each
+// other, so a test network on one machine passes. The errors match ErrInvalidPath.
+func ValidatePath(path []string, tnMap map[string]rsa.PublicKey, subnetBits int) error {
+	for i := range path {
+		for j := i + 1; j < len(path); j++ {
+			if err := samePathError(path[i], path[j], tnMap, subnetBits); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func samePathError(a, b string, tnMap map[string]rsa.PublicKey, subnetBits int) error {
+	if a == b {
+		return wrapError(ErrInvalidPath, fmt.Errorf("%s is on the path twice", a))
+	}
+	keyA, okA := tnMap[a]
+	keyB, okB := tnMap[b]
+	if okA && okB && fingerprint(keyA) == fingerprint(keyB) {
+		return wrapError(ErrInvalidPath, fmt.Errorf("%s and %s are one relay", a, b))
+	}
+	if subnetBits == 0 {
+		return nil
+	}
+	ipA, ipB := relayIP(a), relayIP(b)
+	if ipA == nil || ipB == nil || ipA.IsLoopback() || ipB.IsLoopback() {
+		return nil
+	}
+	bits, size := subnetBits, 8*net.IPv4len
+	if ipA.To4() == nil || ipB.To4() == nil {
+		bits, size = ipv6SubnetBits, 8*net.IPv6len
+	}
+	mask := net.CIDRMask(bits, size)
+	if ipA.Mask(mask).Equal(ipB.Mask(mask)) {
+		return wrapError(ErrInvalidPath, fmt.Errorf("%s and %s share a /%d subnet", a, b, bits))
+	}
+	return nil
+}
+
+// middles picks up to want relays of candidates that are allowed in the middle and get
+// along with fixed and with each other, in random order
+func (r *pathRules) middles(candidates map[string]rsa.PublicKey, fixed []string, want int, tnMap map[string]rsa.PublicKey) []string {
+	picked := []string{}
+	for _, addr := range DetermineTnOrder(candidates) {
+		if len(picked) >= want {
+			break
+		}
+		if !r.allows(middlePosition, addr) {
+			continue
+		}
+		fits := true
+		for _, other := range append(append([]string{}, fixed...), picked...) {
+			if r.conflict(addr, other, tnMap) {
+				fits = false
+				break
+			}
+		}
+		if fits {
+			picked = append(picked, addr)
+		}
+	}
+	return picked
+}
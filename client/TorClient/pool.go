@@ -0,0 +1,247 @@
+package TorClient
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"../../utils"
+)
+
+const (
+	defaultPoolCircuits = 4
+	defaultPoolMaxAge   = 10 * time.Minute
+	defaultPoolMaxUses  = 20
+	// the pool is sized for the most requests in flight at once over this long
+	poolDemandWindow = time.Minute
+	// how often the pool retires old circuits and tops itself up
+	poolMaintainInterval = time.Second
+	// close gives up waiting for a build in progress after this long
+	poolCloseWait = 5 * time.Second
+)
+
+// circuitPool keeps request circuits built ahead of time, so a request finds one ready.
+// It keeps one more circuit than the most requests that were in flight at once lately.
+type circuitPool struct {
+	maxCircuits int
+	maxAge      time.Duration
+	maxUses     int
+	build       func(ctx context.Context) (*RequestCircuit, error)
+
+	mu       sync.Mutex
+	idle     []*RequestCircuit
+	inUse    int
+	building int
+	peak     int // most requests in flight at once since peakAt
+	peakAt   time.Time
+	epoch    int // circuits built before the last flush have an older one
+
+	wake   chan struct{}
+	ctx    context.Context // done once the pool is closed, which gives up builds ahead of time
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newCircuitPool(config utils.CircuitPoolConfig, build func(ctx context.Context) (*RequestCircuit, error)) *circuitPool {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &circuitPool{
+		maxCircuits: config.MaxCircuits,
+		maxAge:      time.Duration(config.MaxAgeMillis) * time.Millisecond,
+		maxUses:     config.MaxUses,
+		build:       build,
+		peakAt:      time.Now(),
+		wake:        make(chan struct{}, 1),
+		ctx:         ctx,
+		cancel:      cancel,
+		done:        make(chan struct{}),
+	}
+	if p.maxCircuits <= 0 {
+		p.maxCircuits = defaultPoolCircuits
+	}
+	if p.maxAge <= 0 {
+		p.maxAge = defaultPoolMaxAge
+	}
+	if p.maxUses <= 0 {
+		p.maxUses = defaultPoolMaxUses
+	}
+	go p.maintain()
+	return p
+}
+
+// take hands out a ready circuit, or builds one for ctx when none is. The caller gives
+// it back with put.
+func (p *circuitPool) take(ctx context.Context) (*RequestCircuit, error) {
+	p.mu.Lock()
+	p.inUse++
+	p.notePeak()
+	for len(p.idle) > 0 {
+		rc := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if p.usable(rc) && rc.Alive() {
+			p.mu.Unlock()
+			p.signal()
+			return rc, nil
+		}
+		rc.Close()
+	}
+	epoch := p.epoch
+	p.mu.Unlock()
+	p.signal()
+
+	fmt.Println("Client: no circuit ready, building one")
+	rc, err := p.build(ctx)
+	if err != nil {
+		p.mu.Lock()
+		p.inUse--
+		p.mu.Unlock()
+		return nil, err
+	}
+	rc.epoch = epoch
+	return rc, nil
+}
+
+// put takes a circuit back after a request, retiring it when the request failed, the
+// pool is closed or the circuit is used up
+func (p *circuitPool) put(rc *RequestCircuit, failed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inUse--
+	if failed || p.ctx.Err() != nil || !p.usable(rc) {
+		rc.Close()
+		p.signal()
+		return
+	}
+	p.idle = append(p.idle, rc)
+}
+
+func (p *circuitPool) usable(rc *RequestCircuit) bool {
+	return rc.uses < p.maxUses && time.Since(rc.built) < p.maxAge && rc.epoch == p.epoch
+}
+
+// callers hold mu
+func (p *circuitPool) notePeak() {
+	if p.inUse > p.peak || time.Since(p.peakAt) > poolDemandWindow {
+		p.peak, p.peakAt = p.inUse, time.Now()
+	}
+}
+
+// circuits the pool should have, idle, in use and being built
+func (p *circuitPool) target() int {
+	target := p.peak + 1
+	if target > p.maxCircuits {
+		target = p.maxCircuits
+	}
+	return target
+}
+
+func (p *circuitPool) signal() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// retires idle circuits that are too old or went down, and builds circuits until the
+// pool is at its target
+func (p *circuitPool) maintain() {
+	defer close(p.done)
+	ticker := time.NewTicker(poolMaintainInterval)
+	defer ticker.Stop()
+
+	for {
+		p.mu.Lock()
+		p.notePeak()
+		kept := p.idle[:0]
+		for _, rc := range p.idle {
+			if p.usable(rc) && rc.Alive() {
+				kept = append(kept, rc)
+			} else {
+				rc.Close()
+			}
+		}
+		p.idle = kept
+		missing := p.target() - len(p.idle) - p.inUse - p.building
+		if missing > 0 {
+			p.building++
+		}
+		epoch := p.epoch
+		p.mu.Unlock()
+
+		if missing > 0 {
+			rc, err := p.build(p.ctx)
+			p.mu.Lock()
+			p.building--
+			if err == nil {
+				rc.epoch = epoch
+				// close may have given up waiting on this build and torn the pool down
+				if p.usable(rc) && p.ctx.Err() == nil {
+					p.idle = append(p.idle, rc)
+				} else {
+					rc.Close()
+				}
+			}
+			p.mu.Unlock()
+			if err != nil && p.ctx.Err() == nil {
+				fmt.Printf("Client: WARNING could not build a circuit ahead of time: %s\n", err)
+			} else if missing > 1 {
+				// go on with the next one right away
+				p.signal()
+			}
+		}
+
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-p.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// discard tears down the idle circuits through a path that avoided tells to leave out
+func (p *circuitPool) discard(avoided func(path []string) bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	kept := p.idle[:0]
+	for _, rc := range p.idle {
+		if avoided(rc.relays) {
+			rc.Close()
+		} else {
+			kept = append(kept, rc)
+		}
+	}
+	p.idle = kept
+	p.signal()
+}
+
+// flush tears down the idle circuits and retires the ones in use and being built as
+// they come back, so requests from now on go through new circuits
+func (p *circuitPool) flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.epoch++
+	for _, rc := range p.idle {
+		rc.Close()
+	}
+	p.idle = nil
+	p.signal()
+}
+
+// close stops building circuits and tears the idle ones down, circuits in use are torn
+// down as they come back. A build in progress is cancelled, close waits for it a little
+// and leaves it to tear its circuit down when it returns later.
+func (p *circuitPool) close() {
+	p.cancel()
+	select {
+	case <-p.done:
+	case <-time.After(poolCloseWait):
+		fmt.Println("Client: WARNING gave up waiting for a circuit being built ahead of time")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, rc := range p.idle {
+		rc.Close()
+	}
+	p.idle = nil
+}
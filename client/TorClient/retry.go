@@ -0,0 +1,184 @@
+package TorClient
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"../../utils"
+)
+
+const (
+	defaultRetryBackoff = 100 * time.Millisecond
+	maxRetryBackoff     = 2 * time.Second
+	defaultAvoidFor     = 10 * time.Minute
+	// paths drawn at most when looking for one without a link that failed
+	pathDraws = 8
+)
+
+// avoidList is the relays and links that failed lately, which new circuits leave out.
+// A link is the connection from one relay to the next, a relay that fails over two links
+// is left out altogether.
+type avoidList struct {
+	avoidFor time.Duration
+
+	mu     sync.Mutex
+	relays map[string]time.Time    // until when
+	links  map[[2]string]time.Time // until when
+}
+
+func newAvoidList(avoidFor time.Duration) *avoidList {
+	if avoidFor <= 0 {
+		avoidFor = defaultAvoidFor
+	}
+	return &avoidList{
+		avoidFor: avoidFor,
+		relays:   make(map[string]time.Time),
+		links:    make(map[[2]string]time.Time),
+	}
+}
+
+// blame leaves out what made the circuit through path fail with hopErr. A hop that
+// couldn't be reached or went quiet may be fine, only the link to it is left out then.
+// Returns what is left out, for the log, or "" when it was nobody on path.
+func (a *avoidList) blame(path []string, hopErr *HopError) string {
+	if hopErr.Hop < 0 || hopErr.Hop >= len(path) {
+		return ""
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	until := time.Now().Add(a.avoidFor)
+	relay := path[hopErr.Hop]
+
+	switch hopErr.Reason {
+	case utils.ReasonUnreachable, utils.ReasonTimeout, utils.ReasonConnectionClosed:
+		if hopErr.Hop == 0 {
+			break
+		}
+		link := [2]string{path[hopErr.Hop-1], relay}
+		for other, otherUntil := range a.links {
+			if other[1] == relay && other != link && time.Now().Before(otherUntil) {
+				a.relays[relay] = until
+				return relay
+			}
+		}
+		a.links[link] = until
+		return link[0] + " -> " + link[1]
+	}
+	a.relays[relay] = until
+	return relay
+}
+
+// clear forgets what failed, for a new identity
+func (a *avoidList) clear() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.relays = make(map[string]time.Time)
+	a.links = make(map[[2]string]time.Time)
+}
+
+// filter returns the relays of tnMap that aren't left out
+func (a *avoidList) filter(tnMap map[string]rsa.PublicKey) map[string]rsa.PublicKey {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	kept := make(map[string]rsa.PublicKey, len(tnMap))
+	for addr, key := range tnMap {
+		if until, ok := a.relays[addr]; ok && now.Before(until) {
+			continue
+		}
+		kept[addr] = key
+	}
+	return kept
+}
+
+// avoids tells whether path goes through a relay or over a link that is left out
+func (a *avoidList) avoids(path []string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for i, relay := range path {
+		if until, ok := a.relays[relay]; ok && now.Before(until) {
+			return true
+		}
+		if i == 0 {
+			continue
+		}
+		if until, ok := a.links[[2]string{path[i-1], relay}]; ok && now.Before(until) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryable tells whether another circuit may do better than the one that failed with err.
+// A circuit that timed out may just have been unlucky, nobody on it is left out.
+// A failure past the last relay, at the data server or the destination of a Dial, would
+// be the same through any circuit.
+func retryable(err error, path []string) bool {
+	var hopErr *HopError
+	if errors.As(err, &hopErr) {
+		return hopErr.Hop < len(path)
+	}
+	return errors.Is(err, ErrDecryptFailed) || errors.Is(err, ErrCircuitTimeout)
+}
+
+// withRetries runs attempt on new circuits until it succeeds, fails for a reason another
+// circuit won't fix, or the deadline passes or the attempts run out, and returns its last
+// error then. attempt returns the relays of the circuit it tried. Every attempt is logged
+// with its circuit, and what failed is left out of the circuits after it.
+func (c *Client) withRetries(ctx context.Context, what string, deadline time.Time, attempt func() ([]string, error)) error {
+	backoff := time.Duration(c.config.Retry.BackoffMillis) * time.Millisecond
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	for n := 1; ; n++ {
+		start := time.Now()
+		path, err := attempt()
+		if err == nil {
+			fmt.Printf("Client: %s attempt %d through %v succeeded after %s\n", what, n, path, time.Since(start).Round(time.Millisecond))
+			c.noteCircuit(path)
+			return nil
+		}
+		fmt.Printf("Client: %s attempt %d through %v failed after %s: %s\n", what, n, path, time.Since(start).Round(time.Millisecond), err)
+
+		var hopErr *HopError
+		if errors.As(err, &hopErr) {
+			if avoided := c.avoid.blame(path, hopErr); avoided != "" {
+				fmt.Printf("Client: leaving out %s of new circuits\n", avoided)
+				if c.pool != nil {
+					c.pool.discard(c.avoid.avoids)
+				}
+			}
+			if hopErr.Hop == 0 && len(c.config.Bridges) > 0 {
+				c.dropBridge()
+			}
+		}
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case !retryable(err, path):
+			return err
+		case c.config.Retry.MaxAttempts > 0 && n >= c.config.Retry.MaxAttempts:
+			fmt.Printf("Client: giving up on %s after %d attempts\n", what, n)
+			return err
+		case time.Until(deadline) <= backoff:
+			fmt.Printf("Client: giving up on %s, no time left for another attempt\n", what)
+			return err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package TorClient
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// commands remembered for the timings command
+const shellTimings = 20
+
+const shellHelp = `commands:
+  get KEY          fetch the value of KEY
+  put KEY VALUE    store VALUE, the rest of the line, under KEY
+  list             list the keys of the data server
+  circuit          show the circuit the last command went through
+  newnym           use new circuits and relays from now on
+  timings          show how long the last commands took
+  help             show this
+  quit             leave the shell`
+
+// how long a command of the shell took
+type shellTiming struct {
+	command string
+	took    time.Duration
+	circuit []string // nil when it failed
+	err     error
+}
+
+// RunShell reads commands from in, one per line, and runs them with client until in
+// ends or says quit, writing the results to out. The commands share the client, so its
+// directory and its pooled circuits carry over from one command to the next.
+func RunShell(client *Client, in io.Reader, out io.Writer) error {
+	var timings []shellTiming
+	scanner := bufio.NewScanner(in)
+	fmt.Fprint(out, "> ")
+	for ; scanner.Scan(); fmt.Fprint(out, "> ") {
+		line := strings.TrimSpace(scanner.Text())
+		command, args := line, ""
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			command, args = line[:i], strings.TrimSpace(line[i+1:])
+		}
+
+		start := time.Now()
+		var err error
+		switch command {
+		case "":
+			continue
+		case "get":
+			if args == "" {
+				fmt.Fprintln(out, "usage: get KEY")
+				continue
+			}
+			var value string
+			if value, err = client.Get(context.Background(), args); err == nil {
+				fmt.Fprintf(out, "%s = %q\n", args, value)
+			}
+		case "put":
+			key, value := args, ""
+			if i := strings.IndexAny(args, " \t"); i >= 0 {
+				key, value = args[:i], strings.TrimSpace(args[i+1:])
+			}
+			if key == "" {
+				fmt.Fprintln(out, "usage: put KEY VALUE")
+				continue
+			}
+			if err = client.Put(context.Background(), key, value); err == nil {
+				fmt.Fprintf(out, "stored %s\n", key)
+			}
+		case "list":
+			var keys []string
+			if keys, err = client.List(context.Background()); err == nil {
+				for _, key := range keys {
+					fmt.Fprintln(out, key)
+				}
+				fmt.Fprintf(out, "%d keys\n", len(keys))
+			}
+		case "circuit":
+			if circuit := client.Circuit(); len(circuit) > 0 {
+				fmt.Fprintln(out, strings.Join(circuit, " -> "))
+			} else {
+				fmt.Fprintln(out, "no circuit yet")
+			}
+			continue
+		case "newnym":
+			client.NewIdentity()
+			fmt.Fprintln(out, "new identity, the next command goes through new circuits")
+			continue
+		case "timings":
+			printTimings(out, timings)
+			continue
+		case "help":
+			fmt.Fprintln(out, shellHelp)
+			continue
+		case "quit", "exit":
+			return nil
+		default:
+			fmt.Fprintf(out, "unknown command %q, try help\n", command)
+			continue
+		}
+
+		timing := shellTiming{command: line, took: time.Since(start), err: err}
+		if err != nil {
+			fmt.Fprintf(out, "%s failed after %s: %s\n", command, timing.took.Round(time.Millisecond), err)
+		} else {
+			timing.circuit = client.Circuit()
+		}
+		timings = append(timings, timing)
+		if len(timings) > shellTimings {
+			timings = timings[1:]
+		}
+	}
+	return scanner.Err()
+}
+
+func printTimings(out io.Writer, timings []shellTiming) {
+	if len(timings) == 0 {
+		fmt.Fprintln(out, "no commands yet")
+		return
+	}
+	var total time.Duration
+	for _, timing := range timings {
+		outcome := "via " + strings.Join(timing.circuit, " -> ")
+		if timing.err != nil {
+			outcome = "failed"
+		}
+		fmt.Fprintf(out, "%10s  %s  %s\n", timing.took.Round(time.Millisecond), timing.command, outcome)
+		total += timing.took
+	}
+	fmt.Fprintf(out, "%d commands, %s on average\n", len(timings), (total / time.Duration(len(timings))).Round(time.Millisecond))
+}
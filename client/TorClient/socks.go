@@ -0,0 +1,188 @@
+package TorClient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"../../utils"
+)
+
+// SOCKS5 as in RFC 1928, CONNECT only and without authentication
+const (
+	socksVersion       = 5
+	socksNoAuth        = 0x00
+	socksNoAcceptable  = 0xff
+	socksCmdConnect    = 0x01
+	socksAtypIPv4      = 0x01
+	socksAtypDomain    = 0x03
+	socksAtypIPv6      = 0x04
+	socksSucceeded     = 0x00
+	socksGeneralFail   = 0x01
+	socksNotAllowed    = 0x02
+	socksHostUnreach   = 0x04
+	socksTTLExpired    = 0x06
+	socksCmdNotSupp    = 0x07
+	socksAtypNotSupp   = 0x08
+	socksHandshakeTime = 10 * time.Second
+)
+
+// DialFunc opens a TCP connection to a host:port through the network, Client.Dial is one
+type DialFunc func(ctx context.Context, addr string) (net.Conn, error)
+
+// ServeSOCKS accepts SOCKS5 clients on listener and tunnels each CONNECT through a
+// connection from dial. Host names are passed on unresolved, the exit resolves them.
+// Returns once accepting fails, when the listener is closed for instance.
+func ServeSOCKS(listener net.Listener, dial DialFunc) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go serveSOCKSConn(conn, dial)
+	}
+}
+
+func serveSOCKSConn(conn net.Conn, dial DialFunc) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(socksHandshakeTime))
+
+	addr, reply, err := readSOCKSRequest(conn)
+	if err != nil {
+		fmt.Printf("Client: WARNING bad SOCKS request: %s\n", err)
+		if reply != socksSucceeded {
+			writeSOCKSReply(conn, reply)
+		}
+		return
+	}
+
+	fmt.Println("Client: SOCKS connect to ", addr)
+	target, err := dial(context.Background(), addr)
+	if err != nil {
+		fmt.Printf("Client: WARNING could not connect to %s for error: %s\n", addr, err)
+		writeSOCKSReply(conn, socksReplyFor(err))
+		return
+	}
+	defer target.Close()
+	if writeSOCKSReply(conn, socksSucceeded) != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	splice(conn, target)
+}
+
+// reads the greeting and the request, answering the greeting. Returns the host:port to
+// connect to, or the reply to refuse with when it is not socksSucceeded.
+func readSOCKSRequest(conn net.Conn) (string, byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", socksSucceeded, err
+	}
+	if header[0] != socksVersion {
+		return "", socksSucceeded, fmt.Errorf("SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", socksSucceeded, err
+	}
+	method := byte(socksNoAcceptable)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", socksSucceeded, err
+	}
+	if method == socksNoAcceptable {
+		return "", socksSucceeded, errors.New("client offers no method without authentication")
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", socksSucceeded, err
+	}
+	if request[0] != socksVersion {
+		return "", socksGeneralFail, fmt.Errorf("SOCKS version %d", request[0])
+	}
+	if request[1] != socksCmdConnect {
+		return "", socksCmdNotSupp, fmt.Errorf("command %d not supported", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make([]byte, net.IPv4len)
+		if request[3] == socksAtypIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", socksSucceeded, err
+		}
+		host = net.IP(ip).String()
+	case socksAtypDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", socksSucceeded, err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", socksSucceeded, err
+		}
+		host = string(name)
+	default:
+		return "", socksAtypNotSupp, fmt.Errorf("address type %d not supported", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", socksSucceeded, err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), socksSucceeded, nil
+}
+
+// the bound address is the exit's, which we don't know, so it is always 0.0.0.0:0
+func writeSOCKSReply(conn net.Conn, reply byte) error {
+	_, err := conn.Write([]byte{socksVersion, reply, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// the SOCKS reply that tells the application best why the circuit failed
+func socksReplyFor(err error) byte {
+	var hopErr *HopError
+	switch {
+	case errors.Is(err, ErrNoExit):
+		return socksNotAllowed
+	case errors.Is(err, ErrDeadlineExceeded), errors.Is(err, context.DeadlineExceeded):
+		return socksTTLExpired
+	case errors.As(err, &hopErr) && hopErr.Reason == utils.ReasonRefused:
+		return socksNotAllowed
+	case errors.As(err, &hopErr) && hopErr.Reason == utils.ReasonUnreachable:
+		return socksHostUnreach
+	}
+	return socksGeneralFail
+}
+
+// copies both ways until both sides are done, passing on half-closes
+func splice(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	pass := func(dst, src net.Conn) {
+		defer wg.Done()
+		if _, err := io.Copy(dst, src); err != nil {
+			// no half-close to pass on, tear both down
+			a.Close()
+			b.Close()
+			return
+		}
+		utils.CloseWrite(dst)
+	}
+	go pass(a, b)
+	go pass(b, a)
+	wg.Wait()
+}
@@ -0,0 +1,308 @@
+package TorClient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"../../utils"
+)
+
+const (
+	defaultTimeoutPercentile = 0.8
+	defaultTimeoutMinSamples = 100
+	defaultTimeoutMaxSamples = 1000
+	// width of the histogram bins the mode of the samples is taken from, and the number
+	// of most frequent bins averaged for it, like in Tor
+	timeoutBinWidth = 10 * time.Millisecond
+	timeoutModes    = 10
+	// a learned timeout is never shorter
+	minCircuitTimeout = 10 * time.Millisecond
+	// when more than maxRecentTimeouts of the last recentOutcomes attempts timed out, the
+	// network got slower than what we learned, and we learn anew
+	recentOutcomes    = 20
+	maxRecentTimeouts = 12
+	// new samples between saves of the state file
+	timeoutSaveEvery = 10
+)
+
+// DefaultTimeoutStateFile is where the client commands keep the timeouts the client
+// configured in configPath learned, next to it
+func DefaultTimeoutStateFile(configPath string) string {
+	return strings.TrimSuffix(configPath, filepath.Ext(configPath)) + ".timeouts.json"
+}
+
+// ParetoTimeout fits a Pareto distribution to samples like Tor fits circuit build times,
+// and returns the time the given share of them, between 0 and 1, is expected to take at
+// most. The scale is the average of the most frequent 10ms bins of samples, the shape
+// its maximum likelihood estimate. Returns 0 without samples.
+func ParetoTimeout(samples []time.Duration, percentile float64) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+	bins := map[int64]int{}
+	for _, sample := range samples {
+		bins[int64(sample/timeoutBinWidth)]++
+	}
+	modes := make([]int64, 0, len(bins))
+	for bin := range bins {
+		modes = append(modes, bin)
+	}
+	sort.Slice(modes, func(i, j int) bool {
+		if bins[modes[i]] != bins[modes[j]] {
+			return bins[modes[i]] > bins[modes[j]]
+		}
+		return modes[i] < modes[j]
+	})
+	if len(modes) > timeoutModes {
+		modes = modes[:timeoutModes]
+	}
+	weighted, count := 0.0, 0
+	for _, bin := range modes {
+		mid := (float64(bin) + 0.5) * float64(timeoutBinWidth)
+		weighted += mid * float64(bins[bin])
+		count += bins[bin]
+	}
+	xm := weighted / float64(count)
+
+	logSum := 0.0
+	for _, sample := range samples {
+		if float64(sample) > xm {
+			logSum += math.Log(float64(sample) / xm)
+		}
+	}
+	if logSum == 0 {
+		return time.Duration(xm)
+	}
+	alpha := float64(len(samples)) / logSum
+	return time.Duration(xm / math.Pow(1-percentile, 1/alpha))
+}
+
+// the times one kind of circuit operation took, and the timeout learned from them
+type latencyModel struct {
+	name    string
+	samples []time.Duration // the newest last
+	recent  []bool          // whether each of the last attempts timed out
+	timeout time.Duration   // 0 while there are too few samples
+	stale   bool            // timeout needs fitting again
+}
+
+// adaptiveTimeouts learns how long circuits take from the ones the client built, and
+// gives up on the ones that take longer than most. Builds are pooled circuits until
+// their last relay answers, first responses are requests on their own circuit until the
+// first frame of the response, which is when the circuit is known to be built.
+type adaptiveTimeouts struct {
+	path       string
+	disabled   bool
+	percentile float64
+	minSamples int
+	maxSamples int
+
+	mu            sync.Mutex
+	build         *latencyModel
+	firstResponse *latencyModel
+	unsaved       int
+}
+
+// what the state file holds, in milliseconds
+type timeoutState struct {
+	Build         []float64
+	FirstResponse []float64
+}
+
+// loads the times saved at config.StateFile, if any
+func loadTimeouts(config utils.BuildTimeoutConfig) (*adaptiveTimeouts, error) {
+	t := &adaptiveTimeouts{
+		path:          config.StateFile,
+		disabled:      config.Disabled,
+		percentile:    config.Percentile,
+		minSamples:    config.MinSamples,
+		maxSamples:    config.MaxSamples,
+		build:         &latencyModel{name: "build"},
+		firstResponse: &latencyModel{name: "first response"},
+	}
+	if t.percentile == 0 {
+		t.percentile = defaultTimeoutPercentile
+	}
+	if t.percentile <= 0 || t.percentile >= 1 {
+		return nil, fmt.Errorf("Percentile %v is not between 0 and 1", config.Percentile)
+	}
+	if t.minSamples <= 0 {
+		t.minSamples = defaultTimeoutMinSamples
+	}
+	if t.maxSamples <= 0 {
+		t.maxSamples = defaultTimeoutMaxSamples
+	}
+	if t.path == "" {
+		return t, nil
+	}
+	raw, err := ioutil.ReadFile(t.path)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state timeoutState
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return nil, fmt.Errorf("%s: %w", t.path, err)
+	}
+	for _, loaded := range []struct {
+		model   *latencyModel
+		samples []float64
+	}{{t.build, state.Build}, {t.firstResponse, state.FirstResponse}} {
+		for _, millis := range loaded.samples {
+			t.add(loaded.model, time.Duration(millis*float64(time.Millisecond)))
+		}
+	}
+	return t, nil
+}
+
+// the time after which an operation of model is given up on, 0 for none. Callers hold mu.
+func (t *adaptiveTimeouts) timeoutOf(model *latencyModel) time.Duration {
+	if t.disabled || len(model.samples) < t.minSamples {
+		return 0
+	}
+	if model.stale {
+		model.timeout, model.stale = ParetoTimeout(model.samples, t.percentile), false
+		if model.timeout < minCircuitTimeout {
+			model.timeout = minCircuitTimeout
+		}
+	}
+	return model.timeout
+}
+
+// callers hold mu
+func (t *adaptiveTimeouts) add(model *latencyModel, took time.Duration) {
+	model.samples = append(model.samples, took)
+	if len(model.samples) > t.maxSamples {
+		model.samples = model.samples[len(model.samples)-t.maxSamples:]
+	}
+	model.stale = true
+}
+
+// record notes how long an operation of model took, also when it was given up on before
+func (t *adaptiveTimeouts) record(model *latencyModel, took time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.add(model, took)
+	if t.unsaved++; t.unsaved >= timeoutSaveEvery {
+		t.save()
+	}
+}
+
+// outcome notes whether an attempt of model timed out. When most recent ones did, the
+// samples are dropped and the timeout is learned anew.
+func (t *adaptiveTimeouts) outcome(model *latencyModel, timedOut bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	model.recent = append(model.recent, timedOut)
+	if len(model.recent) > recentOutcomes {
+		model.recent = model.recent[1:]
+	}
+	timeouts := 0
+	for _, timedOut := range model.recent {
+		if timedOut {
+			timeouts++
+		}
+	}
+	if timeouts > maxRecentTimeouts {
+		fmt.Printf("Client: WARNING %d of the last %d circuits timed out before their %s, learning the timeout anew\n", timeouts, len(model.recent), model.name)
+		model.samples, model.recent, model.timeout = nil, nil, 0
+		t.save()
+	}
+}
+
+// writes the samples to the state file, through a temporary file like the guards.
+// Callers hold mu.
+func (t *adaptiveTimeouts) save() {
+	t.unsaved = 0
+	if t.path == "" {
+		return
+	}
+	state := timeoutState{Build: millis(t.build.samples), FirstResponse: millis(t.firstResponse.samples)}
+	raw, err := json.Marshal(state)
+	if err == nil {
+		tmp := t.path + ".tmp"
+		if err = ioutil.WriteFile(tmp, raw, 0600); err == nil {
+			err = os.Rename(tmp, t.path)
+		}
+	}
+	if err != nil {
+		fmt.Printf("Client: WARNING could not save circuit timeouts: %s\n", err)
+	}
+}
+
+// saves what was learned since the last save
+func (t *adaptiveTimeouts) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.unsaved > 0 {
+		t.save()
+	}
+}
+
+func millis(samples []time.Duration) []float64 {
+	out := make([]float64, len(samples))
+	for i, sample := range samples {
+		out[i] = float64(sample) / float64(time.Millisecond)
+	}
+	return out
+}
+
+// runs f, a build or first response of model, and records how long it took when it
+// succeeds. Once it takes longer than the learned timeout, returns ErrCircuitTimeout and
+// leaves f running, so slow circuits still count towards the timeout. cleanup runs once
+// f returns after it was given up on, for a timeout or because ctx is done.
+func (c *Client) timed(ctx context.Context, model *latencyModel, f func() error, cleanup func()) error {
+	t := c.timeouts
+	t.mu.Lock()
+	timeout := t.timeoutOf(model)
+	t.mu.Unlock()
+
+	start := time.Now()
+	run := func() error {
+		err := f()
+		if err == nil {
+			t.record(model, time.Since(start))
+		}
+		return err
+	}
+	if timeout == 0 {
+		return c.untilDone(ctx, run, cleanup)
+	}
+	attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := c.untilDone(attemptCtx, run, cleanup)
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		t.outcome(model, true)
+		return wrapError(ErrCircuitTimeout, fmt.Errorf("no %s after %s", model.name, timeout.Round(time.Millisecond)))
+	}
+	if err == nil {
+		t.outcome(model, false)
+	}
+	return err
+}
+
+// BuildTimeout and FirstResponseTimeout are the timeouts the client learned, 0 while it
+// has too few samples or when adaptive timeouts are disabled
+func (c *Client) BuildTimeout() time.Duration {
+	c.timeouts.mu.Lock()
+	defer c.timeouts.mu.Unlock()
+	return c.timeouts.timeoutOf(c.timeouts.build)
+}
+
+func (c *Client) FirstResponseTimeout() time.Duration {
+	c.timeouts.mu.Lock()
+	defer c.timeouts.mu.Unlock()
+	return c.timeouts.timeoutOf(c.timeouts.firstResponse)
+}
@@ -1,31 +1,32 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 
-	"../keyLibrary"
 	"../utils"
 	"./TorClient"
-	"github.com/DistributedClocks/GoVector/govec"
 )
 
 func main() {
 	configPath := ""
 
-	if len(os.Args)-1 != 2 {
-		fmt.Println("please use: go run client.go client.json keyToFetchFromServer")
+	// without a key the client runs a shell, which keeps its circuits between commands
+	if len(os.Args)-1 != 2 && len(os.Args)-1 != 1 {
+		fmt.Println("please use: go run client.go client.json [keyToFetchFromServer]")
+		os.Exit(1)
 	}
 
 	configPath = os.Args[1]
-	keyToFetch := os.Args[2]
 
 	rawConfig, fileerr := ioutil.ReadFile(configPath)
 	if fileerr != nil {
-		log.Printf("client.go: Invalid json file: %s\n", fileerr)
+		log.Printf("client.go: Invalid config file: %s\n", fileerr)
 		os.Exit(1)
 	}
 	clientConfig := &utils.ClientConfig{}
@@ -34,43 +35,49 @@ func main() {
 		log.Printf("client.go: Invalid json file: %s\n", jsonErr)
 		os.Exit(1)
 	}
-	vecLogger := govec.InitGoVector("Client-"+clientConfig.ID, "Client-"+clientConfig.ID, govec.GetDefaultConfig())
 
-	//1. communicate to DS to get the list of tor nodes
-	DSPublicKey, keyErr := keyLibrary.LoadPublicKey(clientConfig.DSPublicKeyPath)
-	if keyErr != nil {
-		panic(keyErr)
+	if clientConfig.Guards.StateFile == "" {
+		clientConfig.Guards.StateFile = TorClient.DefaultGuardStateFile(configPath)
 	}
-	tnMap, dsErr := TorClient.ContactDsSerer(clientConfig.DSIPPort, clientConfig.MaxNumNodes, *DSPublicKey, vecLogger)
-
-	if dsErr != nil {
-		fmt.Printf("Could not contact directory server for error: %s\n", dsErr)
-		os.Exit(1)
+	if clientConfig.Timeouts.StateFile == "" {
+		clientConfig.Timeouts.StateFile = TorClient.DefaultTimeoutStateFile(configPath)
 	}
 
-	if uint16(len(tnMap)) < clientConfig.MaxNumNodes {
-		fmt.Printf("Directory server didn't send enough tor nodes: needed %d, received: %d\n", clientConfig.MaxNumNodes, len(tnMap))
+	client, err := TorClient.NewClient(*clientConfig)
+	if err != nil {
+		fmt.Printf("Could not start client for error: %s\n", err)
 		os.Exit(1)
 	}
-
-	nodeOrder := TorClient.DetermineTnOrder(tnMap)
-	fmt.Println("Client: using Tor circuit: ", nodeOrder)
-	nodeOrder = append(nodeOrder, clientConfig.ServerIPPort)
-
-	//2. create and send onion
-	serverPublicKey, err := keyLibrary.LoadPublicKey(clientConfig.ServerPublicKeyPath)
-	if err != nil {
-		panic(err)
+	defer client.Close()
+
+	if len(os.Args)-1 == 1 {
+		if clientConfig.ControlPort.IPPort != "" {
+			listener, err := net.Listen("tcp", clientConfig.ControlPort.IPPort)
+			if err != nil {
+				fmt.Printf("Could not open the control port for error: %s\n", err)
+				os.Exit(1)
+			}
+			defer listener.Close()
+			fmt.Println("Client: listening for controllers on ", clientConfig.ControlPort.IPPort)
+			go func() {
+				if err := client.ServeControl(listener); err != nil {
+					fmt.Printf("Client: control port closed: %s\n", err)
+				}
+			}()
+		}
+		if err := TorClient.RunShell(client, os.Stdin, os.Stdout); err != nil {
+			fmt.Printf("Client: shell input failed: %s\n", err)
+		}
+		return
 	}
 
-	tnMap[clientConfig.ServerIPPort] = *serverPublicKey
-
+	keyToFetch := os.Args[2]
 	fmt.Println("Client: Fetching key: ", keyToFetch)
-	onionMessage, symmKeys := TorClient.CreateOnionMessage(nodeOrder, tnMap, keyToFetch)
-
-	res, sendErr := TorClient.SendOnionMessage(nodeOrder[0], onionMessage, symmKeys, vecLogger)
-	if sendErr != nil {
-		fmt.Printf("Could not send onion message for error: %s\n", sendErr)
+	res, err := client.Get(context.Background(), keyToFetch)
+	if err != nil {
+		fmt.Printf("Could not fetch %s for error: %s\n", keyToFetch, err)
+		// os.Exit skips the deferred Close, which saves what the client learned
+		client.Close()
 		os.Exit(1)
 	}
 
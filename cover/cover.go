@@ -0,0 +1,190 @@
+package cover
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"sync"
+	"time"
+
+	"../keyLibrary"
+	"../utils"
+	"github.com/DistributedClocks/GoVector/govec"
+)
+
+const (
+	defaultPayloadBytes = 512
+	// a CachedDirectory fetches the relays again after this long
+	directoryRefresh = 5 * time.Minute
+)
+
+// Directory returns the relays cover circuits are picked from. It is asked before
+// every cover onion, so it should answer from what it already knows.
+type Directory func() (map[string]rsa.PublicKey, error)
+
+// CachedDirectory calls fetch at most once every few minutes, for a tor node, which
+// keeps no relays of its own
+func CachedDirectory(fetch func() (map[string]rsa.PublicKey, error)) Directory {
+	var mu sync.Mutex
+	var relays map[string]rsa.PublicKey
+	var fetchedAt time.Time
+	return func() (map[string]rsa.PublicKey, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if relays == nil || time.Since(fetchedAt) > directoryRefresh {
+			fetched, err := fetch()
+			if err != nil {
+				return nil, err
+			}
+			relays, fetchedAt = fetched, time.Now()
+		}
+		copied := make(map[string]rsa.PublicKey, len(relays))
+		for addr, key := range relays {
+			copied[addr] = key
+		}
+		return copied, nil
+	}
+}
+
+// Traffic sends dummy onions through random circuits until stopped.
+// The last relay of every cover circuit drops the onion and answers with padding.
+type Traffic struct {
+	config    utils.CoverTrafficConfig
+	links     utils.LinkConfig
+	directory Directory
+	self      string // never used as a hop, empty for clients
+	logger    *log.Logger
+	vecLogger *govec.GoLog
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+
+	mu            sync.Mutex
+	onionsSent    uint64
+	bytesSent     uint64
+	bytesReceived uint64
+}
+
+// Start kicks off the cover traffic daemon, returns nil if it is disabled in config.
+// Cover circuits are picked from directory, without self. Failures go to logger.
+func Start(config utils.CoverTrafficConfig, links utils.LinkConfig, directory Directory, self string, logger *log.Logger, vecLogger *govec.GoLog) *Traffic {
+	if !config.Enabled || config.MeanIntervalMillis <= 0 || config.PathLength == 0 {
+		return nil
+	}
+	if config.PayloadBytes <= 0 {
+		config.PayloadBytes = defaultPayloadBytes
+	}
+
+	c := &Traffic{
+		config:    config,
+		links:     links,
+		directory: directory,
+		self:      self,
+		logger:    logger,
+		vecLogger: vecLogger,
+		stopCh:    make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+func (c *Traffic) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stopCh)
+	})
+}
+
+// Stats returns the number of cover onions sent and the bytes they cost in each direction
+func (c *Traffic) Stats() (onionsSent uint64, bytesSent uint64, bytesReceived uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.onionsSent, c.bytesSent, c.bytesReceived
+}
+
+func (c *Traffic) run() {
+	random := mathrand.New(mathrand.NewSource(time.Now().UnixNano()))
+	mean := float64(c.config.MeanIntervalMillis) * float64(time.Millisecond)
+
+	for {
+		// exponential gaps make the onions a poisson process, so their timing says nothing
+		wait := time.Duration(random.ExpFloat64() * mean)
+		select {
+		case <-c.stopCh:
+			return
+		case <-time.After(wait):
+		}
+
+		err := c.sendCoverOnion()
+		if err != nil {
+			c.logger.Printf("WARNING failed to send cover onion: %s", err)
+		}
+	}
+}
+
+func (c *Traffic) sendCoverOnion() error {
+	// asking the DS now would tell it when cover onions go out
+	tnMap, dirErr := c.directory()
+	if dirErr != nil {
+		return dirErr
+	}
+	delete(tnMap, c.self)
+	if len(tnMap) == 0 {
+		return fmt.Errorf("no tor nodes available for a cover circuit")
+	}
+
+	nodeOrder := make([]string, 0, len(tnMap))
+	for addr := range tnMap {
+		nodeOrder = append(nodeOrder, addr)
+	}
+	mathrand.Shuffle(len(nodeOrder), func(i, j int) { nodeOrder[i], nodeOrder[j] = nodeOrder[j], nodeOrder[i] })
+	if len(nodeOrder) > int(c.config.PathLength) {
+		nodeOrder = nodeOrder[:c.config.PathLength]
+	}
+	onion, _, err := CreateOnion(nodeOrder, tnMap, c.config.PayloadBytes)
+	if err != nil {
+		return err
+	}
+
+	first := tnMap[nodeOrder[0]]
+	conn, connErr := c.links.Dial(nodeOrder[0], keyLibrary.KeyFingerprint(&first), 0)
+	if connErr != nil {
+		return connErr
+	}
+	defer conn.Close()
+
+	sent, werr := utils.WriteData(conn, onion, c.vecLogger, "Sending cover onion to Tor network")
+	if werr != nil {
+		return werr
+	}
+
+	received := 0
+	var rerr error
+	for {
+		var padding *utils.Cell
+		padding, rerr = utils.ReadCell(conn, c.vecLogger, "Received cover onion response")
+		if rerr != nil || padding.Command != utils.CellData {
+			break
+		}
+		received += len(padding.Payload)
+	}
+
+	c.mu.Lock()
+	c.onionsSent++
+	c.bytesSent += uint64(sent)
+	c.bytesReceived += uint64(received)
+	c.mu.Unlock()
+
+	return rerr
+}
+
+// CreateOnion builds a dummy onion through the given relays, the last relay sees the
+// cover flag and drops it. The onion is built exactly like a real one.
+// returns the onion and the symmetric keys from T1 to Tn
+func CreateOnion(nodeOrder []string, tnMap map[string]rsa.PublicKey, payloadBytes int) ([]byte, [][]byte, error) {
+	dummy := make([]byte, payloadBytes)
+	rand.Read(dummy)
+
+	return utils.WrapRelayOnion(nodeOrder, tnMap, utils.Onion{Payload: dummy, Cover: true})
+}
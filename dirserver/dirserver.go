@@ -3,6 +3,8 @@ package main
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	mathrand "math/rand"
@@ -33,10 +35,14 @@ type DirServer struct {
 	PortForTC string
 	PriKey    *rsa.PrivateKey
 	TNs       map[string]rsa.PublicKey
+	Exits     map[string]utils.ExitPorts         // TNs that open connections out of the network, with their policy
+	Services  map[string]utils.ServiceDescriptor // by onion address
 	Fd        utils.FD
 	NotifyCh  <-chan utils.FailureDetected
 	Mu        *sync.RWMutex
 	VecLogger *govec.GoLog
+	TNTLS     *tls.Config // asks TNs for their identity certificate
+	TCTLS     *tls.Config
 }
 
 func main() {
@@ -74,7 +80,10 @@ func NewDirServer(Ip, PortForTN, PortForTC string) *DirServer {
 
 	ds := new(DirServer)
 	ds.LoadPrivateKey()
+	ds.InitTLS()
 	ds.TNs = make(map[string]rsa.PublicKey)
+	ds.Exits = make(map[string]utils.ExitPorts)
+	ds.Services = make(map[string]utils.ServiceDescriptor)
 	ds.Mu = &sync.RWMutex{}
 	ds.Ip = Ip
 	ds.PortForTN = PortForTN
@@ -92,6 +101,16 @@ func (ds *DirServer) LoadPrivateKey() {
 	ds.PriKey = key
 }
 
+// TLS links are bound to the DS key, which clients and TNs already have
+func (ds *DirServer) InitTLS() {
+
+	var err error
+	ds.TNTLS, err = keyLibrary.ServerTLSConfig(ds.PriKey, true)
+	checkError(err)
+	ds.TCTLS, err = keyLibrary.ServerTLSConfig(ds.PriKey, false)
+	checkError(err)
+}
+
 func (ds *DirServer) InitFD() {
 
 	fd, notifyCh, err := utils.Initialize(epochNonce, chCapacity)
@@ -126,7 +145,7 @@ func (ds *DirServer) ListenAndServeTN() {
 		fmt.Println("================================================================")
 		fmt.Println("Here comes a new TN: ", conn.RemoteAddr().String())
 
-		go ds.HandleTN(conn)
+		go ds.HandleTN(tls.Server(conn, ds.TNTLS))
 	}
 }
 
@@ -149,11 +168,11 @@ func (ds *DirServer) ListenAndServeTC() {
 		fmt.Println("================================================================")
 		fmt.Println("Here comes a new TC: ", conn.RemoteAddr().String())
 
-		go ds.HandleTC(conn)
+		go ds.HandleTC(tls.Server(conn, ds.TCTLS))
 	}
 }
 
-func (ds *DirServer) HandleTN(conn *net.TCPConn) {
+func (ds *DirServer) HandleTN(conn *tls.Conn) {
 
 	defer func() {
 		err := conn.Close()
@@ -175,8 +194,25 @@ func (ds *DirServer) HandleTN(conn *net.TCPConn) {
 		return
 	}
 
+	// only the holder of a key may publish it, or anyone could hijack a TN's address
+	peerKey, err := keyLibrary.PeerKey(conn)
+	if err != nil {
+		printError("HandleTN: TN presented no identity", err)
+		return
+	}
+	if keyLibrary.KeyFingerprint(peerKey) != keyLibrary.KeyFingerprint(&req.PubKey) {
+		printError("HandleTN: rejecting "+req.TorIpPort, errors.New("published key does not match the TLS identity"))
+		ds.writeJoinResponse(conn, req.TorIpPort, utils.NetworkJoinResponse{Status: false})
+		return
+	}
+
 	ds.Mu.Lock()
 	ds.TNs[req.TorIpPort] = req.PubKey
+	if req.Exit {
+		ds.Exits[req.TorIpPort] = req.ExitPorts
+	} else {
+		delete(ds.Exits, req.TorIpPort)
+	}
 	ds.Mu.Unlock()
 
 	var resp utils.NetworkJoinResponse
@@ -188,25 +224,36 @@ func (ds *DirServer) HandleTN(conn *net.TCPConn) {
 		resp.Status = false
 	}
 
+	if !ds.writeJoinResponse(conn, req.TorIpPort, resp) {
+		return
+	}
+
+	if resp.Status {
+		Trace.Println("TN: " + req.TorIpPort + " has joined the Tor network")
+		if req.Exit {
+			Trace.Println("TN: " + req.TorIpPort + " is an exit")
+		}
+		Trace.Println("Start monitoring TN: ", req.FdlibIpPort)
+	}
+}
+
+func (ds *DirServer) writeJoinResponse(conn net.Conn, torIpPort string, resp utils.NetworkJoinResponse) bool {
+
 	respBytes, err := utils.Marshall(&resp)
 	if err != nil {
 		printError("HandleTN: response marshaling failed", err)
-		return
+		return false
 	}
 
-	_, err = utils.TCPWrite(conn, respBytes, ds.VecLogger, "Confirm new Tor node from "+req.TorIpPort+" to join")
+	_, err = utils.TCPWrite(conn, respBytes, ds.VecLogger, "Confirm new Tor node from "+torIpPort+" to join")
 	if err != nil {
 		printError("HandleTN: response write failed", err)
-		return
-	}
-
-	if resp.Status {
-		Trace.Println("TN: " + req.TorIpPort + " has joined the Tor network")
-		Trace.Println("Start monitoring TN: ", req.FdlibIpPort)
+		return false
 	}
+	return true
 }
 
-func (ds *DirServer) HandleTC(conn *net.TCPConn) {
+func (ds *DirServer) HandleTC(conn net.Conn) {
 
 	defer func() {
 		err := conn.Close()
@@ -234,10 +281,25 @@ func (ds *DirServer) HandleTC(conn *net.TCPConn) {
 		return
 	}
 
-	// Select a specified number of TNs at random. If not enough TNs, return all of them
-	circuit := ds.SetupCircuit(req.NumNodes)
 	var resp utils.DsResponse
-	resp.DnMap = circuit
+	var circuit map[string]rsa.PublicKey
+	switch {
+	case req.Publish:
+		resp.Published = ds.StoreDescriptor(conn, req.SymmKey)
+	case req.Service != "":
+		ds.Mu.RLock()
+		if descriptor, ok := ds.Services[req.Service]; ok {
+			resp.Descriptor = &descriptor
+		}
+		ds.Mu.RUnlock()
+	default:
+		// Select a specified number of TNs at random. If not enough TNs, return all of them
+		circuit = ds.SetupCircuit(req.NumNodes)
+		if req.Exit {
+			circuit, resp.Exits, resp.ExitPorts = ds.AddExit(circuit, req.ExitPort)
+		}
+		resp.DnMap = circuit
+	}
 
 	// Marshall and encrypt the circuit
 	respBytes, err := utils.Marshall(&resp)
@@ -253,7 +315,61 @@ func (ds *DirServer) HandleTC(conn *net.TCPConn) {
 		return
 	}
 
-	Trace.Println("A circuit of ", len(circuit), " TNs has been setup for TC: ", conn.RemoteAddr())
+	if circuit != nil {
+		Trace.Println("A circuit of ", len(circuit), " TNs has been setup for TC: ", conn.RemoteAddr())
+	}
+}
+
+// reads what follows a request into v, encrypted with the request key
+func (ds *DirServer) readRequestBody(conn net.Conn, symmKey []byte, v interface{}) bool {
+
+	buf, err := utils.TCPRead(conn, ds.VecLogger, "Received request body")
+	if err != nil {
+		printError("readRequestBody: reading from connection failed", err)
+		return false
+	}
+
+	decrypted, err := keyLibrary.SymmKeyDecryptBase64(buf, symmKey)
+	if err != nil {
+		printError("readRequestBody: decryption failed", err)
+		return false
+	}
+
+	err = utils.UnMarshall(decrypted, v)
+	if err != nil {
+		printError("readRequestBody: unmarshal failed", err)
+		return false
+	}
+	return true
+}
+
+// an onion service sends its descriptor after the request, encrypted with the request key.
+// Only the holder of the service key can sign it, and a newer descriptor replaces an older one.
+func (ds *DirServer) StoreDescriptor(conn net.Conn, symmKey []byte) bool {
+
+	var descriptor utils.ServiceDescriptor
+	if !ds.readRequestBody(conn, symmKey, &descriptor) {
+		return false
+	}
+
+	address := utils.ServiceAddress(&descriptor.ServiceKey)
+	err := descriptor.Verify(address)
+	if err != nil {
+		printError("StoreDescriptor: rejecting descriptor for "+address, err)
+		return false
+	}
+
+	ds.Mu.Lock()
+	defer ds.Mu.Unlock()
+
+	if old, ok := ds.Services[address]; ok && old.Published >= descriptor.Published {
+		printError("StoreDescriptor: rejecting descriptor for "+address, errors.New("not newer than the one already published"))
+		return false
+	}
+	ds.Services[address] = descriptor
+
+	Trace.Println("Onion service "+address+" published with ", len(descriptor.IntroPoints), " introduction points")
+	return true
 }
 
 func (ds *DirServer) StartMonitoring() {
@@ -285,6 +401,7 @@ func (ds *DirServer) RemoveTN(TNAddr string) {
 		if ip == ipToRemove {
 			ds.Mu.Lock()
 			delete(ds.TNs, addr)
+			delete(ds.Exits, addr)
 			ds.Mu.Unlock()
 			Trace.Println("TN: " + addr + " has been removed from Tor network")
 		}
@@ -315,6 +432,44 @@ func (ds *DirServer) SetupCircuit(numTNs uint16) map[string]rsa.PublicKey {
 	return circuit
 }
 
+// AddExit lists the exits among the TNs of a circuit with their policies, adding a random
+// one when none of them allows port. Port 0 is allowed by every exit.
+func (ds *DirServer) AddExit(circuit map[string]rsa.PublicKey, port int) (map[string]rsa.PublicKey, []string, map[string]utils.ExitPorts) {
+
+	ds.Mu.RLock()
+	defer ds.Mu.RUnlock()
+
+	withExit := make(map[string]rsa.PublicKey)
+	exits := make([]string, 0)
+	policies := make(map[string]utils.ExitPorts)
+	allowed := false
+	for addr, key := range circuit {
+		withExit[addr] = key
+		if policy, ok := ds.Exits[addr]; ok {
+			exits = append(exits, addr)
+			policies[addr] = policy
+			allowed = allowed || port == 0 || policy.Allows(port)
+		}
+	}
+	if allowed {
+		return withExit, exits, policies
+	}
+
+	candidates := make([]string, 0, len(ds.Exits))
+	for addr, policy := range ds.Exits {
+		if port == 0 || policy.Allows(port) {
+			candidates = append(candidates, addr)
+		}
+	}
+	if len(candidates) == 0 {
+		return withExit, exits, policies
+	}
+	exit := candidates[mathrand.Intn(len(candidates))]
+	withExit[exit] = ds.TNs[exit]
+	policies[exit] = ds.Exits[exit]
+	return withExit, append(exits, exit), policies
+}
+
 /**
  *	If there is not a pair of keys available yet, we call this func to generate a pair for use.
  */
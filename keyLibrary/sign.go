@@ -0,0 +1,20 @@
+package keyLibrary
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+)
+
+// Sign makes an RSA-PSS signature over the SHA-256 of message
+func Sign(key *rsa.PrivateKey, message []byte) ([]byte, error) {
+	digest := sha256.Sum256(message)
+	return rsa.SignPSS(rand.Reader, key, crypto.SHA256, digest[:], nil)
+}
+
+// VerifySignature checks a signature made with Sign, nil means it holds
+func VerifySignature(key *rsa.PublicKey, message []byte, signature []byte) error {
+	digest := sha256.Sum256(message)
+	return rsa.VerifyPSS(key, crypto.SHA256, digest[:], signature, nil)
+}
@@ -0,0 +1,126 @@
+package keyLibrary
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	stdx509 "crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// how long the certificate of a node is valid, nodes make a new one on every start
+const certValidity = 365 * 24 * time.Hour
+
+// KeyFingerprint identifies a node by its public key, hex SHA-256 of the PKCS#1 encoding
+func KeyFingerprint(key *rsa.PublicKey) string {
+	sum := sha256.Sum256(stdx509.MarshalPKCS1PublicKey(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// SelfSignedCertificate makes a TLS certificate for the node's identity key, so a peer
+// that knows the key from the directory can check it is talking to the right node
+func SelfSignedCertificate(key *rsa.PrivateKey) (tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := stdx509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: KeyFingerprint(&key.PublicKey)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(certValidity),
+		KeyUsage:     stdx509.KeyUsageDigitalSignature | stdx509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []stdx509.ExtKeyUsage{stdx509.ExtKeyUsageServerAuth, stdx509.ExtKeyUsageClientAuth},
+	}
+	der, err := stdx509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// ServerTLSConfig serves the node's identity certificate. With requireClientKey the
+// peer has to present a certificate too, its key is then available through PeerKey.
+func ServerTLSConfig(key *rsa.PrivateKey, requireClientKey bool) (*tls.Config, error) {
+	cert, err := SelfSignedCertificate(key)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if requireClientKey {
+		// there is no CA, the handler checks the key against the one it expects
+		config.ClientAuth = tls.RequireAnyClientCert
+	}
+	return config, nil
+}
+
+// ClientTLSConfig only accepts a peer whose certificate carries the key with the given
+// fingerprint. The key, when set, is presented to the peer as our own identity.
+func ClientTLSConfig(peerFingerprint string, key *rsa.PrivateKey) (*tls.Config, error) {
+	if peerFingerprint == "" {
+		return nil, errors.New("no peer key to verify the link against")
+	}
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// certificates are self-signed, the key is verified below instead of a chain
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*stdx509.Certificate) error {
+			peerKey, err := certificateKey(rawCerts)
+			if err != nil {
+				return err
+			}
+			if KeyFingerprint(peerKey) != peerFingerprint {
+				return fmt.Errorf("peer key %s does not match the expected %s", KeyFingerprint(peerKey), peerFingerprint)
+			}
+			return nil
+		},
+	}
+	if key != nil {
+		cert, err := SelfSignedCertificate(key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// PeerKey returns the identity key of the other end of an established TLS link
+func PeerKey(conn *tls.Conn) (*rsa.PublicKey, error) {
+	if err := conn.Handshake(); err != nil {
+		return nil, err
+	}
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, errors.New("peer presented no certificate")
+	}
+	key, ok := certs[0].PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("peer certificate does not hold an RSA key")
+	}
+	return key, nil
+}
+
+func certificateKey(rawCerts [][]byte) (*rsa.PublicKey, error) {
+	if len(rawCerts) == 0 {
+		return nil, errors.New("peer presented no certificate")
+	}
+	cert, err := stdx509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return nil, err
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("peer certificate does not hold an RSA key")
+	}
+	return key, nil
+}
@@ -2,12 +2,17 @@ package DataServer
 
 import (
 	"crypto/rsa"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
+	"sort"
+	"strings"
 	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/DistributedClocks/GoVector/govec"
 
@@ -17,17 +22,24 @@ import (
 
 const TCP_PROTO = "tcp"
 
+// largest slice of a value sent in one response frame
+const RESPONSE_FRAME_SIZE = utils.RESPONSE_FRAME_SIZE
+
 type Server struct {
 	Key          *rsa.PrivateKey   // Private key of the server, the public key is also in this data structure.
 	IpPort       string            // The ip port the server will be listening for connection on.
 	DataBase     map[string]string // The key value pair this database stores.
 	LockDataBase *sync.Mutex       // Lock to ensure synchronized database access.
 	VecLogger    *govec.GoLog
+	FlowControl  utils.FlowControlConfig // Window sizes for sending response frames.
+	Hidden       HiddenServiceConfig     // Runs the server as an onion service when enabled.
 }
 
 type Config struct {
-	IncomingTcpAddr string            // The ip port the server will be listening for connection on
-	DataBase        map[string]string // The key value pair for the data base
+	IncomingTcpAddr string                  // The ip port the server will be listening for connection on
+	DataBase        map[string]string       // The key value pair for the data base
+	FlowControl     utils.FlowControlConfig // Optional, defaults apply to windows left at 0
+	Hidden          HiddenServiceConfig     // Optional, IncomingTcpAddr is not used when enabled
 }
 
 func Initialize(configFile string, privateKeyFile string) (*Server, error) {
@@ -61,7 +73,7 @@ func Initialize(configFile string, privateKeyFile string) (*Server, error) {
 
 	vecLogger := govec.InitGoVector("data-server", "data-server", govec.GetDefaultConfig())
 
-	return &Server{privateKey, config.IncomingTcpAddr, config.DataBase, &sync.Mutex{}, vecLogger}, err
+	return &Server{privateKey, config.IncomingTcpAddr, config.DataBase, &sync.Mutex{}, vecLogger, config.FlowControl, config.Hidden}, err
 }
 
 func (s *Server) StartService() {
@@ -74,6 +86,13 @@ func (s *Server) StartService() {
 
 	listener, err := net.ListenTCP(TCP_PROTO, localTcpAddr)
 
+	// exit relays verify the link against our key, which clients name in the onion
+	tlsConfig, err := keyLibrary.ServerTLSConfig(s.Key, false)
+	if err != nil {
+		fmt.Println("TLS certificate creation failed, please try again.")
+		return
+	}
+
 	for {
 		fmt.Println("Start accepting connections at:", s.IpPort)
 		tcpConn, err := listener.AcceptTCP()
@@ -84,78 +103,200 @@ func (s *Server) StartService() {
 			fmt.Println("Incoming connection established with client:", tcpConn.RemoteAddr().String())
 		}
 
-		go s.connectionHandler(tcpConn)
+		go s.connectionHandler(tls.Server(tcpConn, tlsConfig))
 	}
 }
 
-func (s *Server) connectionHandler(conn *net.TCPConn) {
+func (s *Server) connectionHandler(conn net.Conn) {
 	// Note connection will be closed by the TN.
 
-	reqEncrypt, err := utils.TCPRead(conn, s.VecLogger, "Received client request")
+	cell, err := utils.ReadCell(conn, s.VecLogger, "Received client request")
 
 	if err != nil {
 		fmt.Println("Server handler: reading data from connection failed")
 		return
 	}
 
-	req := unmarshalServerRequest(reqEncrypt, s.Key)
-
-	var resp utils.Response
-	s.LockDataBase.Lock()
-	if val, ok := s.DataBase[req.Key]; ok {
-		resp.Value = val
+	if cell.Command != utils.CellData {
+		fmt.Println("Server handler: circuit destroyed before the request arrived:", cell.Reason)
+		return
 	}
-	s.LockDataBase.Unlock()
 
-	respData, err := json.Marshal(&resp)
+	req, err := unmarshalServerRequest(cell.Payload, s.Key)
 	if err != nil {
-		fmt.Println("Server handler: response marshaling failed")
+		// the exit relay reports it to the client, we don't share a key with the client yet
+		utils.WriteDestroy(conn, utils.ReasonDecryptFailed, s.VecLogger, "Client request rejected")
+		return
+	}
+
+	var resp utils.Response
+	switch req.Op {
+	case utils.RequestGet:
+		resp.Value = s.lookup(req.Key)
+	case utils.RequestPut:
+		s.store(req.Key, req.Value)
+	case utils.RequestList:
+		resp.Value = strings.Join(s.keys(), "\n")
+	default:
+		fmt.Println("Server handler: unknown request:", req.Op)
+		utils.WriteDestroy(conn, utils.ReasonRefused, s.VecLogger, "Client request refused")
 		return
 	}
 
-	encryptedData, err := keyLibrary.SymmKeyEncrypt(respData, req.SymmKey)
+	window := utils.NewSendWindow(s.FlowControl)
+	defer window.Close()
+	go s.sendmeHandler(conn, window)
+
+	// stop sending once the client's deadline passes, even while waiting for a sendme
+	deadline := utils.GiveUpAt(req.Deadline)
+	if !deadline.IsZero() {
+		timer := time.AfterFunc(time.Until(deadline), window.Close)
+		defer timer.Stop()
+	}
 
-	_, err = utils.TCPWrite(conn, encryptedData, s.VecLogger, "Responded to client request")
+	// lets the client notice frames dropped or reordered by the relays
+	digest := utils.NewRunningDigest(req.SymmKey)
 
-	fmt.Println("Server response sent to:", conn.RemoteAddr())
+	// large values go back as several frames, the client puts them together
+	for _, chunk := range splitValue(resp.Value, RESPONSE_FRAME_SIZE) {
+		respData, err := json.Marshal(&utils.Response{Value: chunk, Digest: digest.Add([]byte(chunk))})
+		if err != nil {
+			fmt.Println("Server handler: response marshaling failed")
+			return
+		}
+
+		encryptedData, err := keyLibrary.SymmKeyEncrypt(respData, req.SymmKey)
+		if err != nil {
+			// the symmetric key the client sent is no good
+			fmt.Println("Server handler: response encryption failed:", err)
+			utils.WriteDestroy(conn, utils.ReasonProtocol, s.VecLogger, "Response encryption failed")
+			return
+		}
+
+		_, err = window.Acquire(utils.DEFAULT_STREAM_ID)
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			fmt.Println("Server handler: request deadline passed")
+			utils.WriteDestroy(conn, utils.ReasonTimeout, s.VecLogger, "Request deadline passed")
+			return
+		}
+		if err != nil {
+			fmt.Println("Server handler: circuit closed while waiting for a sendme")
+			return
+		}
+		cell := utils.Cell{Command: utils.CellData, StreamID: utils.DEFAULT_STREAM_ID, Payload: encryptedData}
+		_, err = utils.WriteCell(conn, cell, s.VecLogger, "Responded to client request")
+
+		if err != nil {
+			fmt.Println("Server handler: response write failed")
+			return
+		}
+	}
 
+	_, err = utils.WriteEnd(conn, s.VecLogger, "Response complete")
 	if err != nil {
-		fmt.Println("Server handler: response write failed")
+		fmt.Println("Server handler: response end write failed")
 		return
 	}
 
-	//if n != len(encryptedData) {
-	//	fmt.Println("Server handler: incorrect number of bytes written to the connection")
-	//	return
-	//}
+	fmt.Println("Server response sent to:", conn.RemoteAddr())
+}
+
+// the value stored under key, empty when there is none
+func (s *Server) lookup(key string) string {
+	s.LockDataBase.Lock()
+	defer s.LockDataBase.Unlock()
+	return s.DataBase[key]
+}
+
+func (s *Server) store(key string, value string) {
+	s.LockDataBase.Lock()
+	defer s.LockDataBase.Unlock()
+	if s.DataBase == nil {
+		s.DataBase = make(map[string]string)
+	}
+	s.DataBase[key] = value
+}
+
+// the keys in the database, sorted
+func (s *Server) keys() []string {
+	s.LockDataBase.Lock()
+	defer s.LockDataBase.Unlock()
+	keys := make([]string, 0, len(s.DataBase))
+	for key := range s.DataBase {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// opens the send window for every sendme the client sends back, until the circuit closes
+func (s *Server) sendmeHandler(conn net.Conn, window *utils.SendWindow) {
+	defer window.Close()
+	for {
+		cell, err := utils.ReadCell(conn, s.VecLogger, "Received sendme")
+		if err != nil || cell.Command == utils.CellDestroy {
+			return
+		}
+		if cell.Command == utils.CellSendme {
+			window.Ack(cell.StreamID)
+		}
+	}
+}
+
+// split value into chunks of at most size bytes without cutting a character in half,
+// an empty value is still one chunk
+func splitValue(value string, size int) []string {
+	chunks := make([]string, 0, len(value)/size+1)
+	for len(value) > size {
+		cut := size
+		for cut > 0 && !utf8.RuneStart(value[cut]) {
+			cut--
+		}
+		if cut == 0 {
+			cut = size
+		}
+		chunks = append(chunks, value[:cut])
+		value = value[cut:]
+	}
+	return append(chunks, value)
 }
 
-func unmarshalServerRequest(data []byte, serverKey *rsa.PrivateKey) utils.Request {
+func unmarshalServerRequest(data []byte, serverKey *rsa.PrivateKey) (utils.Request, error) {
 
 	var serverBytes [][]byte
+	var serverMessage utils.Request
 
 	err := utils.UnMarshall(data, &serverBytes)
 	if err != nil {
 		fmt.Println("Error unmarshal client requests bytes:", err)
+		return serverMessage, err
 	}
 
-	var decryptedServerBytes []byte
-
-	for i := range serverBytes {
-		decryptedBytePiece, err := keyLibrary.PrivKeyDecrypt(serverKey, serverBytes[i])
-		if err != nil {
-			fmt.Println("failed to decrypt client requests:", err)
-		}
-		decryptedServerBytes = append(decryptedServerBytes, decryptedBytePiece...)
+	decryptedServerBytes, err := decryptChunks(serverBytes, serverKey)
+	if err != nil {
+		fmt.Println("failed to decrypt client requests:", err)
+		return serverMessage, err
 	}
 
-	var serverMessage utils.Request
-
 	err = utils.UnMarshall(decryptedServerBytes, &serverMessage)
 
 	if err != nil {
 		fmt.Println("Error unmarshal client requests:", err)
+		return serverMessage, err
 	}
 
-	return serverMessage
+	return serverMessage, nil
+}
+
+// clients encrypt anything longer than one RSA block to our key in pieces
+func decryptChunks(chunks [][]byte, serverKey *rsa.PrivateKey) ([]byte, error) {
+	var decrypted []byte
+	for i := range chunks {
+		piece, err := keyLibrary.PrivKeyDecrypt(serverKey, chunks[i])
+		if err != nil {
+			return nil, err
+		}
+		decrypted = append(decrypted, piece...)
+	}
+	return decrypted, nil
 }
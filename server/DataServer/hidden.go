@@ -0,0 +1,269 @@
+package DataServer
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"sync"
+	"time"
+
+	"../../client/TorClient"
+	"../../keyLibrary"
+	"../../utils"
+)
+
+const (
+	defaultIntroPoints     = 3
+	defaultCircuitLength   = 2
+	defaultDSPublicKeyPath = "./dirserver/public.pem"
+
+	// the DS keeps the newest descriptor, republishing keeps it fresh
+	descriptorRepublish = 10 * time.Minute
+	// wait before trying again for missing introduction points
+	introRetry = 5 * time.Second
+)
+
+type HiddenServiceConfig struct {
+	Enabled         bool
+	IntroPoints     int    // introduction points to keep circuits to, 3 when 0
+	CircuitLength   uint16 // relays on each circuit of the service, 2 when 0
+	DSIPPort        string // the DS port for clients, the descriptor is published there
+	DSPublicKeyPath string // ./dirserver/public.pem when empty
+	utils.LinkConfig
+}
+
+type hiddenService struct {
+	s           *Server
+	config      HiddenServiceConfig
+	dsPublicKey rsa.PublicKey
+	address     string
+	introDown   chan string
+
+	intros map[string]rsa.PublicKey // only touched by the StartHiddenService loop
+
+	mu     sync.Mutex
+	relays map[string]rsa.PublicKey // the DS's last list, rendezvous circuits go through them
+}
+
+// StartHiddenService runs the server as an onion service. It never listens: clients
+// reach it through the circuits it keeps to its introduction points, and it meets them
+// at the rendezvous points they pick. Blocks for as long as the service runs.
+func (s *Server) StartHiddenService() error {
+	config := s.Hidden
+	if config.IntroPoints <= 0 {
+		config.IntroPoints = defaultIntroPoints
+	}
+	if config.CircuitLength == 0 {
+		config.CircuitLength = defaultCircuitLength
+	}
+	if config.DSPublicKeyPath == "" {
+		config.DSPublicKeyPath = defaultDSPublicKeyPath
+	}
+	dsPublicKey, err := keyLibrary.LoadPublicKey(config.DSPublicKeyPath)
+	if err != nil {
+		return err
+	}
+
+	h := &hiddenService{
+		s:           s,
+		config:      config,
+		dsPublicKey: *dsPublicKey,
+		address:     utils.ServiceAddress(&s.Key.PublicKey),
+		introDown:   make(chan string, config.IntroPoints),
+		intros:      make(map[string]rsa.PublicKey),
+		relays:      make(map[string]rsa.PublicKey),
+	}
+	fmt.Println("Onion service address:", h.address)
+
+	republish := time.NewTicker(descriptorRepublish)
+	defer republish.Stop()
+	publish := false
+	for {
+		if h.establishIntroPoints() {
+			publish = true
+		}
+		if publish && len(h.intros) > 0 {
+			err := h.publishDescriptor()
+			if err != nil {
+				fmt.Println("Onion service: publishing descriptor failed:", err)
+			} else {
+				publish = false
+			}
+		}
+
+		var retry <-chan time.Time
+		if publish || len(h.intros) < config.IntroPoints {
+			retry = time.After(introRetry)
+		}
+		select {
+		case introPoint := <-h.introDown:
+			delete(h.intros, introPoint)
+			publish = true
+		case <-republish.C:
+			publish = true
+		case <-retry:
+		}
+	}
+}
+
+// tops the introduction points up to the configured number, true if any were added
+func (h *hiddenService) establishIntroPoints() bool {
+	need := h.config.IntroPoints - len(h.intros)
+	if need <= 0 {
+		return false
+	}
+
+	relays, err := TorClient.ContactDsSerer(h.config.DSIPPort, uint16(2*h.config.IntroPoints)+h.config.CircuitLength, h.dsPublicKey, h.s.VecLogger)
+	if err != nil {
+		fmt.Println("Onion service: could not contact directory server:", err)
+		return false
+	}
+	h.mu.Lock()
+	h.relays = relays
+	h.mu.Unlock()
+
+	added := false
+	for introPoint := range relays {
+		if need == 0 {
+			break
+		}
+		if _, ok := h.intros[introPoint]; ok {
+			continue
+		}
+		circuit, err := h.establishIntro(introPoint, relays)
+		if err != nil {
+			fmt.Printf("Onion service: introduction point %s failed: %s\n", introPoint, err)
+			continue
+		}
+		h.intros[introPoint] = relays[introPoint]
+		go h.serveIntro(introPoint, circuit)
+		added = true
+		need--
+	}
+	return added
+}
+
+func (h *hiddenService) establishIntro(introPoint string, relays map[string]rsa.PublicKey) (*TorClient.ServiceCircuit, error) {
+	path, err := TorClient.CircuitTo(introPoint, relays, h.config.CircuitLength)
+	if err != nil {
+		return nil, err
+	}
+	introKey := relays[introPoint]
+	signature, err := keyLibrary.Sign(h.s.Key, utils.IntroAuth(keyLibrary.KeyFingerprint(&introKey)))
+	if err != nil {
+		return nil, err
+	}
+
+	cell := utils.ServiceCell{Command: utils.ServiceEstablishIntro, ServiceKey: &h.s.Key.PublicKey, Signature: signature}
+	circuit, err := TorClient.OpenServiceCircuit(path, relays, cell, h.config.LinkConfig, h.s.FlowControl, h.s.VecLogger)
+	if err != nil {
+		return nil, err
+	}
+	if err := circuit.ExpectFrame(utils.ServiceEstablishIntro); err != nil {
+		circuit.Close()
+		return nil, err
+	}
+	fmt.Println("Onion service: introduction point established at", introPoint)
+	return circuit, nil
+}
+
+// waits for introductions until the circuit goes down
+func (h *hiddenService) serveIntro(introPoint string, circuit *TorClient.ServiceCircuit) {
+	defer func() {
+		circuit.Close()
+		h.introDown <- introPoint
+	}()
+
+	for {
+		frame, err := circuit.ReadFrame()
+		if err != nil {
+			fmt.Printf("Onion service: introduction circuit to %s closed: %s\n", introPoint, err)
+			return
+		}
+		if frame.Command == utils.ServiceIntroduce {
+			go h.rendezvous(frame.Introduction)
+		}
+	}
+}
+
+func (h *hiddenService) publishDescriptor() error {
+	descriptor := utils.ServiceDescriptor{
+		ServiceKey:  h.s.Key.PublicKey,
+		IntroPoints: make(map[string]rsa.PublicKey),
+		Published:   time.Now().UnixNano(),
+	}
+	for introPoint, key := range h.intros {
+		descriptor.IntroPoints[introPoint] = key
+	}
+	err := descriptor.Sign(h.s.Key)
+	if err != nil {
+		return err
+	}
+	err = TorClient.PublishServiceDescriptor(h.config.DSIPPort, descriptor, h.dsPublicKey, h.s.VecLogger)
+	if err == nil {
+		fmt.Printf("Onion service: descriptor published with %d introduction points\n", len(descriptor.IntroPoints))
+	}
+	return err
+}
+
+// meet the client at its rendezvous point and answer its request there
+func (h *hiddenService) rendezvous(sealed [][]byte) {
+	raw, err := decryptChunks(sealed, h.s.Key)
+	var introduction utils.Introduction
+	if err == nil {
+		err = utils.UnMarshall(raw, &introduction)
+	}
+	if err != nil {
+		fmt.Println("Onion service: dropping introduction we can't read:", err)
+		return
+	}
+
+	h.mu.Lock()
+	relays := make(map[string]rsa.PublicKey)
+	for addr, key := range h.relays {
+		relays[addr] = key
+	}
+	h.mu.Unlock()
+	relays[introduction.RendezvousIPPort] = introduction.RendezvousKey
+
+	path, err := TorClient.CircuitTo(introduction.RendezvousIPPort, relays, h.config.CircuitLength)
+	if err != nil {
+		fmt.Println("Onion service: no circuit to the rendezvous point:", err)
+		return
+	}
+	cell := utils.ServiceCell{Command: utils.ServiceJoinRendezvous, Cookie: introduction.Cookie}
+	circuit, err := TorClient.OpenServiceCircuit(path, relays, cell, h.config.LinkConfig, h.s.FlowControl, h.s.VecLogger)
+	if err != nil {
+		fmt.Println("Onion service: rendezvous circuit failed:", err)
+		return
+	}
+	defer circuit.Close()
+	if err := circuit.ExpectFrame(utils.ServiceJoinRendezvous); err != nil {
+		fmt.Println("Onion service: rendezvous failed:", err)
+		return
+	}
+	circuit.Join(introduction.SymmKey, "client")
+
+	key, err := circuit.Next()
+	if err != nil {
+		fmt.Println("Onion service: reading request failed:", err)
+		return
+	}
+	for _, chunk := range splitValue(h.s.lookup(key), RESPONSE_FRAME_SIZE) {
+		if err := circuit.Send(chunk); err != nil {
+			fmt.Println("Onion service: response write failed:", err)
+			return
+		}
+	}
+	if err := circuit.SendEnd(); err != nil {
+		fmt.Println("Onion service: response end write failed:", err)
+		return
+	}
+
+	// the rendezvous point ends our circuit once the client has the end
+	for {
+		if _, err := circuit.Next(); err != nil {
+			break
+		}
+	}
+	fmt.Println("Onion service: response sent through rendezvous point", introduction.RendezvousIPPort)
+}
@@ -25,5 +25,13 @@ func main() {
 		return
 	}
 
+	if server.Hidden.Enabled {
+		err = server.StartHiddenService()
+		if err != nil {
+			fmt.Println("Onion service failed to start:", err)
+		}
+		return
+	}
+
 	server.StartService()
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"../client/TorClient"
+	"../utils"
+)
+
+func main() {
+	args := os.Args[1:]
+
+	if len(args) < 1 || len(args) > 3 {
+		fmt.Println("Usage: go run socks/socks.go [configFile] [listenIPPort] [httpListenIPPort]")
+		return
+	}
+
+	listenIPPort := "127.0.0.1:9050"
+	if len(args) >= 2 {
+		listenIPPort = args[1]
+	}
+	httpListenIPPort := ""
+	if len(args) == 3 {
+		httpListenIPPort = args[2]
+	}
+
+	rawConfig, fileerr := ioutil.ReadFile(args[0])
+	if fileerr != nil {
+		fmt.Printf("Invalid config file: %s\n", fileerr)
+		return
+	}
+	config := utils.ClientConfig{}
+	jsonErr := json.Unmarshal(rawConfig, &config)
+	if jsonErr != nil {
+		fmt.Printf("Invalid config file: %s\n", jsonErr)
+		return
+	}
+
+	if config.Guards.StateFile == "" {
+		config.Guards.StateFile = TorClient.DefaultGuardStateFile(args[0])
+	}
+	if config.Timeouts.StateFile == "" {
+		config.Timeouts.StateFile = TorClient.DefaultTimeoutStateFile(args[0])
+	}
+
+	client, err := TorClient.NewClient(config)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer client.Close()
+
+	listener, err := net.Listen("tcp", listenIPPort)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	var httpListener net.Listener
+	if httpListenIPPort != "" {
+		httpListener, err = net.Listen("tcp", httpListenIPPort)
+		if err != nil {
+			fmt.Println(err)
+			listener.Close()
+			return
+		}
+	}
+	var controlListener net.Listener
+	if config.ControlPort.IPPort != "" {
+		controlListener, err = net.Listen("tcp", config.ControlPort.IPPort)
+		if err != nil {
+			fmt.Println(err)
+			listener.Close()
+			if httpListener != nil {
+				httpListener.Close()
+			}
+			return
+		}
+	}
+
+	// ctrl-c stops accepting, streams in flight end with the process
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+		if httpListener != nil {
+			httpListener.Close()
+		}
+		if controlListener != nil {
+			controlListener.Close()
+		}
+	}()
+
+	if httpListener != nil {
+		fmt.Println("Socks: listening for HTTP proxy clients on ", httpListenIPPort)
+		go func() {
+			err := TorClient.ServeHTTPProxy(httpListener, client.Dial)
+			if ctx.Err() == nil {
+				fmt.Println(err)
+				stop()
+			}
+		}()
+	}
+	if controlListener != nil {
+		fmt.Println("Socks: listening for controllers on ", config.ControlPort.IPPort)
+		go func() {
+			err := client.ServeControl(controlListener)
+			if ctx.Err() == nil {
+				fmt.Println(err)
+				stop()
+			}
+		}()
+	}
+	fmt.Println("Socks: listening for SOCKS5 clients on ", listenIPPort)
+	err = TorClient.ServeSOCKS(listener, client.Dial)
+	if ctx.Err() == nil {
+		fmt.Println(err)
+	}
+}
@@ -0,0 +1,50 @@
+package tests
+
+import (
+	"testing"
+
+	"../utils"
+)
+
+const testFingerprint = "a51c75d0a1648463fdba5205d5aedd42417bfc2d53a38da0438d622bd0fe5a9b"
+
+func TestParseBridgeLine(t *testing.T) {
+	line := "obfs 127.0.0.1:4021 " + testFingerprint + " secret=s3"
+	bridge, err := utils.ParseBridgeLine(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bridge.Addr != "127.0.0.1:4021" || bridge.Fingerprint != testFingerprint {
+		t.Errorf("Bridge actual: %+v, expected 127.0.0.1:4021 with fingerprint %s", bridge, testFingerprint)
+	}
+	if bridge.Transport.Name != utils.TRANSPORT_OBFS || bridge.Transport.Secret != "s3" {
+		t.Errorf("Bridge transport actual: %+v, expected obfs with secret s3", bridge.Transport)
+	}
+	if bridge.String() != line {
+		t.Errorf("Bridge line actual: %q, expected: %q", bridge.String(), line)
+	}
+
+	plain, err := utils.ParseBridgeLine("127.0.0.1:4021 " + testFingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain.Transport.Name != "" {
+		t.Errorf("Bridge without a transport actual: %q, expected the default", plain.Transport.Name)
+	}
+}
+
+func TestParseBridgeLineErrors(t *testing.T) {
+	lines := []string{
+		"",
+		"127.0.0.1:4021",
+		"127.0.0.1:4021 not-a-fingerprint",
+		"127.0.0.1:4021 a51c75d0",
+		"carrier-pigeon 127.0.0.1:4021 " + testFingerprint,
+		"obfs 127.0.0.1:4021 " + testFingerprint + " colour=blue",
+	}
+	for _, line := range lines {
+		if _, err := utils.ParseBridgeLine(line); err == nil {
+			t.Errorf("Bridge line %q should be an error", line)
+		}
+	}
+}
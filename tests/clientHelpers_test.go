@@ -2,12 +2,15 @@ package tests
 
 import (
 	"../client/TorClient"
+	"../cover"
 	"../keyLibrary"
 	"../utils"
+	"bytes"
 	"crypto/rsa"
 	"encoding/json"
 	"fmt"
 	"testing"
+	"time"
 )
 
 func TestCreateOnionMessage(t *testing.T) {
@@ -26,11 +29,14 @@ func TestCreateOnionMessage(t *testing.T) {
 
 	order := []string{"1", "2", "3", "server"}
 
-	onionbytes, _ := TorClient.CreateOnionMessage(order, myMap, "Hello World")
+	onionbytes, _, err := TorClient.CreateOnionMessage(order, myMap, "Hello World", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	var encryptedOnionBytes [][]byte
 
-	err := utils.UnMarshall(onionbytes, &encryptedOnionBytes)
+	err = utils.UnMarshall(onionbytes, &encryptedOnionBytes)
 	if err != nil {
 		fmt.Println(err)
 	}
@@ -130,6 +136,61 @@ func TestCreateOnionMessage(t *testing.T) {
 }
 
 
+func TestCreateCoverOnion(t *testing.T) {
+
+	t1Key, _ := keyLibrary.GeneratePrivPubKey()
+	t2Key, _ := keyLibrary.GeneratePrivPubKey()
+
+	myMap := make(map[string]rsa.PublicKey)
+	myMap["1"] = t1Key.PublicKey
+	myMap["2"] = t2Key.PublicKey
+
+	onionBytes, symmKeys, err := cover.CreateOnion([]string{"1", "2"}, myMap, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t1Onion := decryptLayer(t, onionBytes, t1Key)
+	if t1Onion.Cover || t1Onion.NextIpPort != "2" {
+		t.Errorf("First relay should forward the cover onion to 2, got: %s, cover: %t", t1Onion.NextIpPort, t1Onion.Cover)
+	}
+
+	t2Onion := decryptLayer(t, t1Onion.Payload, t2Key)
+	if !t2Onion.Cover || t2Onion.NextIpPort != "" {
+		t.Errorf("Last relay should see a cover onion with no next hop")
+	}
+	if len(t2Onion.Payload) != 512 {
+		t.Errorf("Cover payload size actual: %d, expected: 512", len(t2Onion.Payload))
+	}
+	if !bytes.Equal(symmKeys[0], t1Onion.SymmKey) || !bytes.Equal(symmKeys[1], t2Onion.SymmKey) {
+		t.Errorf("Returned symmetric keys don't match the onion layers")
+	}
+}
+
+func decryptLayer(t *testing.T, onionBytes []byte, key *rsa.PrivateKey) utils.Onion {
+	var chunks [][]byte
+	err := utils.UnMarshall(onionBytes, &chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decrypted []byte
+	for _, chunk := range chunks {
+		piece, err := keyLibrary.PrivKeyDecrypt(key, chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypted = append(decrypted, piece...)
+	}
+
+	var onion utils.Onion
+	err = utils.UnMarshall(decrypted, &onion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return onion
+}
+
 /*
 
 func TestDecryptOnionRes(t *testing.T) {
@@ -165,7 +226,10 @@ func TestDecryptOnionRes(t *testing.T) {
 	//done creating onion message
 
 	//unwrap union message
-	res := TorClient.DecryptServerResponse(endOnionBytes, symmKeys)
+	res, err := TorClient.DecryptServerResponse(endOnionBytes, symmKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if res != "Hello World" {
 		t.Log("FAILED TO GET CORRECT STRING")
@@ -202,7 +266,10 @@ func TestEncryptPayload(t *testing.T) {
 
 	myBytes := []byte("ekrjhgekrjhgejrghserjghserjkhgserhjgsjhrvidshbewkjfhgjhsgslekjkuesrjhgsekrjdghdkjfghdfkjghsdkjhgsdjrghsdfghj,dfjkhbdfjsbh,jdhfbh,jdfhsbgdf,sjhbkfdhbjldsfgjdhsfgvsjdhbserhldrshvliaeuhluiaerhliauewglieruaghlueirhglaieruhgiluasdfhglkdfjsghlaekfhalkjsdfharlukdghasj,dhfgajshdfgajhdsgfdjs,fgjah,dfgaksjdhfjksdfghjsdfhbadlrubhdaruhadkrhdjrs,f,jadrfb,jarfg,hjagfj,harfgajh,sfgahsjdfgasjdhfgasjdfasdjhfgasjdhfgasjhd,fgas,jhdsjadhfgasdjh,gvurjh")
 
-	encryptedPayload := TorClient.EncryptPayload(myBytes, t1Key.PublicKey)
+	encryptedPayload, err := TorClient.EncryptPayload(myBytes, t1Key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	fmt.Println(encryptedPayload)
 }
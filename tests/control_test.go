@@ -0,0 +1,182 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"../client/TorClient"
+	"../tn/tornode"
+	"../utils"
+)
+
+// a controller's connection to the control port
+type controller struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+	events []string // read while waiting for a reply
+}
+
+func dialControl(t *testing.T, addr string) *controller {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return &controller{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (c *controller) line() string {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+// sends command and returns the lines of its reply, keeping events for waitEvent
+func (c *controller) send(command string) []string {
+	if _, err := c.conn.Write([]byte(command + "\r\n")); err != nil {
+		c.t.Fatal(err)
+	}
+	var lines []string
+	for {
+		line := c.line()
+		if strings.HasPrefix(line, "650 ") {
+			c.events = append(c.events, line)
+			continue
+		}
+		lines = append(lines, line)
+		if len(line) >= 4 && line[3] == ' ' && (len(lines) == 1 || !strings.HasPrefix(lines[0], "250+") || lines[len(lines)-2] == ".") {
+			return lines
+		}
+	}
+}
+
+// reads events until one with state for the circuit, or for any circuit when id is
+// empty, returns its fields after 650 CIRC
+func (c *controller) waitEvent(id string, state TorClient.CircuitState) []string {
+	for {
+		var line string
+		if len(c.events) > 0 {
+			line, c.events = c.events[0], c.events[1:]
+		} else {
+			line = c.line()
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "650 CIRC "))
+		if len(fields) > 1 && (id == "" || fields[0] == id) && fields[1] == string(state) {
+			return fields
+		}
+	}
+}
+
+// asks for circuit-status until it lists a built circuit for purpose, returns its fields.
+// The circuit may have been built before events were asked for.
+func (c *controller) waitBuilt(purpose string) []string {
+	for {
+		status := c.send("GETINFO circuit-status")
+		if len(status) < 3 || status[0] != "250+circuit-status=" {
+			c.t.Fatalf("circuit-status actual: %v", status)
+		}
+		for _, line := range status[1 : len(status)-2] {
+			fields := strings.Fields(line)
+			if len(fields) > 3 && fields[1] == string(TorClient.CircuitBuilt) && fields[3] == "PURPOSE="+purpose {
+				return fields
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestControlPortListsAndClosesCircuits(t *testing.T) {
+	relays := []*tornode.TorNode{}
+	for i := 0; i < 3; i++ {
+		relay := startBridgeNode(t, context.Background())
+		defer relay.Stop()
+		relays = append(relays, relay)
+	}
+	cookieFile := filepath.Join(t.TempDir(), "control.cookie")
+	config := clientConfigFor(t, relays...)
+	config.MaxNumNodes = 2
+	config.CircuitPool = utils.CircuitPoolConfig{Enabled: true, MaxCircuits: 1}
+	config.ControlPort = utils.ControlPortConfig{Password: "secret", CookieFile: cookieFile}
+	client, err := TorClient.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go client.ServeControl(listener)
+
+	// nothing but the ways to authenticate before authenticating
+	anonymous := dialControl(t, listener.Addr().String())
+	if reply := anonymous.send("PROTOCOLINFO"); len(reply) != 3 || !strings.Contains(reply[1], "PASSWORD") || !strings.Contains(reply[1], "COOKIE") {
+		t.Errorf("PROTOCOLINFO reply actual: %v", reply)
+	}
+	if reply := anonymous.send("GETINFO circuit-status"); reply[0] != "514 Authentication required" {
+		t.Errorf("Reply before authenticating actual: %v", reply)
+	}
+	if reply := dialControl(t, listener.Addr().String()).send(`AUTHENTICATE "wrong"`); reply[0] != "515 Authentication failed" {
+		t.Errorf("Reply to a wrong password actual: %v", reply)
+	}
+	cookie, err := ioutil.ReadFile(cookieFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply := dialControl(t, listener.Addr().String()).send("AUTHENTICATE " + hex.EncodeToString(cookie)); reply[0] != "250 OK" {
+		t.Errorf("Reply to the cookie actual: %v", reply)
+	}
+
+	control := dialControl(t, listener.Addr().String())
+	for _, command := range []string{`AUTHENTICATE "secret"`, "SETEVENTS CIRC"} {
+		if reply := control.send(command); reply[0] != "250 OK" {
+			t.Fatalf("Reply to %s actual: %v", command, reply)
+		}
+	}
+	if value, err := client.Get(context.Background(), "a"); err != nil || value != "apple" {
+		t.Fatalf("Get actual: %q, %v", value, err)
+	}
+	// the pool may have built its circuit before SETEVENTS, so no event for it
+	built := control.waitBuilt(TorClient.PurposePooled)
+	id := built[0]
+	if len(strings.Split(built[2], ",")) != 2 {
+		t.Errorf("Built circuit actual: %v, expected 2 hops", built)
+	}
+
+	if reply := control.send("CLOSECIRCUIT " + id); reply[0] != "250 OK" {
+		t.Fatalf("CLOSECIRCUIT reply actual: %v", reply)
+	}
+	control.waitEvent(id, TorClient.CircuitClosed)
+	for _, info := range client.Circuits() {
+		if strconv.FormatUint(info.ID, 10) == id {
+			t.Errorf("Circuits after closing circuit %s actual: %v", id, client.Circuits())
+		}
+	}
+	if reply := control.send("CLOSECIRCUIT " + id); !strings.HasPrefix(reply[0], "552 ") {
+		t.Errorf("Reply to closing a closed circuit actual: %v", reply)
+	}
+	if reply := control.send("SIGNAL NEWNYM"); reply[0] != "250 OK" {
+		t.Errorf("NEWNYM reply actual: %v", reply)
+	}
+	// the pool builds another circuit for the next request, after SETEVENTS
+	if _, err := client.Get(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+	rebuilt := control.waitEvent("", TorClient.CircuitBuilt)
+	if rebuilt[0] == id || len(rebuilt) < 4 || rebuilt[3] != "PURPOSE="+TorClient.PurposePooled {
+		t.Errorf("Built event after NEWNYM actual: %v", rebuilt)
+	}
+}
@@ -0,0 +1,93 @@
+package tests
+
+import (
+	"context"
+	"crypto/rsa"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"../cover"
+	"../keyLibrary"
+	"../tn/tornode"
+	"../utils"
+	"github.com/DistributedClocks/GoVector/govec"
+)
+
+func TestRelaysDropCoverOnionsAndPad(t *testing.T) {
+	relays := []*tornode.TorNode{}
+	for i := 0; i < 2; i++ {
+		relay := startBridgeNode(t, context.Background())
+		defer relay.Stop()
+		relays = append(relays, relay)
+	}
+	// there is no DS, cover circuits come from what the directory already knows
+	directory := func() (map[string]rsa.PublicKey, error) {
+		return dnMapOf(relays), nil
+	}
+	config := utils.CoverTrafficConfig{Enabled: true, MeanIntervalMillis: 20, PathLength: 2, PayloadBytes: 256}
+	vecLogger := govec.InitGoVector("cover-test", "cover-test", govec.GetDefaultConfig())
+	traffic := cover.Start(config, utils.LinkConfig{}, directory, "", log.New(os.Stdout, "cover-test: ", 0), vecLogger)
+	if traffic == nil {
+		t.Fatal("Cover traffic should start when enabled")
+	}
+
+	var sent, received uint64
+	for start := time.Now(); sent < 3 && time.Since(start) < 5*time.Second; {
+		time.Sleep(20 * time.Millisecond)
+		sent, _, received = traffic.Stats()
+	}
+	traffic.Stop()
+	if sent < 3 || received == 0 {
+		t.Fatalf("Cover onions actual: %d sent, %d bytes of padding back, expected 3 answered", sent, received)
+	}
+
+	// every relay dropped its self-test onion, and the last relay of each circuit ours
+	dropped := uint64(0)
+	for _, relay := range relays {
+		dropped += relay.Metrics().CoverOnionsDropped - 1
+	}
+	if dropped < sent {
+		t.Errorf("Cover onions dropped actual: %d, expected at least the %d answered", dropped, sent)
+	}
+}
+
+func TestCoverResponsesVaryInSize(t *testing.T) {
+	relay := startBridgeNode(t, context.Background())
+	defer relay.Stop()
+	tnMap := dnMapOf([]*tornode.TorNode{relay})
+	vecLogger := govec.InitGoVector("cover-test", "cover-test", govec.GetDefaultConfig())
+
+	// a fixed padding size would tell cover answers apart from data server answers
+	sizes := map[int]bool{}
+	for i := 0; i < 10; i++ {
+		onion, _, err := cover.CreateOnion([]string{relay.ListenIPPort}, tnMap, 256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := utils.LinkConfig{}.Dial(relay.ListenIPPort, keyLibrary.KeyFingerprint(&relay.PrivateKey.PublicKey), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := utils.WriteData(conn, onion, vecLogger, "Sending cover onion"); err != nil {
+			t.Fatal(err)
+		}
+		received := 0
+		for {
+			cell, err := utils.ReadCell(conn, vecLogger, "Received cover onion response")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cell.Command != utils.CellData {
+				break
+			}
+			received += len(cell.Payload)
+		}
+		conn.Close()
+		sizes[received] = true
+	}
+	if len(sizes) < 2 {
+		t.Errorf("Cover response sizes actual: %v, expected them to vary", sizes)
+	}
+}
@@ -0,0 +1,169 @@
+package tests
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"../client/TorClient"
+	"../keyLibrary"
+	"../utils"
+	"github.com/DistributedClocks/GoVector/govec"
+)
+
+func TestHopDeadlinesStagger(t *testing.T) {
+	deadline := time.Now().Add(time.Second)
+	for hop := 0; hop < 3; hop++ {
+		giveUp := utils.GiveUpAt(utils.HopDeadline(deadline, hop))
+		next := time.Unix(0, utils.HopDeadline(deadline, hop+1))
+		if giveUp.Before(next) {
+			t.Errorf("Hop %d gives up at %v, before hop %d's deadline %v", hop, giveUp, hop+1, next)
+		}
+		if !giveUp.Before(deadline) {
+			t.Errorf("Hop %d gives up at %v, not before the client deadline %v", hop, giveUp, deadline)
+		}
+	}
+	if utils.HopDeadline(time.Time{}, 1) != 0 || !utils.GiveUpAt(0).IsZero() {
+		t.Errorf("No deadline should stay no deadline")
+	}
+}
+
+// acts as a T1 that takes the onion and never answers
+func serveSilent(t *testing.T, vecLogger *govec.GoLog) (string, map[string]rsa.PublicKey) {
+	key, err := keyLibrary.GeneratePrivPubKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := keyLibrary.ServerTLSConfig(key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		utils.ReadCell(conn, vecLogger, "Received onion")
+		time.Sleep(2 * time.Second)
+	}()
+	addr := listener.Addr().String()
+	return addr, map[string]rsa.PublicKey{addr: key.PublicKey}
+}
+
+func TestClientGivesUpAtDeadline(t *testing.T) {
+	vecLogger := govec.InitGoVector("deadline-test", "deadline-test", govec.GetDefaultConfig())
+	symmKeys := [][]byte{keyLibrary.GenerateSymmKey(), keyLibrary.GenerateSymmKey()}
+	t1, tnMap := serveSilent(t, vecLogger)
+
+	start := time.Now()
+	_, err := TorClient.SendOnionMessage([]string{t1, "server"}, tnMap, []byte("onion"), symmKeys, utils.LinkConfig{}, utils.FlowControlConfig{}, start.Add(300*time.Millisecond), vecLogger)
+	if !errors.Is(err, TorClient.ErrDeadlineExceeded) {
+		t.Fatalf("Error actual: %v, expected ErrDeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Client gave up after %v, expected about 300ms", elapsed)
+	}
+}
+
+// a DS that reads requests and never answers them, returns its address and key path
+func serveSilentDS(t *testing.T) (string, string) {
+	dsKey, err := keyLibrary.GeneratePrivPubKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsKeyPath := filepath.Join(t.TempDir(), "ds.pem")
+	if err := keyLibrary.SavePublicKeyOnDisk(dsKeyPath, &dsKey.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := keyLibrary.ServerTLSConfig(dsKey, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	vecLogger := govec.InitGoVector("deadline-test", "deadline-test", govec.GetDefaultConfig())
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			go utils.TCPRead(conn, vecLogger, "Received request")
+		}
+	}()
+	return listener.Addr().String(), dsKeyPath
+}
+
+func TestClientGivesUpOnSilentDS(t *testing.T) {
+	dsAddr, dsKeyPath := serveSilentDS(t)
+	client, err := TorClient.NewClient(clientConfigWith(t, dsAddr, dsKeyPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Get(ctx, "a")
+		done <- err
+	}()
+
+	// the client isn't locked up while the DS is asked
+	time.Sleep(100 * time.Millisecond)
+	circuitDone := make(chan struct{})
+	go func() {
+		client.Circuit()
+		close(circuitDone)
+	}()
+	select {
+	case <-circuitDone:
+	case <-time.After(100 * time.Millisecond):
+		t.Error("Circuit blocked while the DS was asked for relays")
+	}
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Get without an answer from the DS succeeded")
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Client gave up after %v, expected about 300ms", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Get still waiting on the DS after 5s")
+	}
+}
+
+func TestClientClosesWhilePoolWaitsOnDS(t *testing.T) {
+	dsAddr, dsKeyPath := serveSilentDS(t)
+	config := clientConfigWith(t, dsAddr, dsKeyPath)
+	config.CircuitPool = utils.CircuitPoolConfig{Enabled: true, MaxCircuits: 1}
+	client, err := TorClient.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the pool starts building right away and waits on the DS
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	client.Close()
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("Close actual: %s, expected it to cancel the build in progress", took)
+	}
+}
@@ -0,0 +1,107 @@
+package tests
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"errors"
+	"testing"
+	"time"
+
+	"../client/TorClient"
+	"../keyLibrary"
+	"../utils"
+	"github.com/DistributedClocks/GoVector/govec"
+)
+
+// wrap one layer the way a relay does on the way back
+func wrapLayer(t *testing.T, payload []byte, symmKey []byte) []byte {
+	raw, err := utils.Marshall(utils.Onion{Payload: payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := keyLibrary.SymmKeyEncrypt(raw, symmKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wrapped
+}
+
+// acts as T1: reads the onion and answers with the given destroy cell, returns its
+// address and key
+func serveDestroy(t *testing.T, destroy utils.Cell, vecLogger *govec.GoLog) (string, map[string]rsa.PublicKey) {
+	addr, tnMap, _ := serveCellAndRead(t, destroy, false, vecLogger)
+	return addr, tnMap
+}
+
+// like serveDestroy for any cell, passing on the cell the client answers with when read
+// is set
+func serveCellAndRead(t *testing.T, cell utils.Cell, read bool, vecLogger *govec.GoLog) (string, map[string]rsa.PublicKey, <-chan *utils.Cell) {
+	answers := make(chan *utils.Cell, 1)
+	key, err := keyLibrary.GeneratePrivPubKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := keyLibrary.ServerTLSConfig(key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		utils.ReadCell(conn, vecLogger, "Received onion")
+		utils.WriteCell(conn, cell, vecLogger, "Cell sent")
+		if read {
+			answer, _ := utils.ReadCell(conn, vecLogger, "Received answer")
+			answers <- answer
+		}
+	}()
+	addr := listener.Addr().String()
+	return addr, map[string]rsa.PublicKey{addr: key.PublicKey}, answers
+}
+
+func TestDestroyNamesFailedHop(t *testing.T) {
+	vecLogger := govec.InitGoVector("destroy-test", "destroy-test", govec.GetDefaultConfig())
+	symmKeys := [][]byte{keyLibrary.GenerateSymmKey(), keyLibrary.GenerateSymmKey(), keyLibrary.GenerateSymmKey()}
+
+	// T2 could not dial the data server, T1 wraps its report
+	info, _ := utils.Marshall(utils.DestroyInfo{Reason: utils.ReasonUnreachable, NextHop: true})
+	payload := wrapLayer(t, wrapLayer(t, info, symmKeys[1]), symmKeys[0])
+	t1, tnMap := serveDestroy(t, utils.Cell{Command: utils.CellDestroy, Reason: utils.ReasonUnreachable, Payload: payload}, vecLogger)
+
+	nodeOrder := []string{t1, "t2", "server"}
+	_, err := TorClient.SendOnionMessage(nodeOrder, tnMap, []byte("onion"), symmKeys, utils.LinkConfig{}, utils.FlowControlConfig{}, time.Time{}, vecLogger)
+
+	var hopErr *TorClient.HopError
+	if !errors.As(err, &hopErr) {
+		t.Fatalf("Error actual: %v, expected a HopError", err)
+	}
+	if hopErr.Hop != 2 || hopErr.Addr != "server" || hopErr.Reason != utils.ReasonUnreachable {
+		t.Errorf("HopError actual: %+v, expected hop 2 (server): %s", hopErr, utils.ReasonUnreachable)
+	}
+}
+
+func TestDestroyFromFirstHop(t *testing.T) {
+	vecLogger := govec.InitGoVector("destroy-test", "destroy-test", govec.GetDefaultConfig())
+	symmKeys := [][]byte{keyLibrary.GenerateSymmKey(), keyLibrary.GenerateSymmKey()}
+
+	// T1 rejects the circuit before it has a key
+	t1, tnMap := serveDestroy(t, utils.Cell{Command: utils.CellDestroy, Reason: utils.ReasonOverloaded}, vecLogger)
+
+	_, err := TorClient.SendOnionMessage([]string{t1, "server"}, tnMap, []byte("onion"), symmKeys, utils.LinkConfig{}, utils.FlowControlConfig{}, time.Time{}, vecLogger)
+
+	var hopErr *TorClient.HopError
+	if !errors.As(err, &hopErr) || hopErr.Hop != 0 || hopErr.Addr != t1 {
+		t.Fatalf("Error actual: %v, expected a HopError at hop 0", err)
+	}
+	if !errors.Is(err, TorClient.ErrRelayOverloaded) {
+		t.Errorf("An overloaded hop should match ErrRelayOverloaded")
+	}
+}
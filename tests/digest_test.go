@@ -0,0 +1,59 @@
+package tests
+
+import (
+	"testing"
+
+	"../keyLibrary"
+	"../utils"
+)
+
+func TestLayerDigestDetectsTampering(t *testing.T) {
+	onion := utils.Onion{NextIpPort: "127.0.0.1:4001", SymmKey: keyLibrary.GenerateSymmKey(), Payload: []byte("next layer")}
+	onion.Digest = utils.LayerDigest(onion)
+
+	if !utils.VerifyLayerDigest(onion) {
+		t.Fatalf("Untouched layer should verify")
+	}
+
+	tampered := onion
+	tampered.Payload = []byte("next layeR")
+	if utils.VerifyLayerDigest(tampered) {
+		t.Errorf("Layer with a modified payload should not verify")
+	}
+
+	redirected := onion
+	redirected.NextIpPort = "127.0.0.1:6666"
+	if utils.VerifyLayerDigest(redirected) {
+		t.Errorf("Layer with a modified next hop should not verify")
+	}
+}
+
+func TestRunningDigestDetectsReorder(t *testing.T) {
+	key := keyLibrary.GenerateSymmKey()
+	frames := [][]byte{[]byte("frame 1"), []byte("frame 2"), []byte("frame 3")}
+
+	sender := utils.NewRunningDigest(key)
+	digests := make([][]byte, len(frames))
+	for i, frame := range frames {
+		digests[i] = sender.Add(frame)
+	}
+
+	inOrder := utils.NewRunningDigest(key)
+	for i, frame := range frames {
+		if !inOrder.Verify(frame, digests[i]) {
+			t.Fatalf("Frame %d received in order should verify", i)
+		}
+	}
+
+	// the receiver gets frame 2 first, along with its digest
+	swapped := utils.NewRunningDigest(key)
+	if swapped.Verify(frames[1], digests[1]) {
+		t.Errorf("Reordered frame should not verify")
+	}
+
+	dropped := utils.NewRunningDigest(key)
+	dropped.Verify(frames[0], digests[0])
+	if dropped.Verify(frames[2], digests[2]) {
+		t.Errorf("Frame after a dropped one should not verify")
+	}
+}
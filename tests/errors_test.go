@@ -0,0 +1,106 @@
+package tests
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"../client/TorClient"
+	"../keyLibrary"
+	"../utils"
+	"github.com/DistributedClocks/GoVector/govec"
+)
+
+func TestDSUnreachable(t *testing.T) {
+	vecLogger := govec.InitGoVector("errors-test", "errors-test", govec.GetDefaultConfig())
+	dsKey, _ := keyLibrary.GeneratePrivPubKey()
+
+	// nothing listens on a port we just let go of
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	_, err = TorClient.ContactDsSerer(addr, 3, dsKey.PublicKey, vecLogger)
+	if !errors.Is(err, TorClient.ErrDSUnreachable) {
+		t.Errorf("Error actual: %v, expected ErrDSUnreachable", err)
+	}
+}
+
+func TestBadDSResponse(t *testing.T) {
+	vecLogger := govec.InitGoVector("errors-test", "errors-test", govec.GetDefaultConfig())
+	dsKey, _ := keyLibrary.GeneratePrivPubKey()
+	tlsConfig, err := keyLibrary.ServerTLSConfig(dsKey, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		utils.TCPRead(conn, vecLogger, "Received request")
+		utils.TCPWrite(conn, []byte("not encrypted with the request key"), vecLogger, "Garbage sent")
+	}()
+
+	_, err = TorClient.ContactDsSerer(listener.Addr().String(), 3, dsKey.PublicKey, vecLogger)
+	if !errors.Is(err, TorClient.ErrBadDSResponse) {
+		t.Errorf("Error actual: %v, expected ErrBadDSResponse", err)
+	}
+}
+
+func TestDecryptServerResponseWrongKey(t *testing.T) {
+	symmKeys := [][]byte{keyLibrary.GenerateSymmKey(), keyLibrary.GenerateSymmKey()}
+	response, _ := keyLibrary.SymmKeyEncrypt([]byte("response"), keyLibrary.GenerateSymmKey())
+
+	_, err := TorClient.DecryptServerResponse(response, symmKeys)
+	if !errors.Is(err, TorClient.ErrDecryptFailed) {
+		t.Errorf("Error actual: %v, expected ErrDecryptFailed", err)
+	}
+}
+
+func TestStreamedFrameThatDoesNotDecrypt(t *testing.T) {
+	vecLogger := govec.InitGoVector("errors-test", "errors-test", govec.GetDefaultConfig())
+	symmKeys := [][]byte{keyLibrary.GenerateSymmKey(), keyLibrary.GenerateSymmKey()}
+	garbage, _ := keyLibrary.SymmKeyEncrypt([]byte("frame"), keyLibrary.GenerateSymmKey())
+	t1, tnMap, answers := serveCellAndRead(t, utils.Cell{Command: utils.CellData, StreamID: utils.DEFAULT_STREAM_ID, Payload: garbage}, true, vecLogger)
+
+	_, err := TorClient.SendOnionMessage([]string{t1, "server"}, tnMap, []byte("onion"), symmKeys, utils.LinkConfig{}, utils.FlowControlConfig{}, time.Time{}, vecLogger)
+	var hopErr *TorClient.HopError
+	if !errors.As(err, &hopErr) || hopErr.Hop != 0 || hopErr.Reason != utils.ReasonDecryptFailed {
+		t.Fatalf("Error actual: %v, expected the layer of hop 0 not to decrypt", err)
+	}
+	// the client tears the circuit down for the same reason
+	if destroy := <-answers; destroy == nil || destroy.Command != utils.CellDestroy || destroy.Reason != utils.ReasonDecryptFailed {
+		t.Errorf("Cell from the client actual: %+v, expected a destroy for ReasonDecryptFailed", destroy)
+	}
+	if !errors.Is(err, TorClient.ErrDecryptFailed) {
+		t.Errorf("A frame that does not decrypt should match ErrDecryptFailed")
+	}
+
+	// a hop that could not decrypt its layer of the onion
+	err = &TorClient.HopError{Hop: 1, Addr: "server", Reason: utils.ReasonDecryptFailed}
+	if !errors.Is(err, TorClient.ErrDecryptFailed) {
+		t.Errorf("A hop that could not decrypt should match ErrDecryptFailed")
+	}
+}
+
+func TestHopTimeoutIsDeadlineExceeded(t *testing.T) {
+	var err error = &TorClient.HopError{Hop: 1, Addr: "t2", Reason: utils.ReasonTimeout}
+	if !errors.Is(err, TorClient.ErrDeadlineExceeded) {
+		t.Errorf("A hop that timed out should match ErrDeadlineExceeded")
+	}
+	if errors.Is(err, TorClient.ErrRelayOverloaded) {
+		t.Errorf("A hop that timed out should not match ErrRelayOverloaded")
+	}
+}
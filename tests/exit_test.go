@@ -0,0 +1,111 @@
+package tests
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"../client/TorClient"
+	"../utils"
+	"github.com/DistributedClocks/GoVector/govec"
+)
+
+// a TCP server that answers each connection with what it read, once the other side is done writing
+func serveEcho(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, _ := ioutil.ReadAll(conn)
+				conn.Write(append([]byte("echo: "), data...))
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestDialThroughExit(t *testing.T) {
+	middle := startBridgeNode(t, context.Background())
+	defer middle.Stop()
+	exit := startBridgeNodeWith(t, context.Background(), utils.TorNodeConfig{Exit: true, ExitAllowPrivate: true})
+	defer exit.Stop()
+	target := serveEcho(t)
+
+	vecLogger := govec.InitGoVector("exit-test", "exit-test", govec.GetDefaultConfig())
+	tnMap := map[string]rsa.PublicKey{
+		middle.ListenIPPort: middle.PrivateKey.PublicKey,
+		exit.ListenIPPort:   exit.PrivateKey.PublicKey,
+	}
+	conn, err := TorClient.DialExit([]string{middle.ListenIPPort, exit.ListenIPPort}, tnMap, target, utils.LinkConfig{}, utils.FlowControlConfig{}, vecLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// more than one frame each way
+	sent := make([]byte, 10000)
+	for i := range sent {
+		sent[i] = byte('a' + i%26)
+	}
+	if _, err := conn.Write(sent); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	received, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "echo: " + string(sent); string(received) != expected {
+		t.Errorf("Received %d bytes, expected %d bytes of echo", len(received), len(expected))
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read after the end actual: %v, expected EOF", err)
+	}
+}
+
+func TestNonExitRefusesToDial(t *testing.T) {
+	relay := startBridgeNode(t, context.Background())
+	defer relay.Stop()
+	target := serveEcho(t)
+
+	vecLogger := govec.InitGoVector("exit-test", "exit-test", govec.GetDefaultConfig())
+	tnMap := map[string]rsa.PublicKey{relay.ListenIPPort: relay.PrivateKey.PublicKey}
+	_, err := TorClient.DialExit([]string{relay.ListenIPPort}, tnMap, target, utils.LinkConfig{}, utils.FlowControlConfig{}, vecLogger)
+	var hopErr *TorClient.HopError
+	if !errors.As(err, &hopErr) || hopErr.Reason != utils.ReasonRefused {
+		t.Fatalf("Error actual: %v, expected a refused HopError", err)
+	}
+}
+
+func TestExitRefusesPrivateAddresses(t *testing.T) {
+	exit := startBridgeNodeWith(t, context.Background(), utils.TorNodeConfig{Exit: true})
+	defer exit.Stop()
+	target := serveEcho(t)
+	_, port, _ := net.SplitHostPort(target)
+
+	vecLogger := govec.InitGoVector("exit-test", "exit-test", govec.GetDefaultConfig())
+	tnMap := map[string]rsa.PublicKey{exit.ListenIPPort: exit.PrivateKey.PublicKey}
+	// a host name is checked by the IP it resolves to
+	for _, addr := range []string{target, net.JoinHostPort("localhost", port), net.JoinHostPort("0.0.0.0", port)} {
+		_, err := TorClient.DialExit([]string{exit.ListenIPPort}, tnMap, addr, utils.LinkConfig{}, utils.FlowControlConfig{}, vecLogger)
+		var hopErr *TorClient.HopError
+		if !errors.As(err, &hopErr) || hopErr.Reason != utils.ReasonRefused {
+			t.Errorf("Dialing %s error actual: %v, expected a refused HopError", addr, err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"../utils"
+)
+
+func TestSendWindowStallsUntilSendme(t *testing.T) {
+	window := utils.NewSendWindow(utils.FlowControlConfig{CircuitWindow: 4, StreamWindow: 2, SendmeIncrement: 2})
+
+	for i := 0; i < 2; i++ {
+		stalled, err := window.Acquire(1)
+		if err != nil || stalled != 0 {
+			t.Fatalf("Cell %d should fit in the stream window, stalled: %s, err: %s", i, stalled, err)
+		}
+	}
+
+	acquired := make(chan time.Duration)
+	go func() {
+		stalled, _ := window.Acquire(1)
+		acquired <- stalled
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatalf("Sender should stall once the stream window is used up")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	window.Ack(1)
+	select {
+	case stalled := <-acquired:
+		if stalled < 50*time.Millisecond {
+			t.Errorf("Stall time actual: %s, expected at least 50ms", stalled)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Sendme should resume the sender")
+	}
+
+	// another stream still has its own window, but the circuit window has one cell left
+	if _, err := window.Acquire(2); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		window.Acquire(2)
+		acquired <- 0
+	}()
+	select {
+	case <-acquired:
+		t.Fatalf("Sender should stall once the circuit window is used up")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	window.Close()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatalf("Close should wake up a stalled sender")
+	}
+}
+
+func TestReceiveWindowSendmes(t *testing.T) {
+	window := utils.NewReceiveWindow(utils.FlowControlConfig{CircuitWindow: 10, StreamWindow: 10, SendmeIncrement: 3})
+
+	sendmes := make([]uint16, 0)
+	for i := 0; i < 6; i++ {
+		sendmes = append(sendmes, window.Delivered(1)...)
+	}
+
+	expected := []uint16{0, 1, 0, 1}
+	if len(sendmes) != len(expected) {
+		t.Fatalf("Sendmes actual: %v, expected: %v", sendmes, expected)
+	}
+	for i := range expected {
+		if sendmes[i] != expected[i] {
+			t.Errorf("Sendmes actual: %v, expected: %v", sendmes, expected)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package tests
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"../client/TorClient"
+	"../keyLibrary"
+	"../tn/tornode"
+	"../utils"
+	"github.com/DistributedClocks/GoVector/govec"
+)
+
+// a DS that lists relays to every client, returns its address and the path of its key
+func serveDirectory(t *testing.T, relays ...*tornode.TorNode) (string, string) {
+	return serveDnMap(t, dnMapOf(relays))
+}
+
+func dnMapOf(relays []*tornode.TorNode) map[string]rsa.PublicKey {
+	dnMap := map[string]rsa.PublicKey{}
+	for _, relay := range relays {
+		dnMap[relay.ListenIPPort] = relay.PrivateKey.PublicKey
+	}
+	return dnMap
+}
+
+// like serveDirectory, for relays that may not be tor nodes
+func serveDnMap(t *testing.T, dnMap map[string]rsa.PublicKey) (string, string) {
+	return serveDirectoryWith(t, func(utils.DsRequest) map[string]rsa.PublicKey { return dnMap })
+}
+
+// a DS that lists the relays answer picks for each request
+func serveDirectoryWith(t *testing.T, answer func(utils.DsRequest) map[string]rsa.PublicKey) (string, string) {
+	vecLogger := govec.InitGoVector("guards-test", "guards-test", govec.GetDefaultConfig())
+	dsKey, err := keyLibrary.GeneratePrivPubKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsKeyPath := filepath.Join(t.TempDir(), "ds.pem")
+	if err := keyLibrary.SavePublicKeyOnDisk(dsKeyPath, &dsKey.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := keyLibrary.ServerTLSConfig(dsKey, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			reqBytes, err := utils.TCPRead(conn, vecLogger, "Received request")
+			var req utils.DsRequest
+			if err == nil {
+				var decrypted []byte
+				if decrypted, err = keyLibrary.PrivKeyDecrypt(dsKey, reqBytes); err == nil {
+					err = utils.UnMarshall(decrypted, &req)
+				}
+			}
+			if err == nil {
+				respBytes, _ := utils.Marshall(&utils.DsResponse{DnMap: answer(req)})
+				encrypted, _ := keyLibrary.SymmKeyEncryptBase64(respBytes, req.SymmKey)
+				utils.TCPWrite(conn, encrypted, vecLogger, "Directory sent")
+			}
+			conn.Close()
+		}
+	}()
+
+	return listener.Addr().String(), dsKeyPath
+}
+
+// a client config for a network of relays, with a data server that holds "a"
+func clientConfigFor(t *testing.T, relays ...*tornode.TorNode) utils.ClientConfig {
+	return clientConfigOf(t, dnMapOf(relays))
+}
+
+func clientConfigOf(t *testing.T, dnMap map[string]rsa.PublicKey) utils.ClientConfig {
+	dsAddr, dsKeyPath := serveDnMap(t, dnMap)
+	return clientConfigWith(t, dsAddr, dsKeyPath)
+}
+
+func clientConfigWith(t *testing.T, dsAddr string, dsKeyPath string) utils.ClientConfig {
+	server, serverKey := startDataServer(t, map[string]string{"a": "apple"})
+	serverKeyPath := filepath.Join(t.TempDir(), "server.pem")
+	if err := keyLibrary.SavePublicKeyOnDisk(serverKeyPath, &serverKey); err != nil {
+		t.Fatal(err)
+	}
+	return utils.ClientConfig{
+		ID:                  "client-test",
+		DSPublicKeyPath:     dsKeyPath,
+		ServerPublicKeyPath: serverKeyPath,
+		DSIPPort:            dsAddr,
+		ServerIPPort:        server,
+	}
+}
+
+type savedGuard struct {
+	Addr             string
+	UnreachableSince time.Time
+}
+
+func readGuards(t *testing.T, path string) []savedGuard {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var guards []savedGuard
+	if err := json.Unmarshal(raw, &guards); err != nil {
+		t.Fatal(err)
+	}
+	return guards
+}
+
+func TestGuardsOutliveClientAndReplaceUnreachable(t *testing.T) {
+	relays := map[string]*tornode.TorNode{}
+	for i := 0; i < 3; i++ {
+		relay := startBridgeNode(t, context.Background())
+		defer relay.Stop()
+		relays[relay.ListenIPPort] = relay
+	}
+	all := make([]*tornode.TorNode, 0, len(relays))
+	for _, relay := range relays {
+		all = append(all, relay)
+	}
+	stateFile := filepath.Join(t.TempDir(), "client.guards.json")
+	config := clientConfigFor(t, all...)
+	config.MaxNumNodes = 2
+	config.Guards = utils.GuardConfig{StateFile: stateFile, NumGuards: 1}
+	get := func() error {
+		client, err := TorClient.NewClient(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		value, err := client.Get(context.Background(), "a")
+		if err == nil && value != "apple" {
+			t.Errorf("Value actual: %q, expected apple", value)
+		}
+		return err
+	}
+
+	if err := get(); err != nil {
+		t.Fatal(err)
+	}
+	guards := readGuards(t, stateFile)
+	if len(guards) != 1 {
+		t.Fatalf("Guards actual: %v, expected one", guards)
+	}
+	// a new client enters through the same guard
+	if err := get(); err != nil {
+		t.Fatal(err)
+	}
+	if again := readGuards(t, stateFile); len(again) != 1 || again[0].Addr != guards[0].Addr {
+		t.Fatalf("Guards after another run actual: %v, expected %v", again, guards)
+	}
+
+	// the request goes around the guard, which waits to be tried again while a new one
+	// takes over
+	relays[guards[0].Addr].Stop()
+	if err := get(); err != nil {
+		t.Fatal(err)
+	}
+	replaced := readGuards(t, stateFile)
+	if len(replaced) != 2 || replaced[0].Addr != guards[0].Addr || replaced[0].UnreachableSince.IsZero() || !replaced[1].UnreachableSince.IsZero() {
+		t.Errorf("Guards after the first went down actual: %v, expected it marked unreachable and a second one", replaced)
+	}
+}
+
+func TestGuardsFoundInLargerDirectorySample(t *testing.T) {
+	guard := startBridgeNode(t, context.Background())
+	defer guard.Stop()
+	stateFile := filepath.Join(t.TempDir(), "client.guards.json")
+	config := clientConfigFor(t, guard)
+	config.MaxNumNodes = 1
+	config.Guards = utils.GuardConfig{StateFile: stateFile, NumGuards: 1}
+	get := func() {
+		client, err := TorClient.NewClient(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		if value, err := client.Get(context.Background(), "a"); err != nil || value != "apple" {
+			t.Fatalf("Value actual: %q, %v, expected apple", value, err)
+		}
+	}
+	get()
+
+	// the guard joins a larger network, where it sorts after every other relay and only
+	// shows up in samples of all of them
+	dnMap := map[string]rsa.PublicKey{guard.ListenIPPort: guard.PrivateKey.PublicKey}
+	for i := 0; i < 40; i++ {
+		dnMap[fmt.Sprintf("10.0.%d.1:4001", i)] = guard.PrivateKey.PublicKey
+	}
+	addrs := make([]string, 0, len(dnMap))
+	for addr := range dnMap {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	var mu sync.Mutex
+	asked := []uint16{}
+	dsAddr, dsKeyPath := serveDirectoryWith(t, func(req utils.DsRequest) map[string]rsa.PublicKey {
+		mu.Lock()
+		asked = append(asked, req.NumNodes)
+		mu.Unlock()
+		sample := map[string]rsa.PublicKey{}
+		for i := 0; i < int(req.NumNodes) && i < len(addrs); i++ {
+			sample[addrs[i]] = dnMap[addrs[i]]
+		}
+		return sample
+	})
+	config.DSIPPort, config.DSPublicKeyPath = dsAddr, dsKeyPath
+	get()
+
+	if guards := readGuards(t, stateFile); len(guards) != 1 || guards[0].Addr != guard.ListenIPPort {
+		t.Errorf("Guards actual: %v, expected %s kept", guards, guard.ListenIPPort)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(asked) < 2 || int(asked[len(asked)-1]) <= len(dnMap)-1 {
+		t.Errorf("Relays asked for actual: %v, expected larger samples until the guard is in one", asked)
+	}
+}
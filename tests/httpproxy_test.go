@@ -0,0 +1,112 @@
+package tests
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"../client/TorClient"
+	"../utils"
+)
+
+// an HTTP proxy through dial, counting the streams it opens
+func serveHTTPProxy(t *testing.T, dial TorClient.DialFunc, dials *int32) *url.URL {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go TorClient.ServeHTTPProxy(listener, func(ctx context.Context, addr string) (net.Conn, error) {
+		atomic.AddInt32(dials, 1)
+		return dial(ctx, addr)
+	})
+	return &url.URL{Scheme: "http", Host: listener.Addr().String()}
+}
+
+func get(t *testing.T, client *http.Client, target string) (int, string) {
+	resp, err := client.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestHTTPProxyIsolatesDestinations(t *testing.T) {
+	exit := startBridgeNodeWith(t, context.Background(), utils.TorNodeConfig{Exit: true, ExitAllowPrivate: true})
+	defer exit.Stop()
+	first := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "first") }))
+	defer first.Close()
+	second := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "second") }))
+	defer second.Close()
+
+	var dials int32
+	proxy := serveHTTPProxy(t, dialThrough(exit), &dials)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxy)}}
+
+	for _, expected := range []string{"first", "first", "second"} {
+		target := first.URL
+		if expected == "second" {
+			target = second.URL
+		}
+		if status, body := get(t, client, target); status != http.StatusOK || body != expected {
+			t.Errorf("Response actual: %d %q, expected 200 %q", status, body, expected)
+		}
+	}
+	if dials != 2 {
+		t.Errorf("Streams opened actual: %d, expected one per destination", dials)
+	}
+}
+
+func TestHTTPProxyConnect(t *testing.T) {
+	exit := startBridgeNodeWith(t, context.Background(), utils.TorNodeConfig{Exit: true, ExitAllowPrivate: true})
+	defer exit.Stop()
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "secret") }))
+	defer target.Close()
+
+	var dials int32
+	proxy := serveHTTPProxy(t, dialThrough(exit), &dials)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxy),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	if status, body := get(t, client, target.URL); status != http.StatusOK || body != "secret" {
+		t.Errorf("Response actual: %d %q, expected 200 %q", status, body, "secret")
+	}
+}
+
+func TestHTTPProxyReportsCircuitErrors(t *testing.T) {
+	exit := startBridgeNodeWith(t, context.Background(), utils.TorNodeConfig{Exit: true, ExitAllowPrivate: true, ExitPorts: utils.ExitPorts{443}})
+	defer exit.Stop()
+	relay := startBridgeNode(t, context.Background())
+	defer relay.Stop()
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	var dials int32
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(serveHTTPProxy(t, dialThrough(exit), &dials))}}
+	if status, _ := get(t, client, target.URL); status != http.StatusForbidden {
+		t.Errorf("Status for a port the exit refuses actual: %d, expected 403", status)
+	}
+
+	// nothing listens on the address the relay is told to connect to
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+	unreachable := startBridgeNodeWith(t, context.Background(), utils.TorNodeConfig{Exit: true, ExitAllowPrivate: true})
+	defer unreachable.Stop()
+	client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(serveHTTPProxy(t, dialThrough(relay, unreachable), &dials))}}
+	if status, _ := get(t, client, closed.URL); status != http.StatusBadGateway {
+		t.Errorf("Status for an unreachable destination actual: %d, expected 502", status)
+	}
+}
@@ -0,0 +1,200 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"crypto/rsa"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"../client/TorClient"
+	"../tn/tornode"
+	"../utils"
+	"github.com/DistributedClocks/GoVector/govec"
+)
+
+// gets key from the data server through relays, returns the value
+func requestThrough(t *testing.T, relays []*tornode.TorNode, server string, serverKey rsa.PublicKey, key string) string {
+	nodeOrder := []string{}
+	tnMap := map[string]rsa.PublicKey{server: serverKey}
+	for _, relay := range relays {
+		nodeOrder = append(nodeOrder, relay.ListenIPPort)
+		tnMap[relay.ListenIPPort] = relay.PrivateKey.PublicKey
+	}
+	nodeOrder = append(nodeOrder, server)
+	onion, symmKeys, err := TorClient.CreateOnionMessage(nodeOrder, tnMap, key, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vecLogger := govec.InitGoVector("request-test", "request-test", govec.GetDefaultConfig())
+	value, err := TorClient.SendOnionMessage(nodeOrder, tnMap, onion, symmKeys, utils.LinkConfig{}, utils.FlowControlConfig{}, time.Time{}, vecLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+// an address nothing listens on yet
+func freeAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// fetches the metrics page, waiting for the endpoint to come up
+func scrapeMetrics(t *testing.T, addr string) string {
+	for i := 0; ; i++ {
+		resp, err := http.Get("http://" + addr + "/metrics")
+		if err != nil {
+			if i == 50 {
+				t.Fatal(err)
+			}
+			time.Sleep(20 * time.Millisecond)
+			continue
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+}
+
+func TestMetricsCountRelayedCircuit(t *testing.T) {
+	metricsAddr := freeAddr(t)
+	first := startBridgeNodeWith(t, context.Background(), utils.TorNodeConfig{MetricsIPPort: metricsAddr})
+	defer first.Stop()
+	second := startBridgeNode(t, context.Background())
+	defer second.Stop()
+	server, serverKey := startDataServer(t, map[string]string{"a": "apple"})
+
+	// the self-test already went through the node
+	before := first.Metrics()
+	if value := requestThrough(t, []*tornode.TorNode{first, second}, server, serverKey, "a"); value != "apple" {
+		t.Fatalf("Value actual: %q, expected apple", value)
+	}
+	var after tornode.MetricsSnapshot
+	for i := 0; i < 50; i++ {
+		if after = first.Metrics(); after.ActiveCircuits == 0 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if after.ActiveCircuits != 0 {
+		t.Errorf("Active circuits actual: %d, expected 0 once the circuit is done", after.ActiveCircuits)
+	}
+	if peeled := after.OnionsPeeled - before.OnionsPeeled; peeled != 1 {
+		t.Errorf("Onions peeled actual: %d, expected 1", peeled)
+	}
+	if after.BytesForward <= before.BytesForward || after.BytesBackward <= before.BytesBackward {
+		t.Errorf("Bytes actual: %d forward, %d backward, expected more than %d and %d", after.BytesForward, after.BytesBackward, before.BytesForward, before.BytesBackward)
+	}
+	if responses := after.NextHopLatency.Count - before.NextHopLatency.Count; responses != 1 {
+		t.Errorf("Next hop responses actual: %d, expected 1", responses)
+	}
+	if after.PeelLatency.Count != after.OnionsPeeled {
+		t.Errorf("Peel latencies actual: %d, expected one per onion peeled (%d)", after.PeelLatency.Count, after.OnionsPeeled)
+	}
+
+	page := scrapeMetrics(t, metricsAddr)
+	described := map[string]bool{}
+	typed := map[string]string{}
+	values := map[string]float64{}
+	buckets := map[string][]float64{}
+	scanner := bufio.NewScanner(strings.NewReader(page))
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if strings.HasPrefix(line, "# HELP ") {
+			described[fields[2]] = true
+			continue
+		}
+		if strings.HasPrefix(line, "# TYPE ") {
+			typed[fields[2]] = fields[3]
+			continue
+		}
+		if len(fields) != 2 {
+			t.Fatalf("Metric line actual: %q", line)
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			t.Fatalf("Metric line actual: %q, %v", line, err)
+		}
+		name := fields[0]
+		if i := strings.IndexByte(name, '{'); i >= 0 {
+			name = name[:i]
+		}
+		family := name
+		if typed[strings.TrimSuffix(name, "_bucket")] == "histogram" && strings.HasSuffix(name, "_bucket") {
+			family = strings.TrimSuffix(name, "_bucket")
+			buckets[family] = append(buckets[family], value)
+		} else if base := strings.TrimSuffix(strings.TrimSuffix(name, "_sum"), "_count"); typed[base] == "histogram" {
+			family = base
+		}
+		if !described[family] || typed[family] == "" {
+			t.Errorf("%s has no HELP and TYPE lines before it", name)
+		}
+		values[fields[0]] = value
+	}
+
+	if peeled := values["tornode_onions_peeled_total"]; peeled != float64(after.OnionsPeeled) {
+		t.Errorf("tornode_onions_peeled_total actual: %g, expected %d", peeled, after.OnionsPeeled)
+	}
+	for _, family := range []string{"tornode_peel_duration_seconds", "tornode_next_hop_response_seconds", "tornode_flow_control_stall_seconds"} {
+		counts := buckets[family]
+		if len(counts) == 0 {
+			t.Errorf("%s has no buckets", family)
+			continue
+		}
+		for i := 1; i < len(counts); i++ {
+			if counts[i] < counts[i-1] {
+				t.Errorf("%s buckets actual: %v, expected them cumulative", family, counts)
+				break
+			}
+		}
+		inf := values[family+`_bucket{le="+Inf"}`]
+		if inf != counts[len(counts)-1] || inf != values[family+"_count"] {
+			t.Errorf("%s +Inf bucket actual: %g, expected the last bucket and _count %g", family, inf, values[family+"_count"])
+		}
+	}
+	if count := values["tornode_next_hop_response_seconds_count"]; count != float64(after.NextHopLatency.Count) || count < 1 {
+		t.Errorf("tornode_next_hop_response_seconds_count actual: %g, expected %d", count, after.NextHopLatency.Count)
+	}
+}
+
+func TestMetricsCountFramesOnOpenCircuit(t *testing.T) {
+	first := startBridgeNode(t, context.Background())
+	defer first.Stop()
+	second := startBridgeNode(t, context.Background())
+	defer second.Stop()
+	server, serverKey := startDataServer(t, map[string]string{"a": "apple"})
+
+	vecLogger := govec.InitGoVector("request-test", "request-test", govec.GetDefaultConfig())
+	tnMap := map[string]rsa.PublicKey{
+		first.ListenIPPort:  first.PrivateKey.PublicKey,
+		second.ListenIPPort: second.PrivateKey.PublicKey,
+	}
+	rc, err := TorClient.OpenRequestCircuit([]string{first.ListenIPPort, second.ListenIPPort}, tnMap, utils.LinkConfig{}, utils.FlowControlConfig{}, vecLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	// the request goes forward as a frame on the open circuit, not in the onion
+	before := first.Metrics()
+	if value, err := rc.Request(context.Background(), server, serverKey, "a", time.Now().Add(5*time.Second)); err != nil || value != "apple" {
+		t.Fatalf("Value actual: %q, %v, expected apple", value, err)
+	}
+	if after := first.Metrics(); after.BytesForward <= before.BytesForward {
+		t.Errorf("Bytes forward actual: %d, expected more than %d", after.BytesForward, before.BytesForward)
+	}
+}
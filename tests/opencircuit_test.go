@@ -0,0 +1,109 @@
+package tests
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"../client/TorClient"
+	"../keyLibrary"
+	"../server/DataServer"
+	"../utils"
+	"github.com/DistributedClocks/GoVector/govec"
+)
+
+// a data server on a port of its own, returns its address
+func startDataServer(t *testing.T, dataBase map[string]string) (string, rsa.PublicKey) {
+	key, err := keyLibrary.GeneratePrivPubKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	server := &DataServer.Server{
+		Key:          key,
+		IpPort:       addr,
+		DataBase:     dataBase,
+		LockDataBase: &sync.Mutex{},
+		VecLogger:    govec.InitGoVector("server-test", "server-test", govec.GetDefaultConfig()),
+	}
+	go server.StartService()
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return addr, key.PublicKey
+}
+
+func TestRequestCircuitCarriesRequests(t *testing.T) {
+	first := startBridgeNode(t, context.Background())
+	defer first.Stop()
+	second := startBridgeNode(t, context.Background())
+	defer second.Stop()
+	large := strings.Repeat("x", 5000)
+	server, serverKey := startDataServer(t, map[string]string{"a": "apple", "b": "banana", "large": large})
+
+	vecLogger := govec.InitGoVector("open-test", "open-test", govec.GetDefaultConfig())
+	tnMap := map[string]rsa.PublicKey{
+		first.ListenIPPort:  first.PrivateKey.PublicKey,
+		second.ListenIPPort: second.PrivateKey.PublicKey,
+	}
+	rc, err := TorClient.OpenRequestCircuit([]string{first.ListenIPPort, second.ListenIPPort}, tnMap, utils.LinkConfig{}, utils.FlowControlConfig{}, vecLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	// idle longer than the relays' timeout, keepalives hold the circuit open
+	time.Sleep(3 * time.Second)
+	for _, key := range []string{"a", "b", "large", "missing"} {
+		expected := map[string]string{"a": "apple", "b": "banana", "large": large}[key]
+		value, err := rc.Request(context.Background(), server, serverKey, key, time.Now().Add(5*time.Second))
+		if err != nil {
+			t.Fatalf("Request for %s: %v", key, err)
+		}
+		if value != expected {
+			t.Errorf("Value for %s actual: %d bytes, expected %d bytes", key, len(value), len(expected))
+		}
+	}
+	if !rc.Alive() {
+		t.Errorf("Circuit should stay up between requests")
+	}
+}
+
+func TestRequestCircuitBlamesDataServer(t *testing.T) {
+	relay := startBridgeNode(t, context.Background())
+	defer relay.Stop()
+	vecLogger := govec.InitGoVector("open-test", "open-test", govec.GetDefaultConfig())
+	tnMap := map[string]rsa.PublicKey{relay.ListenIPPort: relay.PrivateKey.PublicKey}
+	rc, err := TorClient.OpenRequestCircuit([]string{relay.ListenIPPort}, tnMap, utils.LinkConfig{}, utils.FlowControlConfig{}, vecLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	// nothing listens there
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	server := listener.Addr().String()
+	listener.Close()
+	serverKey, _ := keyLibrary.GeneratePrivPubKey()
+
+	_, err = rc.Request(context.Background(), server, serverKey.PublicKey, "a", time.Now().Add(5*time.Second))
+	var hopErr *TorClient.HopError
+	if !errors.As(err, &hopErr) || hopErr.Hop != 1 || hopErr.Addr != server || hopErr.Reason != utils.ReasonUnreachable {
+		t.Errorf("Error actual: %v, expected the data server unreachable", err)
+	}
+}
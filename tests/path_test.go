@@ -0,0 +1,142 @@
+package tests
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"../client/TorClient"
+	"../keyLibrary"
+	"../tn/tornode"
+	"../utils"
+)
+
+func TestValidatePath(t *testing.T) {
+	keys := make([]rsa.PublicKey, 4)
+	for i := range keys {
+		key, err := keyLibrary.GeneratePrivPubKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = key.PublicKey
+	}
+	tnMap := map[string]rsa.PublicKey{
+		"10.1.0.1:4001":   keys[0],
+		"10.1.9.9:4001":   keys[1],
+		"10.2.0.1:4001":   keys[2],
+		"10.3.0.1:4001":   keys[3],
+		"10.3.0.1:4002":   keys[3],
+		"127.0.0.1:4001":  keys[0],
+		"127.0.0.1:4011":  keys[1],
+		"[2001:db8::1]:1": keys[1],
+		"[2001:db8::2]:1": keys[2],
+	}
+	for _, test := range []struct {
+		path       []string
+		subnetBits int
+		valid      bool
+	}{
+		{[]string{"10.1.0.1:4001", "10.2.0.1:4001", "10.3.0.1:4001"}, 16, true},
+		{[]string{"10.1.0.1:4001", "10.2.0.1:4001", "10.1.0.1:4001"}, 16, false},
+		{[]string{"10.1.0.1:4001", "10.3.0.1:4001", "10.3.0.1:4002"}, 16, false},
+		{[]string{"10.1.0.1:4001", "10.1.9.9:4001"}, 16, false},
+		{[]string{"10.1.0.1:4001", "10.1.9.9:4001"}, 24, true},
+		{[]string{"10.1.0.1:4001", "10.1.9.9:4001"}, 0, true},
+		{[]string{"127.0.0.1:4001", "127.0.0.1:4011"}, 16, true},
+		{[]string{"[2001:db8::1]:1", "[2001:db8::2]:1"}, 16, false},
+	} {
+		err := TorClient.ValidatePath(test.path, tnMap, test.subnetBits)
+		if test.valid && err != nil {
+			t.Errorf("Path %v with /%d actual: %v, expected valid", test.path, test.subnetBits, err)
+		}
+		if !test.valid && !errors.Is(err, TorClient.ErrInvalidPath) {
+			t.Errorf("Path %v with /%d actual: %v, expected ErrInvalidPath", test.path, test.subnetBits, err)
+		}
+	}
+}
+
+func TestDetermineTnOrderEmpty(t *testing.T) {
+	if order := TorClient.DetermineTnOrder(map[string]rsa.PublicKey{}); len(order) != 0 {
+		t.Errorf("Order actual: %v, expected none", order)
+	}
+}
+
+func TestPathLengthBetweenMinAndMax(t *testing.T) {
+	relays := []*tornode.TorNode{}
+	for i := 0; i < 2; i++ {
+		relay := startBridgeNode(t, context.Background())
+		defer relay.Stop()
+		relays = append(relays, relay)
+	}
+	config := clientConfigFor(t, relays...)
+	config.Path = utils.PathConfig{MaxLength: 3, MinLength: 2, EntryNodes: []string{relays[1].ListenIPPort}}
+	config.Guards.StateFile = filepath.Join(t.TempDir(), "client.guards.json")
+
+	client, err := TorClient.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// two relays are as many as there are, the entry is the one the rules name
+	if value, err := client.Get(context.Background(), "a"); err != nil || value != "apple" {
+		t.Fatalf("Get actual: %q, %v, expected apple", value, err)
+	}
+	if guards := readGuards(t, config.Guards.StateFile); len(guards) != 1 || guards[0].Addr != relays[1].ListenIPPort {
+		t.Errorf("Guards actual: %v, expected %s alone", guards, relays[1].ListenIPPort)
+	}
+
+	config.Path.MinLength = 3
+	client, err = TorClient.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Get(context.Background(), "a"); !errors.Is(err, TorClient.ErrNotEnoughRelays) {
+		t.Errorf("Error actual: %v, expected ErrNotEnoughRelays", err)
+	}
+
+	config.Path = utils.PathConfig{ExcludeNodes: []string{"not a relay"}}
+	if _, err := TorClient.NewClient(config); err == nil {
+		t.Error("Client with a bad ExcludeNodes entry started")
+	}
+}
+
+func TestExitNodesPickLastRelayOfRequests(t *testing.T) {
+	relays := []*tornode.TorNode{}
+	for i := 0; i < 3; i++ {
+		relay := startBridgeNode(t, context.Background())
+		defer relay.Stop()
+		relays = append(relays, relay)
+	}
+	last := relays[2].ListenIPPort
+	config := clientConfigFor(t, relays...)
+	config.Path = utils.PathConfig{MaxLength: 2, ExitNodes: []string{last}}
+
+	client, err := TorClient.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for i := 0; i < 5; i++ {
+		client.NewIdentity()
+		if value, err := client.Get(context.Background(), "a"); err != nil || value != "apple" {
+			t.Fatalf("Get actual: %q, %v, expected apple", value, err)
+		}
+		if circuit := client.Circuit(); len(circuit) != 2 || circuit[1] != last {
+			t.Errorf("Circuit actual: %v, expected it to end at %s", circuit, last)
+		}
+	}
+
+	// no relay of the directory may be the last one
+	config.Path.ExitNodes = []string{"203.0.113.5:4001"}
+	client, err = TorClient.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Get(context.Background(), "a"); !errors.Is(err, TorClient.ErrNotEnoughRelays) {
+		t.Errorf("Error actual: %v, expected ErrNotEnoughRelays", err)
+	}
+}
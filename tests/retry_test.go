@@ -0,0 +1,62 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"../client/TorClient"
+	"../tn/tornode"
+	"../utils"
+)
+
+func TestRetryGoesAroundDeadRelay(t *testing.T) {
+	relays := []*tornode.TorNode{}
+	for i := 0; i < 4; i++ {
+		relay := startBridgeNode(t, context.Background())
+		defer relay.Stop()
+		relays = append(relays, relay)
+	}
+	// the DS still lists it
+	relays[3].Stop()
+	config := clientConfigFor(t, relays...)
+	config.MaxNumNodes = 3
+
+	client, err := TorClient.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for i := 0; i < 6; i++ {
+		value, err := client.Get(context.Background(), "a")
+		if err != nil {
+			t.Fatalf("Request %d failed: %s", i, err)
+		}
+		if value != "apple" {
+			t.Errorf("Value actual: %q, expected apple", value)
+		}
+	}
+}
+
+func TestRetryStopsAtMaxAttempts(t *testing.T) {
+	relay := startBridgeNode(t, context.Background())
+	defer relay.Stop()
+	dead := startBridgeNode(t, context.Background())
+	dead.Stop()
+	config := clientConfigFor(t, relay, dead)
+	config.MaxNumNodes = 2
+	config.Retry = utils.RetryConfig{MaxAttempts: 2}
+
+	client, err := TorClient.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// every circuit goes through the dead relay, the second attempt uses it again for
+	// lack of others
+	_, err = client.Get(context.Background(), "a")
+	var hopErr *TorClient.HopError
+	if !errors.As(err, &hopErr) || hopErr.Addr != dead.ListenIPPort {
+		t.Errorf("Error actual: %v, expected a HopError at %s", err, dead.ListenIPPort)
+	}
+}
@@ -5,11 +5,15 @@ import (
 	"../keyLibrary"
 	"../server/DataServer"
 	"../utils"
+	"context"
 	"crypto/rsa"
+	"errors"
 	"github.com/DistributedClocks/GoVector/govec"
-	"net"
+	"io"
+	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 )
 
 func TestServerInit(t *testing.T) {
@@ -79,11 +83,11 @@ func TestServerRequest(t *testing.T) {
 }
 
 func sendAndReceive(serverIpPort string, serverPublicKey rsa.PublicKey, key string) (string, error) {
-	tcpLocalAddr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:8081")
-
-	tcpServerAddr, _ := net.ResolveTCPAddr("tcp", serverIpPort)
-
-	tcpConn, _ := net.DialTCP("tcp", tcpLocalAddr, tcpServerAddr)
+	tcpConn, err := utils.DialTLS(serverIpPort, keyLibrary.KeyFingerprint(&serverPublicKey), nil, time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer tcpConn.Close()
 
 	myMap := make(map[string]rsa.PublicKey)
 
@@ -94,10 +98,19 @@ func sendAndReceive(serverIpPort string, serverPublicKey rsa.PublicKey, key stri
 	onionbytes, symKeys := CreateEncryptedRequest(order, myMap, key)
 
 	serverVectorLogger := govec.InitGoVector("data-server", "data-server", govec.GetDefaultConfig())
-	_, _ = utils.TCPWrite(tcpConn, onionbytes,serverVectorLogger, "Responded to client request")
+	_, _ = utils.WriteData(tcpConn, onionbytes,serverVectorLogger, "Responded to client request")
 
 	clientVectorLogger := govec.InitGoVector("fake-client", "client", govec.GetDefaultConfig())
-	res, _ := utils.TCPRead(tcpConn, clientVectorLogger, "Response from the server")
+	cell, err := utils.ReadCell(tcpConn, clientVectorLogger, "Response from the server")
+	if err != nil {
+		return "", err
+	}
+	res := cell.Payload
+
+	end, err := utils.ReadCell(tcpConn, clientVectorLogger, "Response end from the server")
+	if err != nil || end.Command != utils.CellEnd {
+		return "", errors.New("response not terminated by an end cell")
+	}
 
 	for _, key := range symKeys {
 		var err error
@@ -109,7 +122,7 @@ func sendAndReceive(serverIpPort string, serverPublicKey rsa.PublicKey, key stri
 
 	var resp utils.Response
 
-	err := utils.UnMarshall(res, &resp)
+	err = utils.UnMarshall(res, &resp)
 
 	return resp.Value, err
 }
@@ -123,9 +136,85 @@ func CreateEncryptedRequest(nodeOrder []string, tnMap map[string]rsa.PublicKey,
 
 	symKeys = append(symKeys, ServerSymKey)
 
-	encryptedRequest := TorClient.EncryptPayload(request, tnMap[nodeOrder[len(nodeOrder)-1]])
+	encryptedRequest, _ := TorClient.EncryptPayload(request, tnMap[nodeOrder[len(nodeOrder)-1]])
 
 	marshalledRequest, _ := utils.Marshall(encryptedRequest)
 
 	return marshalledRequest,symKeys
 }
+
+func TestServerSendsLargeValuesFrameByFrame(t *testing.T) {
+	first := startBridgeNode(t, context.Background())
+	defer first.Stop()
+	second := startBridgeNode(t, context.Background())
+	defer second.Stop()
+	// the two bytes of é straddle the end of the first frame
+	large := strings.Repeat("x", DataServer.RESPONSE_FRAME_SIZE-1) + "é" + strings.Repeat("y", 2*DataServer.RESPONSE_FRAME_SIZE)
+	server, serverKey := startDataServer(t, map[string]string{"large": large})
+
+	nodeOrder := []string{first.ListenIPPort, second.ListenIPPort, server}
+	tnMap := map[string]rsa.PublicKey{
+		first.ListenIPPort:  first.PrivateKey.PublicKey,
+		second.ListenIPPort: second.PrivateKey.PublicKey,
+		server:              serverKey,
+	}
+	onion, symmKeys, err := TorClient.CreateOnionMessage(nodeOrder, tnMap, "large", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vecLogger := govec.InitGoVector("frames-test", "frames-test", govec.GetDefaultConfig())
+	reader, err := TorClient.SendOnionMessageStream(nodeOrder, tnMap, onion, symmKeys, utils.LinkConfig{}, utils.FlowControlConfig{}, time.Time{}, vecLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	var frames []string
+	for {
+		frame, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Frame %d: %v", len(frames), err)
+		}
+		if len(frame) > DataServer.RESPONSE_FRAME_SIZE || !utf8.ValidString(frame) {
+			t.Errorf("Frame %d actual: %d bytes, valid UTF-8 %v", len(frames), len(frame), utf8.ValidString(frame))
+		}
+		frames = append(frames, frame)
+	}
+	if len(frames) != 4 || !strings.HasPrefix(frames[1], "é") {
+		t.Errorf("Frames actual: %d, expected 4 with é moved to the start of the second", len(frames))
+	}
+	if strings.Join(frames, "") != large {
+		t.Errorf("Frames put together do not make up the value")
+	}
+}
+
+func TestServerDestroysCircuitWithUnusableKey(t *testing.T) {
+	server, serverKey := startDataServer(t, map[string]string{"a": "apple"})
+	conn, err := utils.DialTLS(server, keyLibrary.KeyFingerprint(&serverKey), nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// AES has no 5 byte keys, the response can't be encrypted
+	request, _ := utils.Marshall(utils.Request{Key: "a", SymmKey: []byte("short")})
+	encrypted, err := TorClient.EncryptPayload(request, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onion, _ := utils.Marshall(encrypted)
+	vecLogger := govec.InitGoVector("server-test", "server-test", govec.GetDefaultConfig())
+	if _, err := utils.WriteData(conn, onion, vecLogger, "Request with a short key"); err != nil {
+		t.Fatal(err)
+	}
+	cell, err := utils.ReadCell(conn, vecLogger, "Response from the server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cell.Command != utils.CellDestroy || cell.Reason != utils.ReasonProtocol {
+		t.Errorf("Cell actual: command %d reason %s, expected a destroy: %s", cell.Command, cell.Reason, utils.ReasonProtocol)
+	}
+}
@@ -0,0 +1,53 @@
+package tests
+
+import (
+	"crypto/rsa"
+	"testing"
+
+	"../keyLibrary"
+	"../utils"
+)
+
+func TestServiceDescriptorSignature(t *testing.T) {
+	serviceKey, _ := keyLibrary.GeneratePrivPubKey()
+	relayKey, _ := keyLibrary.GeneratePrivPubKey()
+	address := utils.ServiceAddress(&serviceKey.PublicKey)
+
+	descriptor := utils.ServiceDescriptor{
+		ServiceKey:  serviceKey.PublicKey,
+		IntroPoints: map[string]rsa.PublicKey{"127.0.0.1:4001": relayKey.PublicKey},
+		Published:   1,
+	}
+	if err := descriptor.Sign(serviceKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := descriptor.Verify(address); err != nil {
+		t.Fatalf("Signed descriptor should verify: %s", err)
+	}
+
+	otherKey, _ := keyLibrary.GeneratePrivPubKey()
+	if err := descriptor.Verify(utils.ServiceAddress(&otherKey.PublicKey)); err == nil {
+		t.Errorf("Descriptor should not verify for another service's address")
+	}
+
+	// a relay swapped in by someone without the service key
+	tampered := descriptor
+	tampered.IntroPoints = map[string]rsa.PublicKey{"127.0.0.1:6666": otherKey.PublicKey}
+	if err := tampered.Verify(address); err == nil {
+		t.Errorf("Descriptor with altered introduction points should not verify")
+	}
+}
+
+func TestIntroAuthIsBoundToRelay(t *testing.T) {
+	serviceKey, _ := keyLibrary.GeneratePrivPubKey()
+	signature, err := keyLibrary.Sign(serviceKey, utils.IntroAuth("relay-a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keyLibrary.VerifySignature(&serviceKey.PublicKey, utils.IntroAuth("relay-a"), signature); err != nil {
+		t.Errorf("Introduction signature should verify at the relay it was made for: %s", err)
+	}
+	if err := keyLibrary.VerifySignature(&serviceKey.PublicKey, utils.IntroAuth("relay-b"), signature); err == nil {
+		t.Errorf("Introduction signature should not verify at another relay")
+	}
+}
@@ -0,0 +1,53 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"../client/TorClient"
+	"../tn/tornode"
+	"../utils"
+)
+
+func TestShellSessionKeepsCircuits(t *testing.T) {
+	relays := []*tornode.TorNode{}
+	for i := 0; i < 3; i++ {
+		relay := startBridgeNode(t, context.Background())
+		defer relay.Stop()
+		relays = append(relays, relay)
+	}
+	config := clientConfigFor(t, relays...)
+	config.MaxNumNodes = 2
+	config.CircuitPool = utils.CircuitPoolConfig{Enabled: true, MaxCircuits: 1}
+	client, err := TorClient.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	session := "put b banana split\nget b\nlist\ncircuit\ntimings\n"
+	var out bytes.Buffer
+	if err := TorClient.RunShell(client, strings.NewReader(session), &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"stored b\n", `b = "banana split"`, "a\nb\n2 keys\n", " -> ", "3 commands"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Shell output actual:\n%s\nexpected it to contain %q", out.String(), expected)
+		}
+	}
+	circuit := client.Circuit()
+	if len(circuit) != 2 {
+		t.Fatalf("Circuit actual: %v, expected two relays", circuit)
+	}
+
+	// the commands went through one pooled circuit, until a new identity retires it
+	out.Reset()
+	if err := TorClient.RunShell(client, strings.NewReader("newnym\ncircuit\nget a\n"), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "no circuit yet") || !strings.Contains(out.String(), `a = "apple"`) {
+		t.Errorf("Shell output after newnym actual:\n%s", out.String())
+	}
+}
@@ -0,0 +1,100 @@
+package tests
+
+import (
+	"context"
+	"crypto/rsa"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+
+	"../client/TorClient"
+	"../tn/tornode"
+	"../utils"
+	"github.com/DistributedClocks/GoVector/govec"
+)
+
+// dials through the given relays, the last one being the exit
+func dialThrough(relays ...*tornode.TorNode) TorClient.DialFunc {
+	vecLogger := govec.InitGoVector("proxy-test", "proxy-test", govec.GetDefaultConfig())
+	nodeOrder := []string{}
+	tnMap := map[string]rsa.PublicKey{}
+	for _, relay := range relays {
+		nodeOrder = append(nodeOrder, relay.ListenIPPort)
+		tnMap[relay.ListenIPPort] = relay.PrivateKey.PublicKey
+	}
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		return TorClient.DialExit(nodeOrder, tnMap, addr, utils.LinkConfig{}, utils.FlowControlConfig{}, vecLogger)
+	}
+}
+
+// a SOCKS proxy that tunnels through the given relays
+func serveSOCKSThrough(t *testing.T, relays ...*tornode.TorNode) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go TorClient.ServeSOCKS(listener, dialThrough(relays...))
+	return listener.Addr().String()
+}
+
+// connects through the proxy to host:port by name, returning the SOCKS reply code
+func socksConnect(t *testing.T, proxy string, host string, port int) (net.Conn, byte) {
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := []byte{5, 1, 0, 5, 1, 0, 3, byte(len(host))}
+	request = append(request, host...)
+	request = append(request, byte(port>>8), byte(port))
+	if _, err := conn.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[0] != 5 || reply[1] != 0 {
+		t.Fatalf("Greeting reply actual: %v, expected no authentication", reply[:2])
+	}
+	return conn, reply[3]
+}
+
+func TestSOCKSConnectByName(t *testing.T) {
+	middle := startBridgeNode(t, context.Background())
+	defer middle.Stop()
+	exit := startBridgeNodeWith(t, context.Background(), utils.TorNodeConfig{Exit: true, ExitAllowPrivate: true})
+	defer exit.Stop()
+	_, port, _ := net.SplitHostPort(serveEcho(t))
+	portNum, _ := strconv.Atoi(port)
+
+	conn, reply := socksConnect(t, serveSOCKSThrough(t, middle, exit), "localhost", portNum)
+	defer conn.Close()
+	if reply != 0 {
+		t.Fatalf("Reply actual: %d, expected success", reply)
+	}
+	conn.Write([]byte("hello"))
+	conn.(*net.TCPConn).CloseWrite()
+	received, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(received) != "echo: hello" {
+		t.Errorf("Received actual: %q, expected %q", received, "echo: hello")
+	}
+}
+
+func TestSOCKSExitPolicyRefuses(t *testing.T) {
+	exit := startBridgeNodeWith(t, context.Background(), utils.TorNodeConfig{Exit: true, ExitAllowPrivate: true, ExitPorts: utils.ExitPorts{443}})
+	defer exit.Stop()
+	_, port, _ := net.SplitHostPort(serveEcho(t))
+	portNum, _ := strconv.Atoi(port)
+
+	conn, reply := socksConnect(t, serveSOCKSThrough(t, exit), "127.0.0.1", portNum)
+	defer conn.Close()
+	if reply != 2 {
+		t.Errorf("Reply actual: %d, expected 2 (not allowed)", reply)
+	}
+}
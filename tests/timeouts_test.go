@@ -0,0 +1,123 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"../client/TorClient"
+	"../tn/tornode"
+	"../utils"
+	"github.com/DistributedClocks/GoVector/govec"
+)
+
+func TestParetoTimeoutFitsParetoSamples(t *testing.T) {
+	// evenly spread quantiles of a Pareto distribution with scale 500ms and shape 3
+	xm, alpha := float64(500*time.Millisecond), 3.0
+	samples := make([]time.Duration, 1000)
+	for i := range samples {
+		u := (float64(i) + 0.5) / float64(len(samples))
+		samples[i] = time.Duration(xm / math.Pow(1-u, 1/alpha))
+	}
+	expected := time.Duration(xm / math.Pow(0.2, 1/alpha))
+	actual := TorClient.ParetoTimeout(samples, 0.8)
+	if actual < expected*8/10 || actual > expected*12/10 {
+		t.Errorf("Timeout actual: %v, expected about %v", actual, expected)
+	}
+	if timeout := TorClient.ParetoTimeout(nil, 0.8); timeout != 0 {
+		t.Errorf("Timeout without samples actual: %v, expected 0", timeout)
+	}
+}
+
+func writeTimeoutState(t *testing.T, path string, firstResponses ...float64) {
+	raw, err := json.Marshal(map[string][]float64{"FirstResponse": firstResponses})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientGivesUpOnSlowCircuits(t *testing.T) {
+	vecLogger := govec.InitGoVector("timeouts-test", "timeouts-test", govec.GetDefaultConfig())
+	silent, dnMap := serveSilent(t, vecLogger)
+	stateFile := filepath.Join(t.TempDir(), "client.timeouts.json")
+	// requests used to answer within a millisecond
+	writeTimeoutState(t, stateFile, 1, 1, 1, 1, 1)
+
+	config := clientConfigOf(t, dnMap)
+	config.Retry.MaxAttempts = 1
+	config.Timeouts = utils.BuildTimeoutConfig{StateFile: stateFile, MinSamples: 5}
+	client, err := TorClient.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if timeout := client.FirstResponseTimeout(); timeout != 10*time.Millisecond {
+		t.Errorf("First response timeout actual: %v, expected the 10ms floor", timeout)
+	}
+
+	start := time.Now()
+	_, err = client.Get(context.Background(), "a")
+	if !errors.Is(err, TorClient.ErrCircuitTimeout) {
+		t.Fatalf("Error through %s actual: %v, expected ErrCircuitTimeout", silent, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Client gave up after %v, expected well before the relay's 2s", elapsed)
+	}
+}
+
+func TestClientLearnsTimeoutsAcrossRuns(t *testing.T) {
+	relays := []*tornode.TorNode{}
+	for i := 0; i < 2; i++ {
+		relay := startBridgeNode(t, context.Background())
+		defer relay.Stop()
+		relays = append(relays, relay)
+	}
+	stateFile := filepath.Join(t.TempDir(), "client.timeouts.json")
+	config := clientConfigFor(t, relays...)
+	config.MaxNumNodes = 2
+	config.Timeouts = utils.BuildTimeoutConfig{StateFile: stateFile, MinSamples: 3}
+
+	client, err := TorClient.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := client.Get(context.Background(), "a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.Close()
+
+	raw, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state struct{ FirstResponse []float64 }
+	if err := json.Unmarshal(raw, &state); err != nil {
+		t.Fatal(err)
+	}
+	if len(state.FirstResponse) != 3 {
+		t.Fatalf("Saved first responses actual: %v, expected 3", state.FirstResponse)
+	}
+
+	// the next run starts with the timeout learned in the last one
+	client, err = TorClient.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if timeout := client.FirstResponseTimeout(); timeout < 10*time.Millisecond {
+		t.Errorf("First response timeout actual: %v, expected one learned from the last run", timeout)
+	}
+	if timeout := client.BuildTimeout(); timeout != 0 {
+		t.Errorf("Build timeout actual: %v, expected none without pooled circuits", timeout)
+	}
+}
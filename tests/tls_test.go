@@ -0,0 +1,50 @@
+package tests
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"../keyLibrary"
+	"../utils"
+)
+
+func TestTLSLinkVerifiesIdentityKey(t *testing.T) {
+	nodeKey, _ := keyLibrary.GeneratePrivPubKey()
+	otherKey, _ := keyLibrary.GeneratePrivPubKey()
+
+	tlsConfig, err := keyLibrary.ServerTLSConfig(nodeKey, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			// finish the handshake, then hang up
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	addr := listener.Addr().String()
+	conn, err := utils.DialTLS(addr, keyLibrary.KeyFingerprint(&nodeKey.PublicKey), nil, time.Second)
+	if err != nil {
+		t.Fatalf("Link to the node with its own key should verify: %s", err)
+	}
+	conn.Close()
+
+	if _, err := utils.DialTLS(addr, keyLibrary.KeyFingerprint(&otherKey.PublicKey), nil, time.Second); err == nil {
+		t.Errorf("Link should be refused when the node presents a different key")
+	}
+	if _, err := utils.DialTLS(addr, "", nil, time.Second); err == nil {
+		t.Errorf("Link should be refused when there is no key to verify against")
+	}
+}
@@ -0,0 +1,217 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"errors"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"../client/TorClient"
+	"../keyLibrary"
+	"../tn/tornode"
+	"../utils"
+	"github.com/DistributedClocks/GoVector/govec"
+)
+
+// starts a bridge, so no DS is needed, on a listener the test picked
+func startBridgeNode(t *testing.T, ctx context.Context) *tornode.TorNode {
+	return startBridgeNodeWith(t, ctx, utils.TorNodeConfig{})
+}
+
+// same, with the other settings from config
+func startBridgeNodeWith(t *testing.T, ctx context.Context, config utils.TorNodeConfig) *tornode.TorNode {
+	return startBridgeNodeLogging(t, ctx, config, nil)
+}
+
+// same, with the node's messages going to logger
+func startBridgeNodeLogging(t *testing.T, ctx context.Context, config utils.TorNodeConfig, logger *log.Logger) *tornode.TorNode {
+	dsKey, err := keyLibrary.GeneratePrivPubKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsKeyPath := filepath.Join(t.TempDir(), "ds.pem")
+	if err := keyLibrary.SavePublicKeyOnDisk(dsKeyPath, &dsKey.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.Bridge, config.DSPublicKeyPath = true, dsKeyPath
+	tn, err := tornode.NewTorNode(tornode.Options{
+		ListenIPPort:   listener.Addr().String(),
+		FdListenIPPort: "127.0.0.1:0",
+		TimeoutMillis:  2000,
+		Config:         config,
+		Listener:       listener,
+		VecLogger:      govec.InitGoVector("tornode-test", "tornode-test", govec.GetDefaultConfig()),
+		Logger:         logger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tn.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return tn
+}
+
+func TestTorNodesInOneProcess(t *testing.T) {
+	first := startBridgeNode(t, context.Background())
+	defer first.Stop()
+	second := startBridgeNode(t, context.Background())
+	defer second.Stop()
+	if err := first.Start(context.Background()); err == nil {
+		t.Errorf("Starting a node twice should fail")
+	}
+
+	// a rendezvous circuit through both stays open until a relay goes away
+	vecLogger := govec.InitGoVector("tornode-client", "tornode-client", govec.GetDefaultConfig())
+	tnMap := map[string]rsa.PublicKey{
+		first.ListenIPPort:  first.PrivateKey.PublicKey,
+		second.ListenIPPort: second.PrivateKey.PublicKey,
+	}
+	cell := utils.ServiceCell{Command: utils.ServiceEstablishRendezvous, Cookie: []byte("tornode-test-cookie")}
+	circuit, err := TorClient.OpenServiceCircuit([]string{first.ListenIPPort, second.ListenIPPort}, tnMap, cell, utils.LinkConfig{}, utils.FlowControlConfig{}, vecLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer circuit.Close()
+	if err := circuit.ExpectFrame(utils.ServiceEstablishRendezvous); err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		second.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Stop did not return with a circuit open")
+	}
+	if _, err := circuit.ReadFrame(); err == nil {
+		t.Errorf("The circuit should be torn down once its last relay stops")
+	}
+	if conn, err := net.DialTimeout("tcp", second.ListenIPPort, time.Second); err == nil {
+		conn.Close()
+		t.Errorf("A stopped node should not accept connections")
+	}
+}
+
+func TestTorNodeStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	tn := startBridgeNode(t, ctx)
+	cancel()
+	select {
+	case <-tn.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Node did not stop once its context was done")
+	}
+}
+
+func TestOverloadedNodeRejectsCircuits(t *testing.T) {
+	relay := startBridgeNodeWith(t, context.Background(), utils.TorNodeConfig{MaxCircuits: 1, MaxHandshakes: 1, AcceptQueueSize: 1})
+	defer relay.Stop()
+
+	// peers that never send an onion: one holds the circuit slot until the handshake times
+	// out, one waits for the slot in the dispatcher and one fills the accept queue
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", relay.ListenIPPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	vecLogger := govec.InitGoVector("overload-test", "overload-test", govec.GetDefaultConfig())
+	symmKeys := [][]byte{keyLibrary.GenerateSymmKey(), keyLibrary.GenerateSymmKey()}
+	tnMap := map[string]rsa.PublicKey{relay.ListenIPPort: relay.PrivateKey.PublicKey}
+	_, err := TorClient.SendOnionMessage([]string{relay.ListenIPPort, "server"}, tnMap, []byte("onion"), symmKeys, utils.LinkConfig{}, utils.FlowControlConfig{}, time.Time{}, vecLogger)
+	if !errors.Is(err, TorClient.ErrRelayOverloaded) {
+		t.Fatalf("Error actual: %v, expected ErrRelayOverloaded", err)
+	}
+	if rejected := relay.Metrics().CircuitsRejected; rejected != 1 {
+		t.Errorf("Circuits rejected actual: %d, expected 1", rejected)
+	}
+}
+
+func TestSelfTestPassesThroughListenAddress(t *testing.T) {
+	tn := startBridgeNode(t, context.Background())
+	defer tn.Stop()
+	// the test onion was a cover onion to ourselves, dropped as its last relay
+	if metrics := tn.Metrics(); metrics.OnionsPeeled != 1 || metrics.CoverOnionsDropped != 1 {
+		t.Errorf("Metrics after the self-test actual: %d peeled, %d cover dropped, expected 1 each", metrics.OnionsPeeled, metrics.CoverOnionsDropped)
+	}
+}
+
+func TestSelfTestRefusesUnreachableAdvertisedAddress(t *testing.T) {
+	dsKey, err := keyLibrary.GeneratePrivPubKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsKeyPath := filepath.Join(t.TempDir(), "ds.pem")
+	if err := keyLibrary.SavePublicKeyOnDisk(dsKeyPath, &dsKey.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	// a DS that notes whether the node tried to join
+	ds, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	joined := make(chan struct{}, 1)
+	go func() {
+		if conn, err := ds.Accept(); err == nil {
+			joined <- struct{}{}
+			conn.Close()
+		}
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	advertised := freeAddr(t)
+	tn, err := tornode.NewTorNode(tornode.Options{
+		DSIPPort:       ds.Addr().String(),
+		ListenIPPort:   listener.Addr().String(),
+		FdListenIPPort: "127.0.0.1:0",
+		TimeoutMillis:  500,
+		Config:         utils.TorNodeConfig{DSPublicKeyPath: dsKeyPath, AdvertiseIPPort: advertised},
+		Listener:       listener,
+		VecLogger:      govec.InitGoVector("selftest-test", "selftest-test", govec.GetDefaultConfig()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tn.Start(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "not reachable at advertised address "+advertised) {
+		t.Fatalf("Start error actual: %v, expected %s unreachable", err, advertised)
+	}
+	select {
+	case <-joined:
+		t.Errorf("A node that failed its self-test should not contact the DS")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestTorNodeLogsToItsLogger(t *testing.T) {
+	var logged bytes.Buffer
+	tn := startBridgeNodeLogging(t, context.Background(), utils.TorNodeConfig{}, log.New(&logged, "test node: ", 0))
+	tn.Stop()
+	for _, line := range []string{"test node: Reachability self-test passed", "test node: Stopped " + tn.ListenIPPort} {
+		if !strings.Contains(logged.String(), line) {
+			t.Errorf("Log actual:\n%s\nexpected a line starting with %q", logged.String(), line)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package tests
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"../utils"
+	"github.com/DistributedClocks/GoVector/govec"
+)
+
+func TestObfsTransportRoundTrip(t *testing.T) {
+	vecLogger := govec.InitGoVector("transport-test", "transport-test", govec.GetDefaultConfig())
+	transport, err := utils.NewTransport(utils.TransportConfig{Name: utils.TRANSPORT_OBFS, Secret: "bridge secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	echoed := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			echoed <- err
+			return
+		}
+		server := transport.Server(conn)
+		defer server.Close()
+		cell, err := utils.ReadCell(server, vecLogger, "Received cell")
+		if err == nil {
+			_, err = utils.WriteCell(server, *cell, vecLogger, "Echoed cell")
+		}
+		echoed <- err
+	}()
+
+	conn, err := transport.Dial(listener.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	payload := []byte("hello through the obfuscated link")
+	if _, err := utils.WriteData(conn, payload, vecLogger, "Sent cell"); err != nil {
+		t.Fatal(err)
+	}
+	cell, err := utils.ReadCell(conn, vecLogger, "Received echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-echoed; err != nil {
+		t.Fatal(err)
+	}
+	if cell.Command != utils.CellData || !bytes.Equal(cell.Payload, payload) {
+		t.Errorf("Echoed cell actual: %+v, expected a data cell with %q", cell, payload)
+	}
+}
+
+func TestObfsTransportHidesCells(t *testing.T) {
+	vecLogger := govec.InitGoVector("transport-test", "transport-test", govec.GetDefaultConfig())
+	transport, _ := utils.NewTransport(utils.TransportConfig{Name: utils.TRANSPORT_OBFS})
+
+	// a listener without the transport sees what an observer on the wire sees
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	wire := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			wire <- nil
+			return
+		}
+		defer conn.Close()
+		raw, _ := ioutil.ReadAll(conn)
+		wire <- raw
+	}()
+
+	conn, err := transport.Dial(listener.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.WriteData(conn, []byte("plaintext payload"), vecLogger, "Sent cell")
+	conn.Close()
+
+	raw := <-wire
+	if len(raw) == 0 {
+		t.Fatalf("Nothing was sent on the wire")
+	}
+	if bytes.Contains(raw, []byte("Command")) || bytes.Contains(raw, []byte("Payload")) {
+		t.Errorf("Cell framing is readable on the wire: %q", raw)
+	}
+}
+
+func TestTransportConfig(t *testing.T) {
+	if _, err := utils.NewTransport(utils.TransportConfig{Name: "carrier-pigeon"}); err == nil {
+		t.Errorf("Unknown transport name should be an error")
+	}
+	links := utils.LinkConfig{LinkTransports: map[string]utils.TransportConfig{"127.0.0.1:4001": {Name: utils.TRANSPORT_OBFS}}}
+	if transport, _ := links.TransportFor("127.0.0.1:4001"); transport.Name() != utils.TRANSPORT_OBFS {
+		t.Errorf("Link transport actual: %s, expected: %s", transport.Name(), utils.TRANSPORT_OBFS)
+	}
+	if transport, _ := links.TransportFor("127.0.0.1:4011"); transport.Name() != utils.TRANSPORT_PLAIN {
+		t.Errorf("Default transport actual: %s, expected: %s", transport.Name(), utils.TRANSPORT_PLAIN)
+	}
+}
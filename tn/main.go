@@ -1,18 +1,24 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 
+	"../utils"
 	"./tornode"
 )
 
 func main() {
 	args := os.Args[1:]
 
-	if !(len(args) == 0 || len(args) == 4) {
-		fmt.Println("Usage: go run tn/main.go [dsIPPort] [listenIPPort] [fdListenIPPort] [timeOutMillis]")
+	if !(len(args) == 0 || len(args) == 4 || len(args) == 5) {
+		fmt.Println("Usage: go run tn/main.go [dsIPPort] [listenIPPort] [fdListenIPPort] [timeOutMillis] [configFile]")
 		return
 	}
 
@@ -21,7 +27,7 @@ func main() {
 	fdListenIPPort := "127.0.0.1:4002"
 	timeOutMillis := 1000
 
-	if len(args) == 4 {
+	if len(args) >= 4 {
 		dsIPPort = args[0]
 		listenIPPort = args[1]
 		fdListenIPPort = args[2]
@@ -33,10 +39,39 @@ func main() {
 		}
 	}
 
-	tnerr := tornode.InitTorNode(dsIPPort, listenIPPort, fdListenIPPort, timeOutMillis)
+	config := utils.TorNodeConfig{}
+	if len(args) == 5 {
+		rawConfig, fileerr := ioutil.ReadFile(args[4])
+		if fileerr != nil {
+			fmt.Printf("Invalid config file: %s\n", fileerr)
+			return
+		}
+		jsonErr := json.Unmarshal(rawConfig, &config)
+		if jsonErr != nil {
+			fmt.Printf("Invalid config file: %s\n", jsonErr)
+			return
+		}
+	}
+
+	tn, tnerr := tornode.NewTorNode(tornode.Options{
+		DSIPPort:       dsIPPort,
+		ListenIPPort:   listenIPPort,
+		FdListenIPPort: fdListenIPPort,
+		TimeoutMillis:  timeOutMillis,
+		Config:         config,
+	})
 	if tnerr != nil {
 		fmt.Println(tnerr)
-	} else {
-		<-make(chan bool)
+		return
+	}
+
+	// ctrl-c tears the circuits down before exiting
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	tnerr = tn.Start(ctx)
+	if tnerr != nil {
+		fmt.Println(tnerr)
+		return
 	}
+	<-tn.Done()
 }
@@ -0,0 +1,172 @@
+package tornode
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+
+	"../../utils"
+)
+
+// bytes read from an exit connection into one data frame
+const exitFrameBytes = 4096
+
+// the client asks us to open a TCP connection out of the network and splice it onto
+// the circuit: bytes the client sends come out of the connection, bytes read from it go
+// back as data frames under our circuit key
+func (tn *TorNode) connectExit(ep *endpoint, cell *utils.ServiceCell) {
+	defer ep.close()
+
+	if !tn.exit {
+		tn.logger.Printf("WARNING refusing to exit to %s, not an exit", cell.Address)
+		tn.destroyEndpoint(ep, utils.ReasonRefused)
+		return
+	}
+	if port, perr := utils.DestinationPort(cell.Address); perr != nil || !tn.exitPorts.Allows(port) {
+		tn.logger.Printf("WARNING refusing to exit to %s, port not allowed", cell.Address)
+		tn.destroyEndpoint(ep, utils.ReasonRefused)
+		return
+	}
+	timeout := time.Duration(tn.timeoutMillis) * time.Millisecond
+	ip, port, rerr := resolveExit(cell.Address, timeout)
+	if rerr == nil && !tn.exitToPrivate && isPrivate(ip) {
+		tn.logger.Printf("WARNING refusing to exit to %s, %s is a private address", cell.Address, ip)
+		tn.destroyEndpoint(ep, utils.ReasonRefused)
+		return
+	}
+	var target net.Conn
+	derr := rerr
+	if derr == nil {
+		// the IP we checked, the host could resolve to another one by now
+		target, derr = net.DialTimeout("tcp", net.JoinHostPort(ip.String(), port), timeout)
+	}
+	if derr != nil {
+		tn.metrics.dialFailed()
+		tn.logger.Printf("WARNING error dialing exit target: %s", derr)
+		// the target is our next hop, the client shouldn't hold it against us
+		tn.destroyBack(ep.conn, ep.symmKey, utils.DestroyInfo{Reason: utils.ReasonUnreachable, NextHop: true})
+		return
+	}
+	target, ok := tn.track(target)
+	if !ok {
+		return
+	}
+	defer target.Close()
+
+	if tn.sendServiceFrame(ep, utils.ServiceFrame{Command: utils.ServiceConnect}) != nil {
+		return
+	}
+	tn.logger.Printf("Exit connection to %s opened", cell.Address)
+
+	tn.readEndpoint(ep)
+	targetDone := make(chan struct{})
+	tn.goTracked(func() { tn.exitBack(ep, target, targetDone) })
+	tn.exitForward(ep, target, targetDone)
+	// hang up on the client first, so reading the target fails quietly
+	ep.close()
+	target.Close()
+	tn.logger.Printf("Exit connection to %s closed", cell.Address)
+}
+
+// passes what the client sends on to the target, until both sides are done or either
+// tears down. Keeps the circuit alive while the target is quiet.
+func (tn *TorNode) exitForward(ep *endpoint, target net.Conn, targetDone <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(tn.timeoutMillis) * time.Millisecond / 2)
+	defer ticker.Stop()
+	keepalive := ticker.C
+	clientDone, targetClosed := false, false
+
+	for {
+		select {
+		case cell, ok := <-ep.cells:
+			if !ok || cell.Command == utils.CellDestroy {
+				return
+			}
+			switch cell.Command {
+			case utils.CellData:
+				payload, perr := peelFrame(cell.Payload, ep.symmKey, ep.fwdDigest)
+				if perr != nil {
+					tn.metrics.integrityFailed()
+					tn.logger.Printf("WARNING frame failed integrity check at exit, tearing down circuit")
+					tn.destroyEndpoint(ep, utils.ReasonIntegrity)
+					return
+				}
+				tn.metrics.forwarded(len(payload))
+				if _, werr := target.Write(payload); werr != nil {
+					tn.logger.Printf("WARNING failed to write to exit target: %s", werr)
+					tn.destroyEndpoint(ep, utils.ReasonConnectionClosed)
+					return
+				}
+			case utils.CellEnd:
+				// the client is done sending, the target may still answer
+				clientDone = true
+				utils.CloseWrite(target)
+				if targetClosed {
+					return
+				}
+			}
+		case <-targetDone:
+			if clientDone {
+				return
+			}
+			// the end went back, the client hangs up once it has read it
+			targetClosed = true
+			targetDone, keepalive = nil, nil
+		case <-keepalive:
+			if tn.sendServiceFrame(ep, utils.ServiceFrame{Command: utils.ServiceKeepalive}) != nil {
+				return
+			}
+		}
+	}
+}
+
+// sends what the target answers back to the client, then an end once it hangs up
+func (tn *TorNode) exitBack(ep *endpoint, target net.Conn, targetDone chan<- struct{}) {
+	defer close(targetDone)
+
+	buf := make([]byte, exitFrameBytes)
+	for {
+		n, rerr := target.Read(buf)
+		if n > 0 {
+			tn.metrics.forwardedBack(n)
+			if tn.sendServiceFrame(ep, utils.ServiceFrame{Command: utils.ServiceData, Data: buf[:n]}) != nil {
+				return
+			}
+		}
+		if rerr == io.EOF {
+			tn.endEndpoint(ep)
+			return
+		}
+		if rerr != nil {
+			select {
+			case <-ep.closed:
+			default:
+				tn.logger.Printf("WARNING failed to read from exit target: %s", rerr)
+				tn.destroyEndpoint(ep, utils.ReasonConnectionClosed)
+			}
+			return
+		}
+	}
+}
+
+// the first IP host resolves to, with the port of address
+func resolveExit(address string, timeout time.Duration) (net.IP, string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, "", err
+	}
+	return ips[0], port, nil
+}
+
+// whether ip is in the exit's own networks rather than out on the internet: loopback,
+// private, link-local or unspecified, like Tor's ExitPolicyRejectPrivate
+func isPrivate(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
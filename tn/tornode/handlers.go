@@ -1,118 +1,522 @@
 package tornode
 
 import (
-	"crypto/rsa"
-	"fmt"
+	"crypto/tls"
 	"io"
 	"net"
+	"strings"
 	"time"
 
-	"github.com/DistributedClocks/GoVector/govec"
-
 	"../../utils"
 )
 
 // listening for initial onion messages
-func onionHandler(listener *net.TCPListener, privateKey *rsa.PrivateKey, timeoutMillis int, vecLogger *govec.GoLog) {
+// accepted connections wait in a bounded queue for a circuit slot, once the queue is full
+// new connections are turned away with a destroy cell instead of piling up
+func (tn *TorNode) onionHandler(listener net.Listener) {
+	defer tn.wg.Done()
+	acceptQueue := make(chan net.Conn, tn.acceptQueueSize)
+	tn.goTracked(func() { tn.circuitDispatcher(acceptQueue) })
+
 	for {
-		fmt.Printf("TorNode: Waiting for new circuit connection...\n")
-		newCircuitConn, aerr := listener.AcceptTCP()
+		tn.logger.Printf("Waiting for new circuit connection...")
+		rawConn, aerr := listener.Accept()
 		if aerr != nil {
-			fmt.Printf("TorNode: WARNING could not accept an init onion connection: %s\n", aerr)
+			if isClosedConnErr(aerr) {
+				close(acceptQueue)
+				return
+			}
+			tn.logger.Printf("WARNING could not accept an init onion connection: %s", aerr)
+			continue
+		}
+		// the TLS handshake runs on the first read, under the handshake deadline
+		newCircuitConn, ok := tn.track(tls.Server(tn.listenTransport.Server(rawConn), tn.tlsConfig))
+		if !ok {
 			continue
 		}
-		fmt.Printf("TorNode: new circuit connection from %s! kicking off circuit handler...\n", newCircuitConn.RemoteAddr())
-		go handleNewCircuitConn(newCircuitConn, privateKey, timeoutMillis, vecLogger)
+		select {
+		case acceptQueue <- newCircuitConn:
+			tn.logger.Printf("new circuit connection from %s! queued for circuit handler...", newCircuitConn.RemoteAddr())
+		default:
+			tn.logger.Printf("WARNING overloaded, rejecting circuit connection from %s", newCircuitConn.RemoteAddr())
+			tn.rejectOverloaded(newCircuitConn)
+		}
 	}
 }
 
-func handleNewCircuitConn(newCircuitConn *net.TCPConn, privateKey *rsa.PrivateKey, timeoutMillis int, vecLogger *govec.GoLog) {
-	rawBytes, rerr := utils.TCPRead(newCircuitConn, vecLogger, "Received new onion")
+// the listener was closed, the node is shutting down
+func isClosedConnErr(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
 
-	if rerr != nil {
-		fmt.Printf("TorNode: WARNING read from connection error: %s\n", rerr)
-		return
+// hands queued connections to circuit handlers, at most len(circuitSlots) at a time
+func (tn *TorNode) circuitDispatcher(acceptQueue <-chan net.Conn) {
+	for conn := range acceptQueue {
+		select {
+		case tn.circuitSlots <- struct{}{}:
+		case <-tn.stopping:
+			conn.Close()
+			continue
+		}
+		conn := conn
+		tn.goTracked(func() {
+			defer func() { <-tn.circuitSlots }()
+			tn.handleNewCircuitConn(conn)
+		})
 	}
+}
 
-	fmt.Printf("TorNode: Received new onion of %d bytes\n", len(rawBytes))
+// sends a destroy for at most len(rejectSlots) connections at a time, peers that don't
+// read it are given up on after the node's timeout. Past that the connection is closed
+// without a word, so a flood of connections costs no more than the slots.
+func (tn *TorNode) rejectOverloaded(conn net.Conn) {
+	select {
+	case tn.rejectSlots <- struct{}{}:
+		tn.goTracked(func() {
+			defer func() { <-tn.rejectSlots }()
+			tn.rejectCircuit(conn, utils.ReasonOverloaded)
+		})
+	default:
+		tn.metrics.circuitRejected()
+		conn.Close()
+	}
+}
+
+func (tn *TorNode) rejectCircuit(conn net.Conn, reason utils.DestroyReason) {
+	defer conn.Close()
+	tn.metrics.circuitRejected()
+	// the TLS handshake under the destroy reads from the peer too
+	if derr := conn.SetDeadline(time.Now().Add(time.Duration(tn.timeoutMillis) * time.Millisecond)); derr != nil {
+		tn.logger.Printf("WARNING failed to set deadline: %s", derr)
+		return
+	}
+	tn.sendDestroy(conn, reason)
+}
 
-	nextHop, symmKey, payload, peelerr := peelOnion(rawBytes, privateKey)
+// destroy cell without a payload, for hops that don't share a key with the client:
+// the next hop, or a previous hop we could not peel the onion of
+func (tn *TorNode) sendDestroy(to net.Conn, reason utils.DestroyReason) {
+	_, werr := utils.WriteDestroy(to, reason, tn.vecLogger, "Circuit destroyed")
+	if werr != nil {
+		tn.logger.Printf("WARNING failed to send destroy to %s: %s", to.RemoteAddr(), werr)
+	}
+}
 
-	if peelerr != nil {
-		fmt.Printf("TorNode: WARNING error when peeling onion: %s\n", peelerr)
+// tears the circuit down towards the client, reporting the failure with our circuit key
+func (tn *TorNode) destroyBack(to net.Conn, symmKey []byte, info utils.DestroyInfo) {
+	raw, merr := utils.Marshall(info)
+	if merr != nil {
+		tn.logger.Printf("WARNING could not marshal destroy info: %s", merr)
+		tn.sendDestroy(to, info.Reason)
 		return
 	}
+	tn.forwardDestroyBack(to, symmKey, info.Reason, raw)
+}
 
-	fmt.Printf("TorNode: Onion Peel successful\n")
+// wraps the payload of a destroy cell going back to the client like a response frame
+func (tn *TorNode) forwardDestroyBack(to net.Conn, symmKey []byte, reason utils.DestroyReason, payload []byte) {
+	wrapped, oerr := wrapOnion(payload, symmKey, nil)
+	if oerr != nil {
+		tn.logger.Printf("WARNING could not wrap destroy: %s", oerr)
+		wrapped = nil
+	}
+	cell := utils.Cell{Command: utils.CellDestroy, Reason: reason, Payload: wrapped}
+	_, werr := utils.WriteCell(to, cell, tn.vecLogger, "Destroy sent to previous hop")
+	if werr != nil {
+		tn.logger.Printf("WARNING failed to send destroy to %s: %s", to.RemoteAddr(), werr)
+	}
+}
 
-	// todo next: set up conn to next hop, kick off reverse forwarding thread
-	laddr, laddrerr := net.ResolveTCPAddr("tcp", ":0")
-	raddr, raddrerr := net.ResolveTCPAddr("tcp", nextHop)
-	if laddrerr != nil || raddrerr != nil {
-		fmt.Printf("TorNode: WARNING error resolving tcp addr: %s, %s\n", laddrerr, raddrerr)
+func (tn *TorNode) handleNewCircuitConn(newCircuitConn net.Conn) {
+	tn.metrics.circuitOpened()
+	defer tn.metrics.circuitClosed()
+
+	onion, reason := tn.handshake(newCircuitConn)
+	if reason == utils.ReasonIntegrity {
+		// the key may be tampered with too, the client tells by whether it can read this
+		tn.destroyBack(newCircuitConn, onion.SymmKey, utils.DestroyInfo{Reason: reason})
+		newCircuitConn.Close()
 		return
 	}
-	nextHopConn, dialerr := net.DialTCP("tcp", laddr, raddr)
+	if onion == nil {
+		if reason != utils.ReasonNone {
+			tn.sendDestroy(newCircuitConn, reason)
+		}
+		newCircuitConn.Close()
+		return
+	}
+	nextHop, symmKey, payload := onion.NextIpPort, onion.SymmKey, onion.Payload
+
+	if onion.Cover {
+		tn.metrics.coverOnionDropped()
+		tn.dropCoverOnion(newCircuitConn, symmKey)
+		return
+	}
+	if onion.Service != nil {
+		tn.handleServiceCell(newCircuitConn, symmKey, onion.Service)
+		return
+	}
+
+	// the client's deadline replaces our own timeout, less a margin for the hops before us
+	deadline := utils.GiveUpAt(onion.Deadline)
+	dialTimeout := time.Duration(tn.timeoutMillis) * time.Millisecond
+	if !deadline.IsZero() {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			tn.metrics.timedOut()
+			tn.logger.Printf("WARNING request deadline passed before the circuit was extended")
+			tn.destroyBack(newCircuitConn, symmKey, utils.DestroyInfo{Reason: utils.ReasonTimeout})
+			newCircuitConn.Close()
+			return
+		}
+		if remaining < dialTimeout {
+			dialTimeout = remaining
+		}
+	}
+
+	// set up conn to next hop over the transport configured for it, kick off reverse forwarding thread
+	nextHopConn, dialerr := tn.links.Dial(nextHop, onion.NextFingerprint, dialTimeout)
+	if dialerr == nil {
+		var ok bool
+		if nextHopConn, ok = tn.track(nextHopConn); !ok {
+			newCircuitConn.Close()
+			return
+		}
+	}
 	if dialerr != nil {
-		fmt.Printf("TorNode: WARNING error dialing next hop: %s\n", dialerr)
+		tn.metrics.dialFailed()
+		tn.logger.Printf("WARNING error dialing next hop: %s", dialerr)
+		tn.destroyBack(newCircuitConn, symmKey, utils.DestroyInfo{Reason: utils.ReasonUnreachable, NextHop: true})
+		newCircuitConn.Close()
+		return
+	}
+	forwardStart := time.Now()
+	if !tn.forwardNextHelper(nextHopConn, payload) {
+		tn.destroyBack(newCircuitConn, symmKey, utils.DestroyInfo{Reason: utils.ReasonConnectionClosed, NextHop: true})
+		newCircuitConn.Close()
+		nextHopConn.Close()
 		return
 	}
-	forwardNextHelper(nextHopConn, payload, vecLogger)
-	forwardBackHelper(nextHopConn, newCircuitConn, symmKey, timeoutMillis, vecLogger)
+
+	c := &circuit{
+		prevHop:     newCircuitConn,
+		nextHop:     nextHopConn,
+		symmKey:     symmKey,
+		deadline:    deadline,
+		window:      utils.NewSendWindow(tn.flowControl),
+		backDigest:  utils.NewRunningDigest(symmKey),
+		fwdDigest:   utils.NewRunningDigest(symmKey),
+		controlDone: make(chan struct{}),
+		finished:    make(chan struct{}),
+	}
+	tn.goTracked(func() { tn.forwardControlHelper(c) })
+	tn.forwardBackHelper(c, forwardStart)
 }
 
-func forwardNextHelper(to *net.TCPConn, payload []byte, vecLogger *govec.GoLog) {
-	_, err := utils.TCPWrite(to, payload, vecLogger, "New onion forwarded to next hop")
-	if err != nil {
-		fmt.Printf("TorNode: WARNING forward onion to next hop: %s\n", err)
+// read and peel the onion that opens a circuit, at most len(handshakeSlots) at a time
+// since decrypting onions is what costs a relay the most CPU. Returns a nil onion and
+// the reason to destroy the circuit with on failure, or the suspect onion along with
+// ReasonIntegrity. Once the node is stopping, closes conn and returns ReasonNone.
+func (tn *TorNode) handshake(conn net.Conn) (*utils.Onion, utils.DestroyReason) {
+	select {
+	case tn.handshakeSlots <- struct{}{}:
+	case <-tn.stopping:
+		conn.Close()
+		return nil, utils.ReasonNone
+	}
+	defer func() { <-tn.handshakeSlots }()
+
+	derr := conn.SetReadDeadline(time.Now().Add(time.Duration(tn.timeoutMillis) * time.Millisecond))
+	if derr != nil {
+		tn.logger.Printf("WARNING failed to set read deadline: %s", derr)
+		return nil, utils.ReasonConnectionClosed
+	}
+	cell, rerr := utils.ReadCell(conn, tn.vecLogger, "Received new onion")
+
+	if dpassederr, ok := rerr.(net.Error); ok && dpassederr.Timeout() {
+		tn.metrics.timedOut()
+		tn.logger.Printf("WARNING waiting onion from %s timeout.", conn.RemoteAddr())
+		return nil, utils.ReasonTimeout
+	}
+
+	if rerr != nil {
+		tn.logger.Printf("WARNING read from connection error: %s", rerr)
+		return nil, utils.ReasonProtocol
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if cell.Command != utils.CellData {
+		tn.logger.Printf("WARNING expected an onion, received cell command %d", cell.Command)
+		return nil, utils.ReasonProtocol
+	}
+	rawBytes := cell.Payload
+
+	tn.logger.Printf("Received new onion of %d bytes", len(rawBytes))
+	tn.metrics.forwarded(len(rawBytes))
+
+	peelStart := time.Now()
+	onion, peelerr := peelOnion(rawBytes, tn.PrivateKey)
+
+	if _, ok := peelerr.(integrityError); ok {
+		tn.metrics.integrityFailed()
+		tn.logger.Printf("WARNING onion from %s failed integrity check, tearing down circuit", conn.RemoteAddr())
+		return onion, utils.ReasonIntegrity
+	}
+	if peelerr != nil {
+		reason := utils.ReasonProtocol
+		if _, ok := peelerr.(decryptError); ok {
+			tn.metrics.decryptFailed()
+			reason = utils.ReasonDecryptFailed
+		} else {
+			tn.metrics.peelFailed()
+		}
+		tn.logger.Printf("WARNING error when peeling onion: %s", peelerr)
+		return nil, reason
+	}
+
+	tn.metrics.onionPeeled(time.Since(peelStart))
+	tn.logger.Printf("Onion Peel successful")
+	return onion, utils.ReasonNone
+}
+
+// we are the last relay of a cover circuit: drop the onion, answer with padding so
+// the previous hops see an ordinary response
+func (tn *TorNode) dropCoverOnion(conn net.Conn, symmKey []byte) {
+	defer conn.Close()
+
+	frames, oerr := coverResponse(symmKey)
+	if oerr != nil {
+		tn.logger.Printf("WARNING could not wrap cover response: %s", oerr)
 		return
 	}
-	fmt.Printf("TorNode: Successfully fowarded onion, next hop: %s, payload size: %d\n", to.RemoteAddr(), len(payload))
+	var werr error
+	for _, frame := range frames {
+		if _, werr = utils.WriteData(conn, frame, tn.vecLogger, "Cover onion dropped"); werr != nil {
+			break
+		}
+	}
+	if werr == nil {
+		_, werr = utils.WriteEnd(conn, tn.vecLogger, "Cover onion response end")
+	}
+	if werr != nil {
+		tn.logger.Printf("WARNING failed to answer cover onion: %s", werr)
+	}
+}
+
+func (tn *TorNode) forwardNextHelper(to net.Conn, payload []byte) bool {
+	_, err := utils.WriteData(to, payload, tn.vecLogger, "New onion forwarded to next hop")
+	if err != nil {
+		tn.logger.Printf("WARNING forward onion to next hop: %s", err)
+		return false
+	}
+	tn.logger.Printf("Successfully fowarded onion, next hop: %s, payload size: %d", to.RemoteAddr(), len(payload))
+	return true
+}
+
+// one circuit relayed by this node
+type circuit struct {
+	prevHop     net.Conn
+	nextHop     net.Conn
+	symmKey     []byte
+	deadline    time.Time            // we give up on the request then, zero to wait timeoutMillis per frame instead
+	window      *utils.SendWindow    // backward cells we may still send to the previous hop
+	backDigest  *utils.RunningDigest // of every frame sent back, checked by the client
+	fwdDigest   *utils.RunningDigest // of every frame the client sends once the circuit is up
+	controlDone chan struct{}        // closed once the previous hop stops sending cells
+	finished    chan struct{}        // closed once the backward direction is done, the previous hop may hang up now
+}
+
+// after the end marker the previous hop may still have sendmes in flight, closing on
+// them would reset the connection before it reads the end. Wait for it to hang up first.
+func (tn *TorNode) drainPrevHop(c *circuit) {
+	utils.CloseWrite(c.prevHop)
+	select {
+	case <-c.controlDone:
+	case <-time.After(time.Duration(tn.timeoutMillis) * time.Millisecond):
+	}
+}
+
+// relays the cells the previous hop sends once the circuit is up: sendmes open our
+// window and move on to the next hop, frames are peeled and passed on like the onion
+// was, an end or a destroy is passed on
+func (tn *TorNode) forwardControlHelper(c *circuit) {
+	defer close(c.controlDone)
+	from, to, window := c.prevHop, c.nextHop, c.window
+	for {
+		cell, rerr := utils.ReadCell(from, tn.vecLogger, "Control cell received")
+		if rerr != nil {
+			select {
+			case <-c.finished:
+				// the circuit is closing
+			default:
+				// the previous hop went away mid-circuit, tear down the rest of it
+				tn.logger.Printf("WARNING previous hop %s closed the circuit: %s", from.RemoteAddr(), rerr)
+				tn.sendDestroy(to, utils.ReasonConnectionClosed)
+				to.Close()
+			}
+			return
+		}
+
+		switch cell.Command {
+		case utils.CellSendme:
+			window.Ack(cell.StreamID)
+			_, werr := utils.WriteCell(to, *cell, tn.vecLogger, "Sendme forwarded to next hop")
+			if werr != nil {
+				tn.logger.Printf("WARNING failed to forward sendme to next hop: %s", werr)
+				return
+			}
+		case utils.CellData:
+			payload, perr := peelFrame(cell.Payload, c.symmKey, c.fwdDigest)
+			if perr != nil {
+				tn.metrics.integrityFailed()
+				tn.logger.Printf("WARNING frame from %s failed integrity check, tearing down circuit", from.RemoteAddr())
+				tn.sendDestroy(to, utils.ReasonIntegrity)
+				to.Close()
+				return
+			}
+			forward := utils.Cell{Command: utils.CellData, StreamID: cell.StreamID, Payload: payload}
+			tn.metrics.forwarded(len(forward.Payload))
+			_, werr := utils.WriteCell(to, forward, tn.vecLogger, "Frame forwarded to next hop")
+			if werr != nil {
+				tn.logger.Printf("WARNING failed to forward frame to next hop: %s", werr)
+				return
+			}
+		case utils.CellEnd:
+			_, werr := utils.WriteCell(to, *cell, tn.vecLogger, "End forwarded to next hop")
+			if werr != nil {
+				tn.logger.Printf("WARNING failed to forward end to next hop: %s", werr)
+				return
+			}
+		case utils.CellDestroy:
+			tn.logger.Printf("circuit destroyed by %s: %s", from.RemoteAddr(), cell.Reason)
+			utils.WriteCell(to, *cell, tn.vecLogger, "Destroy forwarded to next hop")
+			to.Close()
+			return
+		default:
+			tn.logger.Printf("WARNING ignoring cell command %d from previous hop", cell.Command)
+		}
+	}
 }
 
 // NOTE: assuming forwarding from Tn+1 to Tn-1
-// Note: assuming response data only sent once
-func forwardBackHelper(from *net.TCPConn, to *net.TCPConn, symmKey []byte, timeoutMillis int, vecLogger *govec.GoLog) {
+// relays response frames, each wrapped with our key, until the next hop sends an end
+// marker or closes the connection. Stops reading from the next hop while the window is used up.
+func (tn *TorNode) forwardBackHelper(c *circuit, forwardStart time.Time) {
+	from, to, symmKey, window := c.nextHop, c.prevHop, c.symmKey, c.window
 	defer func() {
+		// any teardown has been sent both ways by now
+		select {
+		case <-c.finished:
+		default:
+			close(c.finished)
+		}
+		window.Close()
 		from.Close()
 		to.Close()
-		fmt.Printf("TorNode: connection to previous hop: %s, and next hop %s are closed\n", to.RemoteAddr(), from.RemoteAddr())
+		tn.logger.Printf("connection to previous hop: %s, and next hop %s are closed", to.RemoteAddr(), from.RemoteAddr())
 	}()
 
-	derr := from.SetReadDeadline(time.Now().Add(time.Duration(timeoutMillis) * time.Millisecond))
-	if derr != nil {
-		fmt.Printf("TorNode: WARNING failed to set read deadline: %s\n", derr)
-		return
-	}
-	fmt.Printf("TorNode: Wating response from nextHop: %s\n", from.RemoteAddr())
-	payload, rerr := utils.TCPRead(from, vecLogger, "Response onion received")
+	for frames := 0; ; frames++ {
+		readDeadline := c.deadline
+		if readDeadline.IsZero() {
+			readDeadline = time.Now().Add(time.Duration(tn.timeoutMillis) * time.Millisecond)
+		}
+		derr := from.SetReadDeadline(readDeadline)
+		if derr != nil {
+			tn.logger.Printf("WARNING failed to set read deadline: %s", derr)
+			return
+		}
+		tn.logger.Printf("Wating response from nextHop: %s", from.RemoteAddr())
+		cell, rerr := utils.ReadCell(from, tn.vecLogger, "Response onion received")
 
-	if dpassederr, ok := rerr.(net.Error); ok && dpassederr.Timeout() {
-		fmt.Printf("TorNode: WARNING waiting data from %s timeout.\n", from.RemoteAddr())
-		return
-	}
+		if dpassederr, ok := rerr.(net.Error); ok && dpassederr.Timeout() {
+			tn.metrics.timedOut()
+			if c.deadline.IsZero() {
+				tn.logger.Printf("WARNING waiting data from %s timeout.", from.RemoteAddr())
+			} else {
+				tn.logger.Printf("WARNING request deadline passed waiting for data from %s", from.RemoteAddr())
+			}
+			tn.sendDestroy(from, utils.ReasonTimeout)
+			tn.destroyBack(to, symmKey, utils.DestroyInfo{Reason: utils.ReasonTimeout, NextHop: true})
+			return
+		}
 
-	if rerr == io.EOF {
-		fmt.Printf("TorNode: Failed to forward response back: unexpected remote connection from [%s] closed\n", from.RemoteAddr())
-		return
-	}
+		if rerr == io.EOF {
+			if frames == 0 {
+				tn.logger.Printf("Failed to forward response back: unexpected remote connection from [%s] closed", from.RemoteAddr())
+				tn.destroyBack(to, symmKey, utils.DestroyInfo{Reason: utils.ReasonConnectionClosed, NextHop: true})
+				return
+			}
+			// the next hop closing after some frames ends the stream just like an end marker
+			cell = &utils.Cell{Command: utils.CellEnd}
+		} else if rerr != nil {
+			tn.logger.Printf("WARNING failed to read from connection: %s", rerr)
+			tn.destroyBack(to, symmKey, utils.DestroyInfo{Reason: utils.ReasonConnectionClosed, NextHop: true})
+			return
+		}
 
-	if rerr != nil {
-		fmt.Printf("TorNode: WARNING failed to read from connection: %s\n", rerr)
-		return
+		switch cell.Command {
+		case utils.CellDestroy:
+			tn.logger.Printf("circuit destroyed by %s: %s", from.RemoteAddr(), cell.Reason)
+			if len(cell.Payload) == 0 {
+				// the next hop could not report it to the client itself
+				tn.destroyBack(to, symmKey, utils.DestroyInfo{Reason: cell.Reason, NextHop: true})
+			} else {
+				tn.forwardDestroyBack(to, symmKey, cell.Reason, cell.Payload)
+			}
+			return
+		case utils.CellEnd:
+			_, werr := utils.WriteEnd(to, tn.vecLogger, "Response end forwarded to previous hop")
+			if werr != nil {
+				tn.logger.Printf("WARNING failed to forward end of response to previous hop: %s", werr)
+			}
+			tn.logger.Printf("Response of %d frames fowarded from %s BACK to %s", frames, from.RemoteAddr(), to.RemoteAddr())
+			close(c.finished)
+			tn.drainPrevHop(c)
+			return
+		case utils.CellData:
+		default:
+			tn.logger.Printf("WARNING unexpected cell command %d from next hop", cell.Command)
+			tn.sendDestroy(from, utils.ReasonProtocol)
+			tn.destroyBack(to, symmKey, utils.DestroyInfo{Reason: utils.ReasonProtocol, NextHop: true})
+			return
+		}
+
+		if frames == 0 {
+			tn.metrics.nextHopResponded(time.Since(forwardStart))
+		}
+		stalled, werr := window.Acquire(cell.StreamID)
+		if stalled > 0 {
+			tn.metrics.flowControlStalled(stalled)
+		}
+		if werr != nil {
+			return
+		}
+		if !tn.forwardFrameBack(c, cell.StreamID, cell.Payload) {
+			tn.sendDestroy(from, utils.ReasonConnectionClosed)
+			return
+		}
 	}
+}
 
-	forwardPayload, oerr := wrapOnion(payload, symmKey)
+// wraps a response frame with our key and our running digest of everything sent back so far
+func (tn *TorNode) forwardFrameBack(c *circuit, streamID uint16, payload []byte) bool {
+	to := c.prevHop
+	tn.metrics.forwardedBack(len(payload))
+
+	forwardPayload, oerr := wrapOnion(payload, c.symmKey, c.backDigest.Add(payload))
 
 	if oerr != nil {
-		fmt.Printf("TorNode: WARNING could not wrap onion: %s\n", oerr)
-		return
+		tn.logger.Printf("WARNING could not wrap onion: %s", oerr)
+		return false
 	}
 
-	_, werr := utils.TCPWrite(to, forwardPayload, vecLogger, "Response onion forwarded to previous hop")
+	cell := utils.Cell{Command: utils.CellData, StreamID: streamID, Payload: forwardPayload}
+	_, werr := utils.WriteCell(to, cell, tn.vecLogger, "Response onion forwarded to previous hop")
 	if werr != nil {
-		fmt.Printf("TorNode: WARNING failed to forward previous hop: %s\n", werr)
-		return
+		tn.logger.Printf("WARNING failed to forward previous hop: %s", werr)
+		return false
 	}
-	fmt.Printf("TorNode: Successfully fowarded onion from %s BACK to %s, payload size: %d\n", from.RemoteAddr(), to.RemoteAddr(), len(payload))
+	tn.logger.Printf("Successfully fowarded onion BACK to %s, payload size: %d", to.RemoteAddr(), len(payload))
+	return true
 }
@@ -2,30 +2,32 @@ package tornode
 
 import (
 	"crypto/rsa"
-	"net"
+	"log"
+	"os"
+	"time"
 
 	"github.com/DistributedClocks/GoVector/govec"
 
+	"../../keyLibrary"
 	"../../utils"
 )
 
-func contactDS(dsIPPort string, TorIPPort string, fdlibIPPort string, pubKey *rsa.PublicKey, vecLogger *govec.GoLog) (bool, error) {
-	var laddr, raddr *net.TCPAddr
-	var addrErr error
-	laddr, addrErr = net.ResolveTCPAddr("tcp", ":0")
-	raddr, addrErr = net.ResolveTCPAddr("tcp", dsIPPort)
-	if addrErr != nil {
-		return false, addrErr
-	}
-	conn, connErr := net.DialTCP("tcp", laddr, raddr)
+// joins the network over a TLS link to the DS, presenting our identity key so the DS can
+// check it matches the key we register. exit tells the DS to hand us out as an exit to
+// the ports in exitPorts.
+func contactDS(dsIPPort string, dsPublicKey *rsa.PublicKey, TorIPPort string, fdlibIPPort string, exit bool, exitPorts utils.ExitPorts, privateKey *rsa.PrivateKey, timeoutMillis int, vecLogger *govec.GoLog) (bool, error) {
+	conn, connErr := utils.DialTLS(dsIPPort, keyLibrary.KeyFingerprint(dsPublicKey), privateKey, time.Duration(timeoutMillis)*time.Millisecond)
 	if connErr != nil {
 		return false, connErr
 	}
+	defer conn.Close()
 
 	request := utils.NetworkJoinRequest{
 		TorIpPort:   TorIPPort,
 		FdlibIpPort: fdlibIPPort,
-		PubKey:      *pubKey,
+		PubKey:      privateKey.PublicKey,
+		Exit:        exit,
+		ExitPorts:   exitPorts,
 	}
 	payload, merr := utils.Marshall(request)
 	if merr != nil {
@@ -46,3 +48,66 @@ func contactDS(dsIPPort string, TorIPPort string, fdlibIPPort string, pubKey *rs
 	}
 	return response.Status, nil
 }
+
+// asks the DS port for tor clients for relays to pick cover circuits from, the way a
+// client asks for relays to build circuits with
+func (tn *TorNode) fetchCoverRelays() (map[string]rsa.PublicKey, error) {
+	timeout := time.Duration(tn.timeoutMillis) * time.Millisecond
+	conn, connErr := utils.DialTLS(tn.options.Config.DSClientIPPort, keyLibrary.KeyFingerprint(tn.dsPublicKey), nil, timeout)
+	if connErr != nil {
+		return nil, connErr
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	request := utils.DsRequest{NumNodes: coverDirectorySize, SymmKey: keyLibrary.GenerateSymmKey()}
+	payload, merr := utils.Marshall(request)
+	if merr != nil {
+		return nil, merr
+	}
+	encrypted, eerr := keyLibrary.PubKeyEncrypt(tn.dsPublicKey, payload)
+	if eerr != nil {
+		return nil, eerr
+	}
+	_, werr := utils.TCPWrite(conn, encrypted, tn.vecLogger, "Asking DS for cover relays")
+	if werr != nil {
+		return nil, werr
+	}
+	responsePayload, rerr := utils.TCPRead(conn, tn.vecLogger, "Received cover relays from DS")
+	if rerr != nil {
+		return nil, rerr
+	}
+	decrypted, derr := keyLibrary.SymmKeyDecryptBase64(responsePayload, request.SymmKey)
+	if derr != nil {
+		return nil, derr
+	}
+	var response utils.DsResponse
+	umerr := utils.UnMarshall(decrypted, &response)
+	if umerr != nil {
+		return nil, umerr
+	}
+	return response.DnMap, nil
+}
+
+// the identity key is kept in keyPath once there is one, so the node keeps its
+// fingerprint. Without a path every start makes a new key.
+func loadIdentityKey(keyPath string, logger *log.Logger) (*rsa.PrivateKey, error) {
+	if keyPath == "" {
+		return keyLibrary.GeneratePrivPubKey()
+	}
+	if _, statErr := os.Stat(keyPath); statErr == nil {
+		return keyLibrary.LoadPrivateKey(keyPath)
+	}
+
+	privateKey, pkerror := keyLibrary.GeneratePrivPubKey()
+	if pkerror != nil {
+		return nil, pkerror
+	}
+	saveErr := keyLibrary.SavePrivateKeyOnDisk(keyPath, privateKey)
+	if saveErr != nil {
+		return nil, saveErr
+	}
+	os.Chmod(keyPath, 0600)
+	logger.Printf("Saved new identity key to %s", keyPath)
+	return privateKey, nil
+}
@@ -0,0 +1,70 @@
+package tornode
+
+import (
+	"net"
+	"sync"
+
+	"../../utils"
+)
+
+// trackedConn is a link of a circuit we relay, Stop closes whatever is still open
+type trackedConn struct {
+	net.Conn
+	tn        *TorNode
+	closeOnce sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		c.tn.connsMu.Lock()
+		delete(c.tn.conns, c)
+		c.tn.connsMu.Unlock()
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+func (c *trackedConn) CloseWrite() error {
+	return utils.CloseWrite(c.Conn)
+}
+
+// track registers a new link so Stop can close it. Once the node is stopping the link
+// is closed right away, and false returned.
+func (tn *TorNode) track(conn net.Conn) (net.Conn, bool) {
+	tn.connsMu.Lock()
+	defer tn.connsMu.Unlock()
+	select {
+	case <-tn.stopping:
+		conn.Close()
+		return nil, false
+	default:
+	}
+	tracked := &trackedConn{Conn: conn, tn: tn}
+	tn.conns[tracked] = struct{}{}
+	return tracked, true
+}
+
+// closing the links makes every goroutine relaying a circuit tear it down and return
+func (tn *TorNode) closeConns() {
+	tn.connsMu.Lock()
+	conns := make([]*trackedConn, 0, len(tn.conns))
+	for conn := range tn.conns {
+		conns = append(conns, conn)
+	}
+	tn.connsMu.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// goTracked runs f as part of the node, Stop waits for it to return. Only called from
+// goroutines Stop already waits for, so the count never drops to zero in between.
+func (tn *TorNode) goTracked(f func()) {
+	tn.wg.Add(1)
+	go func() {
+		defer tn.wg.Done()
+		f()
+	}()
+}
@@ -0,0 +1,228 @@
+package tornode
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upper bounds of the latency histogram buckets, in seconds
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// Metrics counts what a tor node relays. It is safe for concurrent use.
+type Metrics struct {
+	activeCircuits      int64
+	circuitsRejected    uint64
+	onionsPeeled        uint64
+	coverOnionsDropped  uint64
+	bytesForward        uint64
+	bytesBackward       uint64
+	peelFailures        uint64
+	decryptFailures     uint64
+	integrityFailures   uint64
+	nextHopDialFailures uint64
+	timeouts            uint64
+	peelLatency         *histogram
+	nextHopLatency      *histogram
+	flowControlStalls   *histogram
+}
+
+// MetricsSnapshot is a point in time copy of a node's metrics
+type MetricsSnapshot struct {
+	ActiveCircuits      int64
+	CircuitsRejected    uint64 // turned away because the node was overloaded
+	OnionsPeeled        uint64
+	CoverOnionsDropped  uint64
+	BytesForward        uint64 // onion bytes received from previous hops
+	BytesBackward       uint64 // response bytes received from next hops
+	PeelFailures        uint64
+	DecryptFailures     uint64
+	IntegrityFailures   uint64
+	NextHopDialFailures uint64
+	Timeouts            uint64
+	PeelLatency         HistogramSnapshot // time to peel one onion layer
+	NextHopLatency      HistogramSnapshot // time from forwarding an onion to its response
+	FlowControlStalls   HistogramSnapshot // time spent waiting for a sendme with the window used up
+}
+
+type HistogramSnapshot struct {
+	Buckets []float64 // upper bounds in seconds
+	Counts  []uint64  // cumulative count for each bucket
+	Count   uint64
+	Sum     float64 // seconds
+}
+
+type histogram struct {
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		peelLatency:       &histogram{counts: make([]uint64, len(latencyBuckets))},
+		nextHopLatency:    &histogram{counts: make([]uint64, len(latencyBuckets))},
+		flowControlStalls: &histogram{counts: make([]uint64, len(latencyBuckets))},
+	}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+func (h *histogram) snapshot() HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	counts := make([]uint64, len(h.counts))
+	copy(counts, h.counts)
+	return HistogramSnapshot{latencyBuckets, counts, h.count, h.sum}
+}
+
+func (m *Metrics) circuitOpened() {
+	atomic.AddInt64(&m.activeCircuits, 1)
+}
+
+func (m *Metrics) circuitClosed() {
+	atomic.AddInt64(&m.activeCircuits, -1)
+}
+
+func (m *Metrics) circuitRejected() {
+	atomic.AddUint64(&m.circuitsRejected, 1)
+}
+
+func (m *Metrics) onionPeeled(d time.Duration) {
+	atomic.AddUint64(&m.onionsPeeled, 1)
+	m.peelLatency.observe(d)
+}
+
+func (m *Metrics) coverOnionDropped() {
+	atomic.AddUint64(&m.coverOnionsDropped, 1)
+}
+
+func (m *Metrics) forwarded(n int) {
+	atomic.AddUint64(&m.bytesForward, uint64(n))
+}
+
+func (m *Metrics) forwardedBack(n int) {
+	atomic.AddUint64(&m.bytesBackward, uint64(n))
+}
+
+func (m *Metrics) peelFailed() {
+	atomic.AddUint64(&m.peelFailures, 1)
+}
+
+func (m *Metrics) decryptFailed() {
+	atomic.AddUint64(&m.decryptFailures, 1)
+}
+
+func (m *Metrics) integrityFailed() {
+	atomic.AddUint64(&m.integrityFailures, 1)
+}
+
+func (m *Metrics) dialFailed() {
+	atomic.AddUint64(&m.nextHopDialFailures, 1)
+}
+
+func (m *Metrics) timedOut() {
+	atomic.AddUint64(&m.timeouts, 1)
+}
+
+func (m *Metrics) nextHopResponded(d time.Duration) {
+	m.nextHopLatency.observe(d)
+}
+
+func (m *Metrics) flowControlStalled(d time.Duration) {
+	m.flowControlStalls.observe(d)
+}
+
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	return MetricsSnapshot{
+		ActiveCircuits:      atomic.LoadInt64(&m.activeCircuits),
+		CircuitsRejected:    atomic.LoadUint64(&m.circuitsRejected),
+		OnionsPeeled:        atomic.LoadUint64(&m.onionsPeeled),
+		CoverOnionsDropped:  atomic.LoadUint64(&m.coverOnionsDropped),
+		BytesForward:        atomic.LoadUint64(&m.bytesForward),
+		BytesBackward:       atomic.LoadUint64(&m.bytesBackward),
+		PeelFailures:        atomic.LoadUint64(&m.peelFailures),
+		DecryptFailures:     atomic.LoadUint64(&m.decryptFailures),
+		IntegrityFailures:   atomic.LoadUint64(&m.integrityFailures),
+		NextHopDialFailures: atomic.LoadUint64(&m.nextHopDialFailures),
+		Timeouts:            atomic.LoadUint64(&m.timeouts),
+		PeelLatency:         m.peelLatency.snapshot(),
+		NextHopLatency:      m.nextHopLatency.snapshot(),
+		FlowControlStalls:   m.flowControlStalls.snapshot(),
+	}
+}
+
+// WritePrometheus writes the metrics in the prometheus text exposition format
+func (m *Metrics) WritePrometheus(w io.Writer) {
+	s := m.Snapshot()
+
+	writeMetric(w, "tornode_active_circuits", "gauge", "Circuits currently relayed by this node.", float64(s.ActiveCircuits))
+	writeMetric(w, "tornode_circuits_rejected_total", "counter", "Circuits rejected because the node was overloaded.", float64(s.CircuitsRejected))
+	writeMetric(w, "tornode_onions_peeled_total", "counter", "Onion layers peeled.", float64(s.OnionsPeeled))
+	writeMetric(w, "tornode_cover_onions_dropped_total", "counter", "Cover onions dropped as the last relay.", float64(s.CoverOnionsDropped))
+	fmt.Fprintf(w, "# HELP tornode_bytes_total Bytes received from neighbouring hops.\n")
+	fmt.Fprintf(w, "# TYPE tornode_bytes_total counter\n")
+	fmt.Fprintf(w, "tornode_bytes_total{direction=\"forward\"} %d\n", s.BytesForward)
+	fmt.Fprintf(w, "tornode_bytes_total{direction=\"backward\"} %d\n", s.BytesBackward)
+	writeMetric(w, "tornode_peel_failures_total", "counter", "Onions that could not be parsed after decryption.", float64(s.PeelFailures))
+	writeMetric(w, "tornode_decrypt_failures_total", "counter", "Onions that could not be decrypted with the node key.", float64(s.DecryptFailures))
+	writeMetric(w, "tornode_integrity_failures_total", "counter", "Onions that did not match their digest.", float64(s.IntegrityFailures))
+	writeMetric(w, "tornode_next_hop_dial_failures_total", "counter", "Failed connections to next hops.", float64(s.NextHopDialFailures))
+	writeMetric(w, "tornode_timeouts_total", "counter", "Next hops that did not respond in time.", float64(s.Timeouts))
+	writeHistogram(w, "tornode_peel_duration_seconds", "Time to peel one onion layer.", s.PeelLatency)
+	writeHistogram(w, "tornode_next_hop_response_seconds", "Time from forwarding an onion to the next hop response.", s.NextHopLatency)
+	writeHistogram(w, "tornode_flow_control_stall_seconds", "Time a circuit waited for a sendme with its window used up.", s.FlowControlStalls)
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WritePrometheus(w)
+}
+
+// serve metrics at http://metricsIPPort/metrics
+// serves the metrics endpoint until the returned server is closed
+func (m *Metrics) startServer(metricsIPPort string, logger *log.Logger) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	server := &http.Server{Addr: metricsIPPort, Handler: mux}
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			logger.Printf("WARNING metrics endpoint stopped: %s", err)
+		}
+	}()
+	return server
+}
+
+func writeMetric(w io.Writer, name string, kind string, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+	fmt.Fprintf(w, "%s %g\n", name, value)
+}
+
+func writeHistogram(w io.Writer, name string, help string, h HistogramSnapshot) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	for i, bound := range h.Buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, h.Counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.Count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.Sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, h.Count)
+}
@@ -1,33 +1,45 @@
 package tornode
 
 import (
+	"crypto/rand"
 	"crypto/rsa"
+	"encoding/base64"
+	"math"
+	mathrand "math/rand"
 
 	"../../keyLibrary"
 	"../../utils"
 )
 
+const (
+	// relays asked from the DS at once for cover circuits
+	coverDirectorySize = 32
+	// cover responses look like the data server's answers to values of up to this many bytes
+	coverValueMaxBytes = 4 * utils.RESPONSE_FRAME_SIZE
+)
+
 // peel one layer off of the onion to get payload
 // NOTE: assuming one-time circuit usage
-// returns next hop IPPort, symmKey assigned, next hop payload
-func peelOnion(onionBytes []byte, privateKey *rsa.PrivateKey) (string, []byte, []byte, error) {
+// returns the onion layer meant for this node: next hop IPPort, symmKey assigned, next hop payload
+func peelOnion(onionBytes []byte, privateKey *rsa.PrivateKey) (*utils.Onion, error) {
 	// TODO - marlon
 	onion, derr := decryptOnionBytes(onionBytes, privateKey)
 	if derr != nil {
-		return "", nil, nil, derr
+		return nil, derr
 	}
-	nextHop := onion.NextIpPort
-	symmKey := onion.SymmKey
-	payload := onion.Payload
-	return nextHop, symmKey, payload, nil
+	if !utils.VerifyLayerDigest(*onion) {
+		return onion, integrityError{}
+	}
+	return onion, nil
 }
 
-// wrap one layer of encryption
-func wrapOnion(onionPayload []byte, symmKey []byte) ([]byte, error) {
+// wrap one layer of encryption, digest is our running digest of the circuit or nil
+func wrapOnion(onionPayload []byte, symmKey []byte, digest []byte) ([]byte, error) {
 	onion := utils.Onion{
 		NextIpPort: "",
 		SymmKey:    nil,
 		Payload:    onionPayload,
+		Digest:     digest,
 	}
 	onionbytes, merr := utils.Marshall(onion)
 	if merr != nil {
@@ -36,6 +48,81 @@ func wrapOnion(onionPayload []byte, symmKey []byte) ([]byte, error) {
 	return keyLibrary.SymmKeyEncrypt(onionbytes, symmKey)
 }
 
+// peel our layer off a frame sent on an established circuit, checking it against our
+// running digest of the frames before it
+func peelFrame(frame []byte, symmKey []byte, digest *utils.RunningDigest) ([]byte, error) {
+	decrypted, derr := keyLibrary.SymmKeyDecrypt(frame, symmKey)
+	if derr != nil {
+		return nil, decryptError{derr}
+	}
+	var layer utils.Onion
+	umerr := utils.UnMarshall(decrypted, &layer)
+	if umerr != nil {
+		return nil, umerr
+	}
+	if !digest.Verify(layer.Payload, layer.Digest) {
+		return nil, integrityError{}
+	}
+	return layer.Payload, nil
+}
+
+// build the padding response for a cover onion: the frames the data server would send
+// back for a value of random length, each wrapped like any other response under our
+// running digest. Lengths are drawn log-uniformly, so most answers are one short frame
+// like most real ones, and some take several frames.
+func coverResponse(symmKey []byte) ([][]byte, error) {
+	length := int(math.Exp(mathrand.Float64()*math.Log(coverValueMaxBytes+1))) - 1
+	random := make([]byte, length)
+	rand.Read(random)
+	value := base64.RawURLEncoding.EncodeToString(random)[:length]
+
+	// the data server encrypts its frames with a key we don't have, any key will do
+	serverKey := keyLibrary.GenerateSymmKey()
+	serverDigest := utils.NewRunningDigest(serverKey)
+	digest := utils.NewRunningDigest(symmKey)
+	frames := [][]byte{}
+	for {
+		chunk := value
+		if len(chunk) > utils.RESPONSE_FRAME_SIZE {
+			chunk = chunk[:utils.RESPONSE_FRAME_SIZE]
+		}
+		value = value[len(chunk):]
+		padding, merr := utils.Marshall(utils.Response{Value: chunk, Digest: serverDigest.Add([]byte(chunk))})
+		if merr != nil {
+			return nil, merr
+		}
+		padding, eerr := keyLibrary.SymmKeyEncrypt(padding, serverKey)
+		if eerr != nil {
+			return nil, eerr
+		}
+		frame, werr := wrapOnion(padding, symmKey, digest.Add(padding))
+		if werr != nil {
+			return nil, werr
+		}
+		frames = append(frames, frame)
+		if value == "" {
+			return frames, nil
+		}
+	}
+}
+
+// the onion was not encrypted with our public key, or was tampered with
+type decryptError struct {
+	err error
+}
+
+func (e decryptError) Error() string {
+	return "could not decrypt onion: " + e.err.Error()
+}
+
+// the onion layer decrypted fine but does not match its digest, a previous hop
+// tampered with it
+type integrityError struct{}
+
+func (e integrityError) Error() string {
+	return "onion layer does not match its digest"
+}
+
 // decrypt received raw bytes into an onion
 func decryptOnionBytes(raw []byte, privateKey *rsa.PrivateKey) (*utils.Onion, error) {
 	decryptedBytes := make([]byte, 0)
@@ -47,7 +134,7 @@ func decryptOnionBytes(raw []byte, privateKey *rsa.PrivateKey) (*utils.Onion, er
 	for _, chunk := range encryptedChunks {
 		decryptedChunk, derr := keyLibrary.PrivKeyDecrypt(privateKey, chunk)
 		if derr != nil {
-			return nil, derr
+			return nil, decryptError{derr}
 		}
 		decryptedBytes = append(decryptedBytes, decryptedChunk...)
 	}
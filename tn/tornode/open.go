@@ -0,0 +1,185 @@
+package tornode
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"../../utils"
+)
+
+// the client built this circuit ahead of time. We hold it open with keepalives and pass
+// each request it sends on to the data server the request names, one at a time, so a
+// request only costs the client the data server's layer.
+func (tn *TorNode) serveOpenCircuit(ep *endpoint) {
+	defer ep.close()
+
+	if tn.sendServiceFrame(ep, utils.ServiceFrame{Command: utils.ServiceOpen}) != nil {
+		return
+	}
+	tn.logger.Printf("Open circuit ready for requests")
+
+	tn.readEndpoint(ep)
+	ticker := time.NewTicker(time.Duration(tn.timeoutMillis) * time.Millisecond / 2)
+	defer ticker.Stop()
+	for requests := 0; ; {
+		select {
+		case cell, ok := <-ep.cells:
+			if !ok || cell.Command == utils.CellDestroy || cell.Command == utils.CellEnd {
+				tn.logger.Printf("Open circuit closed after %d requests", requests)
+				return
+			}
+			// sendmes left over from the last response are of no use any more
+			if cell.Command != utils.CellData {
+				continue
+			}
+			payload, perr := peelFrame(cell.Payload, ep.symmKey, ep.fwdDigest)
+			var layer utils.Onion
+			if perr == nil {
+				perr = utils.UnMarshall(payload, &layer)
+			}
+			if perr != nil {
+				tn.metrics.integrityFailed()
+				tn.logger.Printf("WARNING request on open circuit failed integrity check, tearing down circuit")
+				tn.destroyEndpoint(ep, utils.ReasonIntegrity)
+				return
+			}
+			tn.metrics.forwarded(len(payload))
+			if !tn.forwardRequest(ep, &layer, ticker.C) {
+				return
+			}
+			requests++
+		case <-ticker.C:
+			if tn.sendServiceFrame(ep, utils.ServiceFrame{Command: utils.ServiceKeepalive}) != nil {
+				return
+			}
+		}
+	}
+}
+
+// sends the data server the request in layer and the response frames back, each in a
+// data frame of ours, then a done frame. Sendmes from the client go on to the data
+// server, and keepalives keep going out while it is slow. Returns false once the circuit
+// was torn down.
+func (tn *TorNode) forwardRequest(ep *endpoint, layer *utils.Onion, keepalive <-chan time.Time) bool {
+	deadline := utils.GiveUpAt(layer.Deadline)
+	timeout := time.Duration(tn.timeoutMillis) * time.Millisecond
+	if !deadline.IsZero() {
+		timeout = time.Until(deadline)
+	}
+	if timeout <= 0 {
+		tn.metrics.timedOut()
+		tn.logger.Printf("WARNING request deadline passed before it reached the open circuit")
+		tn.destroyEndpoint(ep, utils.ReasonTimeout)
+		return false
+	}
+
+	server, dialerr := tn.links.Dial(layer.NextIpPort, layer.NextFingerprint, timeout)
+	if dialerr == nil {
+		var ok bool
+		if server, ok = tn.track(server); !ok {
+			return false
+		}
+	}
+	if dialerr != nil {
+		tn.metrics.dialFailed()
+		tn.logger.Printf("WARNING error dialing data server: %s", dialerr)
+		tn.destroyBack(ep.conn, ep.symmKey, utils.DestroyInfo{Reason: utils.ReasonUnreachable, NextHop: true})
+		return false
+	}
+	defer server.Close()
+	forwardStart := time.Now()
+	if !tn.forwardNextHelper(server, layer.Payload) {
+		tn.destroyBack(ep.conn, ep.symmKey, utils.DestroyInfo{Reason: utils.ReasonConnectionClosed, NextHop: true})
+		return false
+	}
+
+	cells := make(chan *utils.Cell)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	tn.goTracked(func() { tn.readServer(server, deadline, cells, readErr, done) })
+	for frames := 0; ; {
+		select {
+		case cell, ok := <-ep.cells:
+			if !ok || cell.Command == utils.CellDestroy {
+				tn.sendDestroy(server, utils.ReasonConnectionClosed)
+				return false
+			}
+			if cell.Command == utils.CellSendme {
+				utils.WriteCell(server, *cell, tn.vecLogger, "Sendme forwarded to data server")
+			}
+		case cell := <-cells:
+			if frames == 0 {
+				tn.metrics.nextHopResponded(time.Since(forwardStart))
+			}
+			frames++
+			tn.metrics.forwardedBack(len(cell.Payload))
+			if tn.sendServiceFrame(ep, utils.ServiceFrame{Command: utils.ServiceData, Data: cell.Payload}) != nil {
+				return false
+			}
+		case err := <-readErr:
+			if err == io.EOF && frames > 0 {
+				tn.logger.Printf("Response of %d frames passed back on open circuit", frames)
+				return tn.sendServiceFrame(ep, utils.ServiceFrame{Command: utils.ServiceDone}) == nil
+			}
+			reason := utils.ReasonConnectionClosed
+			if destroyed, ok := err.(destroyedError); ok {
+				reason = destroyed.reason
+			} else if timeoutErr, ok := err.(net.Error); ok && timeoutErr.Timeout() {
+				tn.metrics.timedOut()
+				reason = utils.ReasonTimeout
+				tn.sendDestroy(server, reason)
+			}
+			tn.logger.Printf("WARNING request on open circuit failed: %s", err)
+			tn.destroyBack(ep.conn, ep.symmKey, utils.DestroyInfo{Reason: reason, NextHop: true})
+			return false
+		case <-keepalive:
+			if tn.sendServiceFrame(ep, utils.ServiceFrame{Command: utils.ServiceKeepalive}) != nil {
+				return false
+			}
+		}
+	}
+}
+
+// the data server tore the circuit down
+type destroyedError struct {
+	reason utils.DestroyReason
+}
+
+func (e destroyedError) Error() string {
+	return fmt.Sprintf("destroyed by data server: %s", e.reason)
+}
+
+// passes the data server's response frames to cells until the end, then io.EOF to
+// readErr. Gives up once done is closed.
+func (tn *TorNode) readServer(server net.Conn, deadline time.Time, cells chan<- *utils.Cell, readErr chan<- error, done <-chan struct{}) {
+	for {
+		readDeadline := deadline
+		if readDeadline.IsZero() {
+			readDeadline = time.Now().Add(time.Duration(tn.timeoutMillis) * time.Millisecond)
+		}
+		server.SetReadDeadline(readDeadline)
+		cell, rerr := utils.ReadCell(server, tn.vecLogger, "Response received on open circuit")
+		if rerr == nil {
+			switch cell.Command {
+			case utils.CellData:
+				select {
+				case cells <- cell:
+					continue
+				case <-done:
+					return
+				}
+			case utils.CellEnd:
+				rerr = io.EOF
+			case utils.CellDestroy:
+				rerr = destroyedError{cell.Reason}
+			default:
+				rerr = fmt.Errorf("unexpected cell command %d from data server", cell.Command)
+			}
+		}
+		readErr <- rerr
+		return
+	}
+}
@@ -0,0 +1,73 @@
+package tornode
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"time"
+
+	"../../cover"
+	"../../keyLibrary"
+	"../../utils"
+)
+
+const selfTestPayloadBytes = 64
+
+// reachabilityError is returned when a relay can't reach itself at the address it
+// would advertise through the DS
+type reachabilityError struct {
+	addr string
+	err  error
+}
+
+func (e reachabilityError) Error() string {
+	return fmt.Sprintf("relay is not reachable at advertised address %s: %s", e.addr, e.err)
+}
+
+// selfTest builds a one-hop cover circuit to ourselves through the advertised address.
+// Only this node can peel the onion, so a padding response that decrypts with the
+// circuit key proves the address leads back to this node and its onion handler works.
+func (tn *TorNode) selfTest(advertisedIPPort string, timeoutMillis int) error {
+	onion, symmKeys, onionErr := cover.CreateOnion(
+		[]string{advertisedIPPort},
+		map[string]rsa.PublicKey{advertisedIPPort: tn.PrivateKey.PublicKey},
+		selfTestPayloadBytes)
+	if onionErr != nil {
+		return onionErr
+	}
+
+	timeout := time.Duration(timeoutMillis) * time.Millisecond
+	// peers reach us through our listen transport, and expect our identity key on the link
+	conn, dialErr := utils.DialLink(tn.listenTransport, advertisedIPPort, keyLibrary.KeyFingerprint(&tn.PrivateKey.PublicKey), nil, timeout)
+	if dialErr != nil {
+		return reachabilityError{advertisedIPPort, dialErr}
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	_, werr := utils.WriteData(conn, onion, tn.vecLogger, "Sending reachability self-test onion")
+	if werr != nil {
+		return reachabilityError{advertisedIPPort, werr}
+	}
+
+	cell, rerr := utils.ReadCell(conn, tn.vecLogger, "Received reachability self-test response")
+	if rerr != nil {
+		return reachabilityError{advertisedIPPort, rerr}
+	}
+	if cell.Command == utils.CellDestroy {
+		return reachabilityError{advertisedIPPort, fmt.Errorf("circuit destroyed: %s", cell.Reason)}
+	}
+	if cell.Command != utils.CellData {
+		return reachabilityError{advertisedIPPort, fmt.Errorf("unexpected cell command %d", cell.Command)}
+	}
+
+	// another relay listening there could not have used our key
+	decrypted, derr := keyLibrary.SymmKeyDecrypt(cell.Payload, symmKeys[0])
+	if derr != nil {
+		return reachabilityError{advertisedIPPort, fmt.Errorf("response was not sent by this relay: %s", derr)}
+	}
+	response := &utils.Onion{}
+	if umerr := utils.UnMarshall(decrypted, response); umerr != nil {
+		return reachabilityError{advertisedIPPort, fmt.Errorf("response was not sent by this relay: %s", umerr)}
+	}
+	return nil
+}
@@ -0,0 +1,406 @@
+package tornode
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"../../keyLibrary"
+	"../../utils"
+)
+
+// how long a rendezvous point waits for the service to join a client
+const rendezvousTimeout = 30 * time.Second
+
+// our end of a circuit that ends at this relay, where we act for an onion service.
+// We answer the originator like a data server would, with frames under our circuit key.
+type endpoint struct {
+	conn       net.Conn
+	symmKey    []byte
+	backDigest *utils.RunningDigest
+	fwdDigest  *utils.RunningDigest
+	writeMu    sync.Mutex // frames to the originator come from several goroutines
+
+	cells     chan *utils.Cell // what the originator sends, closed once it hangs up
+	readOnce  sync.Once
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newEndpoint(conn net.Conn, symmKey []byte) *endpoint {
+	return &endpoint{
+		conn:       conn,
+		symmKey:    symmKey,
+		backDigest: utils.NewRunningDigest(symmKey),
+		fwdDigest:  utils.NewRunningDigest(symmKey),
+		cells:      make(chan *utils.Cell),
+		closed:     make(chan struct{}),
+	}
+}
+
+// starts passing the cells the originator sends to ep.cells
+func (tn *TorNode) readEndpoint(ep *endpoint) {
+	ep.readOnce.Do(func() {
+		tn.goTracked(func() {
+			defer close(ep.cells)
+			for {
+				cell, rerr := utils.ReadCell(ep.conn, tn.vecLogger, "Service circuit cell received")
+				if rerr != nil {
+					return
+				}
+				select {
+				case ep.cells <- cell:
+				case <-ep.closed:
+					return
+				}
+			}
+		})
+	})
+}
+
+func (ep *endpoint) close() {
+	ep.closeOnce.Do(func() {
+		close(ep.closed)
+		ep.conn.Close()
+	})
+}
+
+// onion service relays on this node: introduction circuits by onion address, clients
+// waiting at the rendezvous point by cookie
+type serviceTable struct {
+	mu         sync.Mutex
+	intros     map[string]*endpoint
+	rendezvous map[string]chan *endpoint
+}
+
+func newServiceTable() *serviceTable {
+	return &serviceTable{
+		intros:     make(map[string]*endpoint),
+		rendezvous: make(map[string]chan *endpoint),
+	}
+}
+
+// returns the introduction circuit the new one replaces, if any
+func (t *serviceTable) setIntro(address string, ep *endpoint) *endpoint {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old := t.intros[address]
+	t.intros[address] = ep
+	return old
+}
+
+func (t *serviceTable) intro(address string) *endpoint {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.intros[address]
+}
+
+func (t *serviceTable) removeIntro(address string, ep *endpoint) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.intros[address] == ep {
+		delete(t.intros, address)
+	}
+}
+
+func (t *serviceTable) addRendezvous(cookie string, joined chan *endpoint) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.rendezvous[cookie]; ok {
+		return false
+	}
+	t.rendezvous[cookie] = joined
+	return true
+}
+
+// a cookie is good for one join
+func (t *serviceTable) takeRendezvous(cookie string) chan *endpoint {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	joined := t.rendezvous[cookie]
+	delete(t.rendezvous, cookie)
+	return joined
+}
+
+// we are the last relay of the circuit, and the onion asks us to act for an onion service,
+// to exit the network or to hold the circuit open for requests
+func (tn *TorNode) handleServiceCell(conn net.Conn, symmKey []byte, cell *utils.ServiceCell) {
+	ep := newEndpoint(conn, symmKey)
+	switch cell.Command {
+	case utils.ServiceEstablishIntro:
+		tn.establishIntro(ep, cell)
+	case utils.ServiceIntroduce:
+		tn.introduce(ep, cell)
+	case utils.ServiceEstablishRendezvous:
+		tn.establishRendezvous(ep, cell)
+	case utils.ServiceJoinRendezvous:
+		tn.joinRendezvous(ep, cell)
+	case utils.ServiceConnect:
+		tn.connectExit(ep, cell)
+	case utils.ServiceOpen:
+		tn.serveOpenCircuit(ep)
+	default:
+		tn.logger.Printf("WARNING unknown service command %d", cell.Command)
+		tn.destroyEndpoint(ep, utils.ReasonProtocol)
+		ep.close()
+	}
+}
+
+func (tn *TorNode) establishIntro(ep *endpoint, cell *utils.ServiceCell) {
+	defer ep.close()
+
+	auth := utils.IntroAuth(keyLibrary.KeyFingerprint(&tn.PrivateKey.PublicKey))
+	if cell.ServiceKey == nil || keyLibrary.VerifySignature(cell.ServiceKey, auth, cell.Signature) != nil {
+		tn.logger.Printf("WARNING refusing introduction circuit without a valid service signature")
+		tn.destroyEndpoint(ep, utils.ReasonProtocol)
+		return
+	}
+	address := utils.ServiceAddress(cell.ServiceKey)
+
+	// the service replaced its circuit to us
+	if old := tn.services.setIntro(address, ep); old != nil {
+		old.close()
+	}
+	defer tn.services.removeIntro(address, ep)
+
+	if tn.sendServiceFrame(ep, utils.ServiceFrame{Command: utils.ServiceEstablishIntro}) != nil {
+		return
+	}
+	tn.logger.Printf("Introduction point for %s", address)
+	tn.holdCircuit(ep, nil, nil)
+	tn.logger.Printf("Introduction circuit for %s closed", address)
+}
+
+// pass the client's introduction on to the service, and tell the client it went out
+func (tn *TorNode) introduce(ep *endpoint, cell *utils.ServiceCell) {
+	defer ep.close()
+
+	intro := tn.services.intro(cell.Address)
+	if intro == nil || tn.sendServiceFrame(intro, utils.ServiceFrame{Command: utils.ServiceIntroduce, Introduction: cell.Introduction}) != nil {
+		tn.logger.Printf("WARNING no introduction circuit for %s", cell.Address)
+		tn.destroyEndpoint(ep, utils.ReasonUnreachable)
+		return
+	}
+	if tn.sendServiceFrame(ep, utils.ServiceFrame{Command: utils.ServiceIntroduce}) == nil {
+		tn.endEndpoint(ep)
+	}
+}
+
+func (tn *TorNode) establishRendezvous(ep *endpoint, cell *utils.ServiceCell) {
+	cookie := string(cell.Cookie)
+	joined := make(chan *endpoint, 1)
+	if len(cookie) == 0 || !tn.services.addRendezvous(cookie, joined) {
+		tn.logger.Printf("WARNING rendezvous cookie missing or already in use")
+		tn.destroyEndpoint(ep, utils.ReasonProtocol)
+		ep.close()
+		return
+	}
+
+	var service *endpoint
+	timedOut := false
+	if tn.sendServiceFrame(ep, utils.ServiceFrame{Command: utils.ServiceEstablishRendezvous}) == nil {
+		service, timedOut = tn.holdCircuit(ep, joined, time.After(rendezvousTimeout))
+	}
+	if service == nil && tn.services.takeRendezvous(cookie) == nil {
+		// the service got the cookie just as we gave up on it
+		service = <-joined
+		service.close()
+		service = nil
+	}
+	if service == nil {
+		if timedOut {
+			tn.logger.Printf("WARNING service did not join the rendezvous in time")
+			tn.destroyEndpoint(ep, utils.ReasonTimeout)
+		}
+		ep.close()
+		return
+	}
+	tn.splice(ep, service)
+}
+
+// the client is waiting under the cookie, its rendezvous goroutine takes over from here
+func (tn *TorNode) joinRendezvous(ep *endpoint, cell *utils.ServiceCell) {
+	joined := tn.services.takeRendezvous(string(cell.Cookie))
+	if joined == nil {
+		tn.logger.Printf("WARNING no client waiting for the rendezvous cookie")
+		tn.destroyEndpoint(ep, utils.ReasonUnreachable)
+		ep.close()
+		return
+	}
+	joined <- ep
+}
+
+// keeps an idle circuit that ends here alive with keepalive frames, until the
+// originator tears it down, another circuit arrives on joined or timeout fires.
+// Returns the joined circuit, or nil and whether it timed out.
+func (tn *TorNode) holdCircuit(ep *endpoint, joined <-chan *endpoint, timeout <-chan time.Time) (*endpoint, bool) {
+	tn.readEndpoint(ep)
+	// relays on the circuit give up on a next hop that says nothing for their timeout
+	ticker := time.NewTicker(time.Duration(tn.timeoutMillis) * time.Millisecond / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case cell, ok := <-ep.cells:
+			// the originator only sends sendmes for our frames until then
+			if !ok || cell.Command == utils.CellDestroy || cell.Command == utils.CellEnd {
+				return nil, false
+			}
+		case other := <-joined:
+			return other, false
+		case <-timeout:
+			return nil, true
+		case <-ticker.C:
+			if tn.sendServiceFrame(ep, utils.ServiceFrame{Command: utils.ServiceKeepalive}) != nil {
+				return nil, false
+			}
+		}
+	}
+}
+
+// the client's and the service's circuits, joined at this rendezvous point
+type splicedCircuit struct {
+	client  *endpoint
+	service *endpoint
+	endOnce sync.Once
+	ended   chan struct{} // an end went out both ways
+	done    chan struct{} // we are tearing the circuits down
+}
+
+// relays frames between the two circuits: each frame the originator of one sends is
+// peeled of our layer and wrapped again for the originator of the other
+func (tn *TorNode) splice(client *endpoint, service *endpoint) {
+	s := &splicedCircuit{client: client, service: service, ended: make(chan struct{}), done: make(chan struct{})}
+	defer func() {
+		close(s.done)
+		client.close()
+		service.close()
+	}()
+
+	for _, ep := range []*endpoint{client, service} {
+		if tn.sendServiceFrame(ep, utils.ServiceFrame{Command: utils.ServiceJoinRendezvous}) != nil {
+			tn.destroyEndpoint(client, utils.ReasonConnectionClosed)
+			tn.destroyEndpoint(service, utils.ReasonConnectionClosed)
+			return
+		}
+	}
+	tn.logger.Printf("Rendezvous joined, splicing circuits")
+
+	tn.readEndpoint(client)
+	tn.readEndpoint(service)
+	finished := make(chan struct{}, 2)
+	tn.goTracked(func() { tn.pipe(s, client, service, finished) })
+	tn.goTracked(func() { tn.pipe(s, service, client, finished) })
+
+	<-finished
+	select {
+	case <-s.ended:
+		// like drainPrevHop, let both sides read the end before we hang up
+		select {
+		case <-finished:
+		case <-time.After(time.Duration(tn.timeoutMillis) * time.Millisecond):
+		}
+	default:
+	}
+}
+
+func (tn *TorNode) pipe(s *splicedCircuit, from *endpoint, to *endpoint, finished chan<- struct{}) {
+	defer func() { finished <- struct{}{} }()
+
+	for cell := range from.cells {
+		switch cell.Command {
+		case utils.CellData:
+			payload, perr := peelFrame(cell.Payload, from.symmKey, from.fwdDigest)
+			if perr != nil {
+				tn.metrics.integrityFailed()
+				tn.logger.Printf("WARNING frame failed integrity check at rendezvous, tearing down circuits")
+				tn.destroyEndpoint(from, utils.ReasonIntegrity)
+				tn.destroyEndpoint(to, utils.ReasonIntegrity)
+				return
+			}
+			if tn.relayFrame(to, payload) != nil {
+				tn.destroyEndpoint(from, utils.ReasonConnectionClosed)
+				return
+			}
+		case utils.CellEnd:
+			s.endOnce.Do(func() {
+				tn.endEndpoint(to)
+				tn.endEndpoint(from)
+				close(s.ended)
+			})
+			// sendmes may still follow, the originator hangs up once it has the end
+		case utils.CellDestroy:
+			tn.logger.Printf("spliced circuit destroyed: %s", cell.Reason)
+			tn.destroyEndpoint(to, cell.Reason)
+			return
+		}
+	}
+
+	select {
+	case <-s.ended:
+	case <-s.done:
+	default:
+		// one side went away mid-circuit
+		tn.destroyEndpoint(to, utils.ReasonConnectionClosed)
+	}
+}
+
+// a frame from us to the originator, encrypted under the circuit key like a data server response
+func (tn *TorNode) sendServiceFrame(ep *endpoint, frame utils.ServiceFrame) error {
+	raw, merr := utils.Marshall(frame)
+	if merr != nil {
+		return merr
+	}
+	ep.writeMu.Lock()
+	defer ep.writeMu.Unlock()
+
+	value := string(raw)
+	response, merr := utils.Marshall(utils.Response{Value: value, Digest: ep.backDigest.Add([]byte(value))})
+	if merr != nil {
+		return merr
+	}
+	encrypted, eerr := keyLibrary.SymmKeyEncrypt(response, ep.symmKey)
+	if eerr != nil {
+		return eerr
+	}
+	cell := utils.Cell{Command: utils.CellData, StreamID: utils.DEFAULT_STREAM_ID, Payload: encrypted}
+	_, werr := utils.WriteCell(ep.conn, cell, tn.vecLogger, "Service frame sent")
+	if werr != nil {
+		tn.logger.Printf("WARNING failed to send service frame to %s: %s", ep.conn.RemoteAddr(), werr)
+	}
+	return werr
+}
+
+// a frame from the other side of a rendezvous, wrapped with our layer like any relayed frame
+func (tn *TorNode) relayFrame(ep *endpoint, payload []byte) error {
+	ep.writeMu.Lock()
+	defer ep.writeMu.Unlock()
+
+	tn.metrics.forwardedBack(len(payload))
+	wrapped, oerr := wrapOnion(payload, ep.symmKey, ep.backDigest.Add(payload))
+	if oerr != nil {
+		return oerr
+	}
+	cell := utils.Cell{Command: utils.CellData, StreamID: utils.DEFAULT_STREAM_ID, Payload: wrapped}
+	_, werr := utils.WriteCell(ep.conn, cell, tn.vecLogger, "Rendezvous frame relayed")
+	if werr != nil {
+		tn.logger.Printf("WARNING failed to relay frame to %s: %s", ep.conn.RemoteAddr(), werr)
+	}
+	return werr
+}
+
+func (tn *TorNode) endEndpoint(ep *endpoint) {
+	ep.writeMu.Lock()
+	defer ep.writeMu.Unlock()
+	_, werr := utils.WriteEnd(ep.conn, tn.vecLogger, "Service circuit end sent")
+	if werr != nil {
+		tn.logger.Printf("WARNING failed to end service circuit to %s: %s", ep.conn.RemoteAddr(), werr)
+	}
+	utils.CloseWrite(ep.conn)
+}
+
+func (tn *TorNode) destroyEndpoint(ep *endpoint, reason utils.DestroyReason) {
+	ep.writeMu.Lock()
+	defer ep.writeMu.Unlock()
+	tn.destroyBack(ep.conn, ep.symmKey, utils.DestroyInfo{Reason: reason})
+}
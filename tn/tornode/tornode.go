@@ -1,40 +1,213 @@
 package tornode
 
 import (
+	"context"
 	"crypto/rsa"
+	"crypto/tls"
 	"errors"
-	"fmt"
+	"log"
 	"math/rand"
 	"net"
+	"net/http"
+	"os"
+	"sync"
 	"time"
 
+	"../../cover"
 	"../../keyLibrary"
 	"../../utils"
 	"github.com/DistributedClocks/GoVector/govec"
 )
 
+// used when the config leaves a limit at 0
+const (
+	defaultMaxCircuits     = 256
+	defaultMaxHandshakes   = 16
+	defaultAcceptQueueSize = 64
+)
+
+// where the DS key is when the config doesn't say
+const defaultDSPublicKeyPath = "./dirserver/public.pem"
+
 type TorNode struct {
-	PrivateKey    *rsa.PrivateKey
-	ListenIPPort  string
-	fd            utils.FD
-	timeoutMillis int
+	PrivateKey      *rsa.PrivateKey
+	ListenIPPort    string
+	fd              utils.FD
+	timeoutMillis   int
+	vecLogger       *govec.GoLog
+	logger          *log.Logger
+	metrics         *Metrics
+	circuitSlots    chan struct{} // one token per circuit being relayed
+	handshakeSlots  chan struct{} // one token per onion being read and peeled
+	rejectSlots     chan struct{} // one token per overloaded connection being sent a destroy
+	acceptQueueSize int
+	flowControl     utils.FlowControlConfig
+	listenTransport utils.Transport
+	links           utils.LinkConfig
+	tlsConfig       *tls.Config   // serves a certificate for PrivateKey
+	services        *serviceTable // onion services we are an introduction or rendezvous point for
+	exit            bool          // clients may open TCP connections out of the network through us
+	exitPorts       utils.ExitPorts
+	exitToPrivate   bool // clients may reach loopback, private and link-local addresses through us
+
+	options       Options
+	dsPublicKey   *rsa.PublicKey
+	listener      net.Listener
+	metricsServer *http.Server
+	cover         *cover.Traffic
+
+	startOnce sync.Once
+	startMu   sync.Mutex // held while starting, Stop waits for it
+	stopOnce  sync.Once
+	stopping  chan struct{}  // closed once Stop is called, no new circuits after that
+	done      chan struct{}  // closed once Stop has torn everything down
+	wg        sync.WaitGroup // the accept loop and every goroutine relaying a circuit
+	connsMu   sync.Mutex
+	conns     map[*trackedConn]struct{} // open links of the circuits we relay
 }
 
-func InitTorNode(dsIPPort string, listenIPPort string, fdListenIPPort string, timeoutMillis int) error {
-	fmt.Println("==========================================================")
-	fmt.Printf("Initalizing Tor node with DS: %s, listening at: %s, fdlib listening at %s, timeout in milliseconds: %d\n", dsIPPort, listenIPPort, fdListenIPPort, timeoutMillis)
+// Options configures a TorNode made with NewTorNode
+type Options struct {
+	DSIPPort       string
+	ListenIPPort   string // where circuits come in, and what the DS is told unless Config.AdvertiseIPPort says otherwise
+	FdListenIPPort string // where the DS's failure detector heartbeats us
+	TimeoutMillis  int
+	Config         utils.TorNodeConfig
 
-	vecLogger := govec.InitGoVector("tor-node-"+listenIPPort, "tor-node-"+listenIPPort, govec.GetDefaultConfig())
+	// Listener accepts circuits in place of a TCP listener on ListenIPPort, which must
+	// still lead to it for the self-test. Stop closes it.
+	Listener net.Listener
+	// VecLogger logs what the node sends and receives, one named after ListenIPPort when nil
+	VecLogger *govec.GoLog
+	// Logger gets the node's messages, stdout prefixed with ListenIPPort when nil
+	Logger *log.Logger
+}
 
-	// Initialize variables
-	privateKey, pkerror := keyLibrary.GeneratePrivPubKey()
+// Metrics returns what this node has relayed so far
+func (tn *TorNode) Metrics() MetricsSnapshot {
+	return tn.metrics.Snapshot()
+}
+
+// InitTorNode starts a node that runs until the process exits, see NewTorNode and Start
+func InitTorNode(dsIPPort string, listenIPPort string, fdListenIPPort string, timeoutMillis int, config utils.TorNodeConfig) (*TorNode, error) {
+	tn, err := NewTorNode(Options{
+		DSIPPort:       dsIPPort,
+		ListenIPPort:   listenIPPort,
+		FdListenIPPort: fdListenIPPort,
+		TimeoutMillis:  timeoutMillis,
+		Config:         config,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = tn.Start(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return tn, nil
+}
+
+// NewTorNode loads the keys and checks the config of a node, without opening any
+// connection. Any number of nodes can run in one process.
+func NewTorNode(options Options) (*TorNode, error) {
+	config := options.Config
+	vecLogger := options.VecLogger
+	if vecLogger == nil {
+		vecLogger = govec.InitGoVector("tor-node-"+options.ListenIPPort, "tor-node-"+options.ListenIPPort, govec.GetDefaultConfig())
+	}
+	logger := options.Logger
+	if logger == nil {
+		logger = log.New(os.Stdout, "TorNode "+options.ListenIPPort+": ", 0)
+	}
+
+	privateKey, pkerror := loadIdentityKey(config.IdentityKeyPath, logger)
 	if pkerror != nil {
-		fmt.Printf("Could not init tor node. Failed to generate private key: %s\n", pkerror)
-		return pkerror
+		logger.Printf("Could not init tor node. Failed to generate private key: %s", pkerror)
+		return nil, pkerror
+	}
+
+	tlsConfig, tlsErr := keyLibrary.ServerTLSConfig(privateKey, false)
+	if tlsErr != nil {
+		logger.Printf("Could not create TLS certificate: %s", tlsErr)
+		return nil, tlsErr
+	}
+
+	dsKeyPath := config.DSPublicKeyPath
+	if dsKeyPath == "" {
+		dsKeyPath = defaultDSPublicKeyPath
+	}
+	dsPublicKey, keyErr := keyLibrary.LoadPublicKey(dsKeyPath)
+	if keyErr != nil {
+		logger.Printf("Could not load DS public key: %s", keyErr)
+		return nil, keyErr
+	}
+
+	listenTransport, transportErr := utils.NewTransport(config.ListenTransport)
+	if transportErr != nil {
+		logger.Printf("Invalid listen transport: %s", transportErr)
+		return nil, transportErr
 	}
 
-	// load necessary keys
-	publicKey := &privateKey.PublicKey
+	return &TorNode{
+		PrivateKey:      privateKey,
+		ListenIPPort:    options.ListenIPPort,
+		timeoutMillis:   options.TimeoutMillis,
+		vecLogger:       vecLogger,
+		logger:          logger,
+		metrics:         NewMetrics(),
+		circuitSlots:    make(chan struct{}, orDefault(config.MaxCircuits, defaultMaxCircuits)),
+		handshakeSlots:  make(chan struct{}, orDefault(config.MaxHandshakes, defaultMaxHandshakes)),
+		rejectSlots:     make(chan struct{}, orDefault(config.MaxHandshakes, defaultMaxHandshakes)),
+		acceptQueueSize: orDefault(config.AcceptQueueSize, defaultAcceptQueueSize),
+		flowControl:     config.FlowControl,
+		listenTransport: listenTransport,
+		links:           config.LinkConfig,
+		tlsConfig:       tlsConfig,
+		services:        newServiceTable(),
+		exit:            config.Exit,
+		exitPorts:       config.ExitPorts,
+		exitToPrivate:   config.ExitAllowPrivate,
+		options:         options,
+		dsPublicKey:     dsPublicKey,
+		stopping:        make(chan struct{}),
+		done:            make(chan struct{}),
+		conns:           make(map[*trackedConn]struct{}),
+	}, nil
+}
+
+// Start opens the listener, checks the node is reachable and joins the network, or
+// just prints the bridge line for a bridge. The node runs until Stop is called or ctx
+// is done. A node starts at most once, and is stopped again if Start fails.
+func (tn *TorNode) Start(ctx context.Context) error {
+	err := errors.New("TorNode: already started")
+	tn.startOnce.Do(func() {
+		tn.startMu.Lock()
+		err = tn.start(ctx)
+		tn.startMu.Unlock()
+		if err != nil {
+			tn.Stop()
+			return
+		}
+		go func() {
+			select {
+			case <-ctx.Done():
+				tn.Stop()
+			case <-tn.stopping:
+			}
+		}()
+	})
+	return err
+}
+
+func (tn *TorNode) start(ctx context.Context) error {
+	select {
+	case <-tn.stopping:
+		return errors.New("TorNode: already stopped")
+	default:
+	}
+	options, config := tn.options, tn.options.Config
+	tn.logger.Println("==========================================================")
+	tn.logger.Printf("Initalizing Tor node with DS: %s, listening at: %s, fdlib listening at %s, timeout in milliseconds: %d", options.DSIPPort, options.ListenIPPort, options.FdListenIPPort, options.TimeoutMillis)
 
 	// start failure detector
 	source := rand.NewSource(time.Now().UnixNano())
@@ -42,38 +215,128 @@ func InitTorNode(dsIPPort string, listenIPPort string, fdListenIPPort string, ti
 	epochNonce := rand.Uint64()
 	fd, _, fdliberr := utils.Initialize(epochNonce, 50)
 	if fdliberr != nil {
-		fmt.Printf("TorNode: failed to start fdlib for error: %s\n", fdliberr)
+		tn.logger.Printf("failed to start fdlib for error: %s", fdliberr)
 		return fdliberr
 	}
-	fdresErr := fd.StartResponding(fdListenIPPort)
+	tn.fd = fd
+	fdresErr := fd.StartResponding(options.FdListenIPPort)
 	if fdresErr != nil {
-		fmt.Printf("TorNode: failed to start responding for error: %s\n", fdresErr)
+		tn.logger.Printf("failed to start responding for error: %s", fdresErr)
 		return fdresErr
 	}
 
-	// join network
-	dsstatus, dserror := contactDS(dsIPPort, listenIPPort, fdListenIPPort, publicKey, vecLogger)
-	if dserror != nil {
-		fmt.Printf("TorNode: Could not contact DS to join tor network for error: %s\n", dserror)
-		return dserror
+	listener := options.Listener
+	if listener == nil {
+		laddr, laddrErr := net.ResolveTCPAddr("tcp", options.ListenIPPort)
+		if laddrErr != nil {
+			tn.logger.Printf("Could not resolve listen address for error: %s", laddrErr)
+			return laddrErr
+		}
+		var lerr error
+		listener, lerr = net.ListenTCP("tcp", laddr)
+		if lerr != nil {
+			tn.logger.Printf("Could not start TCP listening for error: %s", lerr)
+			return lerr
+		}
 	}
-	if !dsstatus {
-		return errors.New("TorNode: Network join rejected by DS")
+	tn.listener = listener
+
+	tn.logger.Printf("Kicking off onion handler daemon, %s transport...", tn.listenTransport.Name())
+	tn.wg.Add(1)
+	go tn.onionHandler(listener)
+
+	// the DS hands our address to clients, so make sure it actually leads here first
+	advertiseIPPort := config.AdvertiseIPPort
+	if advertiseIPPort == "" {
+		advertiseIPPort = options.ListenIPPort
+	}
+	testErr := tn.selfTest(advertiseIPPort, tn.timeoutMillis)
+	if testErr != nil {
+		tn.logger.Printf("Reachability self-test failed, refusing to join tor network: %s", testErr)
+		return testErr
+	}
+	tn.logger.Printf("Reachability self-test passed for %s", advertiseIPPort)
+	if ctx.Err() != nil {
+		return ctx.Err()
 	}
 
-	laddr, laddrErr := net.ResolveTCPAddr("tcp", listenIPPort)
-	if laddrErr != nil {
-		fmt.Printf("TorNode: Could not resolve listen address for error: %s\n", laddrErr)
-		return laddrErr
+	if config.Bridge {
+		// users get our address out of band, the DS never learns about us
+		bridge := utils.Bridge{
+			Addr:        advertiseIPPort,
+			Fingerprint: keyLibrary.KeyFingerprint(&tn.PrivateKey.PublicKey),
+			Transport:   config.ListenTransport,
+		}
+		tn.logger.Printf("Running as an unlisted bridge, bridge line:\n\n%s\n", bridge)
+		if config.IdentityKeyPath == "" {
+			tn.logger.Printf("WARNING no IdentityKeyPath set, the bridge line changes on every start")
+		}
+	} else {
+		// join network
+		dsstatus, dserror := contactDS(options.DSIPPort, tn.dsPublicKey, advertiseIPPort, options.FdListenIPPort, config.Exit, config.ExitPorts, tn.PrivateKey, tn.timeoutMillis, tn.vecLogger)
+		if dserror != nil {
+			tn.logger.Printf("Could not contact DS to join tor network for error: %s", dserror)
+			return dserror
+		}
+		if !dsstatus {
+			return errors.New("TorNode: Network join rejected by DS")
+		}
 	}
-	listener, lerr := net.ListenTCP("tcp", laddr)
-	if lerr != nil {
-		fmt.Printf("TorNode: Could not start TCP listening for error: %s\n", lerr)
-		return lerr
+	tn.logger.Printf("Tor Node successfully initialized!")
+
+	if config.MetricsIPPort != "" {
+		tn.logger.Printf("Serving metrics at http://%s/metrics", config.MetricsIPPort)
+		tn.metricsServer = tn.metrics.startServer(config.MetricsIPPort, tn.logger)
 	}
 
-	fmt.Printf("Tor Node successfully initialized! Kicking off onion handler daemon...\n\n\n")
-	go onionHandler(listener, privateKey, timeoutMillis, vecLogger)
+	if config.CoverTraffic.Enabled {
+		tn.logger.Printf("Sending cover traffic every %dms on average", config.CoverTraffic.MeanIntervalMillis)
+		tn.cover = cover.Start(config.CoverTraffic, config.LinkConfig, cover.CachedDirectory(tn.fetchCoverRelays), advertiseIPPort, tn.logger, tn.vecLogger)
+	}
 
 	return nil
 }
+
+// Stop closes the listener and every circuit going through the node, and returns once
+// all of them are torn down. The DS drops the node when its heartbeats go unanswered.
+func (tn *TorNode) Stop() {
+	tn.stopOnce.Do(func() {
+		close(tn.stopping)
+		tn.logger.Printf("Stopping %s", tn.ListenIPPort)
+		tn.startMu.Lock()
+		defer tn.startMu.Unlock()
+
+		if tn.cover != nil {
+			tn.cover.Stop()
+		}
+		if tn.metricsServer != nil {
+			tn.metricsServer.Close()
+		}
+		if tn.listener != nil {
+			tn.listener.Close()
+		} else if tn.options.Listener != nil {
+			tn.options.Listener.Close()
+		}
+		if tn.fd != nil {
+			tn.fd.StopResponding()
+		}
+		tn.closeConns()
+		tn.wg.Wait()
+
+		close(tn.done)
+		tn.logger.Printf("Stopped %s", tn.ListenIPPort)
+	})
+	<-tn.done
+}
+
+// Done is closed once the node has stopped
+func (tn *TorNode) Done() <-chan struct{} {
+	return tn.done
+}
+
+func orDefault(value int, defaultValue int) int {
+	if value <= 0 {
+		return defaultValue
+	}
+	return value
+}
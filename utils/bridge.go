@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Bridge is an unlisted relay, handed to users out of band as a bridge line:
+//
+//	[transport] IP:port fingerprint [secret=...]
+//
+// e.g. "obfs 203.0.113.5:4001 3f1a...c2 secret=correcthorse". The transport defaults to plain.
+type Bridge struct {
+	Addr        string
+	Fingerprint string // of the bridge's identity key, its TLS link is verified against it
+	Transport   TransportConfig
+}
+
+func ParseBridgeLine(line string) (Bridge, error) {
+	fields := strings.Fields(line)
+	bridge := Bridge{}
+
+	if len(fields) > 0 {
+		if _, _, err := net.SplitHostPort(fields[0]); err != nil {
+			bridge.Transport.Name = fields[0]
+			fields = fields[1:]
+		}
+	}
+	if len(fields) < 2 {
+		return bridge, fmt.Errorf("bridge line %q: expected [transport] IP:port fingerprint", line)
+	}
+
+	bridge.Addr, bridge.Fingerprint = fields[0], strings.ToLower(fields[1])
+	if _, _, err := net.SplitHostPort(bridge.Addr); err != nil {
+		return bridge, fmt.Errorf("bridge line %q: %s", line, err)
+	}
+	if raw, err := hex.DecodeString(bridge.Fingerprint); err != nil || len(raw) != 32 {
+		return bridge, fmt.Errorf("bridge line %q: fingerprint is not a hex SHA-256", line)
+	}
+
+	for _, option := range fields[2:] {
+		key, value := option, ""
+		if i := strings.Index(option, "="); i >= 0 {
+			key, value = option[:i], option[i+1:]
+		}
+		switch key {
+		case "secret":
+			bridge.Transport.Secret = value
+		default:
+			return bridge, fmt.Errorf("bridge line %q: unknown option %q", line, key)
+		}
+	}
+
+	if _, err := NewTransport(bridge.Transport); err != nil {
+		return bridge, fmt.Errorf("bridge line %q: %s", line, err)
+	}
+	return bridge, nil
+}
+
+func (b Bridge) String() string {
+	line := b.Addr + " " + b.Fingerprint
+	if b.Transport.Name != "" {
+		line = b.Transport.Name + " " + line
+	}
+	if b.Transport.Secret != "" {
+		line += " secret=" + b.Transport.Secret
+	}
+	return line
+}
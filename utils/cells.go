@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"net"
+
+	"github.com/DistributedClocks/GoVector/govec"
+)
+
+// Every message between two hops of a circuit (client, tor nodes, data server) is a cell
+type CellCommand uint8
+
+const (
+	CellData    CellCommand = iota + 1 // Payload is an onion, or one wrapped frame on an established circuit
+	CellDestroy                        // the circuit is torn down, see Reason
+	CellEnd                            // no more response frames will follow
+	CellSendme                         // the receiver took SendmeIncrement more cells, see FlowControlConfig
+)
+
+type DestroyReason uint8
+
+const (
+	ReasonNone             DestroyReason = iota
+	ReasonOverloaded                     // the relay is out of circuit slots
+	ReasonProtocol                       // a hop sent a cell that made no sense
+	ReasonDecryptFailed                  // the onion could not be decrypted with the hop's key
+	ReasonUnreachable                    // the next hop could not be dialed
+	ReasonTimeout                        // a hop did not answer in time
+	ReasonConnectionClosed               // a hop hung up before the circuit was done
+	ReasonRequested                      // the client closed the circuit
+	ReasonIntegrity                      // a digest did not match, someone tampered with the circuit
+	ReasonRefused                        // the relay does not do what the onion asks, like exiting the network
+)
+
+func (r DestroyReason) String() string {
+	switch r {
+	case ReasonNone:
+		return "none"
+	case ReasonOverloaded:
+		return "relay overloaded"
+	case ReasonProtocol:
+		return "protocol error"
+	case ReasonDecryptFailed:
+		return "decrypt failed"
+	case ReasonUnreachable:
+		return "unreachable"
+	case ReasonTimeout:
+		return "timeout"
+	case ReasonConnectionClosed:
+		return "connection closed"
+	case ReasonRequested:
+		return "closed by client"
+	case ReasonIntegrity:
+		return "integrity check failed"
+	case ReasonRefused:
+		return "refused by relay"
+	}
+	return "unknown reason"
+}
+
+// DestroyInfo is put in the payload of a destroy cell going back to the client by the
+// relay that tore the circuit down. It is wrapped with that relay's circuit key and then
+// by every hop on the way back, like a response frame, so the client learns which hop
+// it came from. A hop without a circuit key sends an empty payload and its previous hop
+// reports it with NextHop set.
+type DestroyInfo struct {
+	Reason  DestroyReason
+	NextHop bool // the failure is at the reporting relay's next hop, not the relay itself
+}
+
+type Cell struct {
+	Command  CellCommand
+	StreamID uint16        // 0 for cells about the whole circuit
+	Reason   DestroyReason // only set on destroy cells
+	Payload  []byte
+}
+
+func ReadCell(from net.Conn, vecLogger *govec.GoLog, vecMsg string) (*Cell, error) {
+	raw, err := TCPRead(from, vecLogger, vecMsg)
+	if err != nil {
+		return nil, err
+	}
+	cell := &Cell{}
+	err = UnMarshall(raw, cell)
+	if err != nil {
+		return nil, err
+	}
+	return cell, nil
+}
+
+func WriteCell(to net.Conn, cell Cell, vecLogger *govec.GoLog, vecMsg string) (int, error) {
+	raw, err := Marshall(cell)
+	if err != nil {
+		return 0, err
+	}
+	return TCPWrite(to, raw, vecLogger, vecMsg)
+}
+
+func WriteData(to net.Conn, payload []byte, vecLogger *govec.GoLog, vecMsg string) (int, error) {
+	return WriteCell(to, Cell{Command: CellData, Payload: payload}, vecLogger, vecMsg)
+}
+
+func WriteDestroy(to net.Conn, reason DestroyReason, vecLogger *govec.GoLog, vecMsg string) (int, error) {
+	return WriteCell(to, Cell{Command: CellDestroy, Reason: reason}, vecLogger, vecMsg)
+}
+
+func WriteEnd(to net.Conn, vecLogger *govec.GoLog, vecMsg string) (int, error) {
+	return WriteCell(to, Cell{Command: CellEnd}, vecLogger, vecMsg)
+}
+
+func WriteSendme(to net.Conn, streamID uint16, vecLogger *govec.GoLog, vecMsg string) (int, error) {
+	return WriteCell(to, Cell{Command: CellSendme, StreamID: streamID}, vecLogger, vecMsg)
+}
@@ -0,0 +1,25 @@
+package utils
+
+import "time"
+
+// DEADLINE_MARGIN is how much sooner each hop gives up on a request than the hop before
+// it, so the timeout of a slow hop gets back to the client before anyone else gives up
+const DEADLINE_MARGIN = 100 * time.Millisecond
+
+// HopDeadline is the request deadline the client puts in the layer of the given hop,
+// 0 being T1. Hops further in get earlier deadlines. 0 when there is no deadline.
+func HopDeadline(deadline time.Time, hop int) int64 {
+	if deadline.IsZero() {
+		return 0
+	}
+	return deadline.Add(-time.Duration(hop) * DEADLINE_MARGIN).UnixNano()
+}
+
+// GiveUpAt is when a hop stops waiting on a request with the deadline from its layer,
+// a margin before it so its timeout reaches the previous hop in time. Zero for none.
+func GiveUpAt(layerDeadline int64) time.Time {
+	if layerDeadline == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, layerDeadline).Add(-DEADLINE_MARGIN)
+}
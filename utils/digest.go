@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// LayerDigest authenticates one forward onion layer with the symmetric key it carries.
+// A relay that swaps, drops or alters the RSA chunks of the next hop's layer changes
+// the plaintext, which then no longer matches its digest.
+func LayerDigest(onion Onion) []byte {
+	mac := hmac.New(sha256.New, onion.SymmKey)
+	mac.Write([]byte(onion.NextIpPort))
+	mac.Write([]byte{0})
+	mac.Write([]byte(onion.NextFingerprint))
+	mac.Write([]byte{0})
+	mac.Write(onion.Payload)
+	if onion.Cover {
+		mac.Write([]byte{1})
+	} else {
+		mac.Write([]byte{0})
+	}
+	deadline := make([]byte, 8)
+	binary.BigEndian.PutUint64(deadline, uint64(onion.Deadline))
+	mac.Write(deadline)
+	if onion.Service != nil {
+		raw, _ := Marshall(onion.Service)
+		mac.Write(raw)
+	}
+	return mac.Sum(nil)
+}
+
+// VerifyLayerDigest checks the digest a peeled onion layer came with
+func VerifyLayerDigest(onion Onion) bool {
+	digest := onion.Digest
+	onion.Digest = nil
+	return hmac.Equal(digest, LayerDigest(onion))
+}
+
+// RunningDigest chains every payload one hop sends back on a circuit, keyed with the
+// hop's circuit key. Both ends keep one per hop: a frame that was altered, dropped,
+// reordered or replayed on the way changes every digest after it.
+type RunningDigest struct {
+	key []byte
+	sum []byte
+}
+
+func NewRunningDigest(key []byte) *RunningDigest {
+	return &RunningDigest{key: key}
+}
+
+// Add chains the payload in and returns the new digest
+func (d *RunningDigest) Add(payload []byte) []byte {
+	mac := hmac.New(sha256.New, d.key)
+	mac.Write(d.sum)
+	mac.Write(payload)
+	d.sum = mac.Sum(nil)
+	return d.sum
+}
+
+// Verify chains the payload in and checks the result against the digest the sender got
+func (d *RunningDigest) Verify(payload []byte, digest []byte) bool {
+	return hmac.Equal(d.Add(payload), digest)
+}
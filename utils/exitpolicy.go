@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"net"
+	"strconv"
+)
+
+// ExitPorts are the destination ports an exit opens connections to. Empty allows every port.
+type ExitPorts []int
+
+func (p ExitPorts) Allows(port int) bool {
+	if len(p) == 0 {
+		return true
+	}
+	for _, allowed := range p {
+		if allowed == port {
+			return true
+		}
+	}
+	return false
+}
+
+// DestinationPort is the port of a host:port destination
+func DestinationPort(addr string) (int, error) {
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(portStr)
+}
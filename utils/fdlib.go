@@ -76,11 +76,11 @@ type HeartbeatInfo struct {
 }
 
 ////////////////////////////////////////////////////// Global Vars
-var INIT_RTT time.Duration
 
-const PKT_SIZE = 1024
+// the RTT a new instance assumes for a node until its first ack
+const INIT_RTT = 3 * time.Second
 
-var initialized bool
+const PKT_SIZE = 1024
 
 const DEBUG = false
 
@@ -121,7 +121,8 @@ type Fdlib struct {
 	Responding   bool
 
 	// For monitoring nodes
-	NodesToMonitor RemoteNodes // indexed by RemoteIpPort
+	NodesToMonitor RemoteNodes   // indexed by RemoteIpPort
+	InitRTT        time.Duration // RTT of a newly monitored node, per instance so several can run in one process
 
 	// For logging everything about the library
 	Log *log.Logger
@@ -221,7 +222,7 @@ func (fd *Fdlib) AddMonitor(LocalIpPort, RemoteIpPort string, LostMsgThresh uint
 		// Create an entry for node that we will monitor
 		remoteNode = &RemoteNodeMonitorInfo{
 			LostMsgThresh: LostMsgThresh,
-			AvgRTT:        INIT_RTT,
+			AvgRTT:        fd.InitRTT,
 			NumFailedAcks: 0,
 			ShouldMonitor: true,
 		}
@@ -446,10 +447,6 @@ func (fd *Fdlib) Println(v ...interface{}) {
 // initialize:
 // https://www.golang-book.com/books/intro/10
 func Initialize(EpochNonce uint64, ChCapacity uint8) (fd FD, notifyCh <-chan FailureDetected, err error) {
-	if initialized {
-		return nil, nil, errors.New("unimplemented")
-	}
-
 	ch := make(chan FailureDetected, ChCapacity)
 	nodes := RemoteNodes{
 		Map: make(map[string]*RemoteNodeMonitorInfo),
@@ -468,12 +465,11 @@ func Initialize(EpochNonce uint64, ChCapacity uint8) (fd FD, notifyCh <-chan Fai
 		EpochNonce:     EpochNonce,
 		NotifyCh:       ch,
 		NodesToMonitor: nodes,
+		InitRTT:        INIT_RTT,
 		Log:            logger,
 		Responding:     false,
 	}
 
-	initialized = true
 	fd = fdlib
-	INIT_RTT = time.Duration(3 * time.Second)
 	return fd, ch, nil
 }
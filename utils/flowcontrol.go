@@ -0,0 +1,166 @@
+package utils
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// used when the config leaves a window at 0
+const (
+	DEFAULT_CIRCUIT_WINDOW   = 1000
+	DEFAULT_STREAM_WINDOW    = 500
+	DEFAULT_SENDME_INCREMENT = 50
+)
+
+// every circuit carries a single stream for now
+const DEFAULT_STREAM_ID uint16 = 1
+
+var ErrWindowClosed = errors.New("flow control window closed")
+
+// Window sizes, counted in data cells. A sender stops once either the circuit or the
+// stream window is used up, and the receiver sends a sendme cell back every
+// SendmeIncrement cells to open both windows again.
+type FlowControlConfig struct {
+	CircuitWindow   int
+	StreamWindow    int
+	SendmeIncrement int
+}
+
+func (c FlowControlConfig) withDefaults() FlowControlConfig {
+	if c.CircuitWindow <= 0 {
+		c.CircuitWindow = DEFAULT_CIRCUIT_WINDOW
+	}
+	if c.StreamWindow <= 0 {
+		c.StreamWindow = DEFAULT_STREAM_WINDOW
+	}
+	if c.SendmeIncrement <= 0 {
+		c.SendmeIncrement = DEFAULT_SENDME_INCREMENT
+	}
+	// a window smaller than one increment would never see a sendme
+	if c.SendmeIncrement > c.StreamWindow {
+		c.SendmeIncrement = c.StreamWindow
+	}
+	if c.SendmeIncrement > c.CircuitWindow {
+		c.SendmeIncrement = c.CircuitWindow
+	}
+	return c
+}
+
+// SendWindow is the sender side of a circuit's flow control
+type SendWindow struct {
+	config  FlowControlConfig
+	mu      sync.Mutex
+	cond    *sync.Cond
+	circuit int
+	streams map[uint16]int
+	closed  bool
+}
+
+func NewSendWindow(config FlowControlConfig) *SendWindow {
+	w := &SendWindow{
+		config:  config.withDefaults(),
+		streams: make(map[uint16]int),
+	}
+	w.circuit = w.config.CircuitWindow
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+// Acquire takes one cell from the circuit and stream windows, blocking while either is
+// used up. It returns how long it was stalled.
+func (w *SendWindow) Acquire(streamID uint16) (time.Duration, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var stallStart time.Time
+	for !w.closed && (w.circuit == 0 || w.stream(streamID) == 0) {
+		if stallStart.IsZero() {
+			stallStart = time.Now()
+		}
+		w.cond.Wait()
+	}
+
+	var stalled time.Duration
+	if !stallStart.IsZero() {
+		stalled = time.Since(stallStart)
+	}
+	if w.closed {
+		return stalled, ErrWindowClosed
+	}
+	w.circuit--
+	w.streams[streamID]--
+	return stalled, nil
+}
+
+// Ack handles a sendme, stream 0 acknowledges the circuit window
+func (w *SendWindow) Ack(streamID uint16) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if streamID == 0 {
+		w.circuit += w.config.SendmeIncrement
+		if w.circuit > w.config.CircuitWindow {
+			w.circuit = w.config.CircuitWindow
+		}
+	} else {
+		w.streams[streamID] = w.stream(streamID) + w.config.SendmeIncrement
+		if w.streams[streamID] > w.config.StreamWindow {
+			w.streams[streamID] = w.config.StreamWindow
+		}
+	}
+	w.cond.Broadcast()
+}
+
+// Close wakes up blocked senders, Acquire fails from now on
+func (w *SendWindow) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	w.cond.Broadcast()
+}
+
+// should be called with the lock held
+func (w *SendWindow) stream(streamID uint16) int {
+	window, ok := w.streams[streamID]
+	if !ok {
+		window = w.config.StreamWindow
+		w.streams[streamID] = window
+	}
+	return window
+}
+
+// ReceiveWindow is the receiver side, it decides when to send sendmes
+type ReceiveWindow struct {
+	config  FlowControlConfig
+	mu      sync.Mutex
+	circuit int
+	streams map[uint16]int
+}
+
+func NewReceiveWindow(config FlowControlConfig) *ReceiveWindow {
+	return &ReceiveWindow{
+		config:  config.withDefaults(),
+		streams: make(map[uint16]int),
+	}
+}
+
+// Delivered counts a data cell handed to the application and returns the stream ids
+// to send a sendme for, 0 meaning the circuit
+func (w *ReceiveWindow) Delivered(streamID uint16) []uint16 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	sendmes := make([]uint16, 0)
+	w.circuit++
+	if w.circuit == w.config.SendmeIncrement {
+		w.circuit = 0
+		sendmes = append(sendmes, 0)
+	}
+	w.streams[streamID]++
+	if w.streams[streamID] == w.config.SendmeIncrement {
+		w.streams[streamID] = 0
+		sendmes = append(sendmes, streamID)
+	}
+	return sendmes
+}
@@ -12,7 +12,12 @@ import (
 
 const MSG_SIZE = 4 // 4 bytes in size
 
-func TCPRead(from *net.TCPConn, vecLogger *govec.GoLog, vecMsg string) ([]byte, error) {
+// largest message we are willing to buffer, a bigger size header is refused before reading the body
+const MAX_MSG_SIZE = 1 << 22
+
+var ErrMsgTooLarge = errors.New("msg size over limit")
+
+func TCPRead(from net.Conn, vecLogger *govec.GoLog, vecMsg string) ([]byte, error) {
 	// Reading message size
 	sizeBuf := make([]byte, 0)
 	sReadCount := MSG_SIZE
@@ -33,6 +38,9 @@ func TCPRead(from *net.TCPConn, vecLogger *govec.GoLog, vecMsg string) ([]byte,
 
 	actlen := int(mlen)
 	fmt.Println("**Networking**: Expected message size:", actlen)
+	if actlen > MAX_MSG_SIZE {
+		return nil, ErrMsgTooLarge
+	}
 
 	// Reading acutal message
 	bytes := make([]byte, 0)
@@ -41,8 +49,13 @@ func TCPRead(from *net.TCPConn, vecLogger *govec.GoLog, vecMsg string) ([]byte,
 
 	sizeMsg := 0
 
-	for {
-		size, rerr := from.Read(chunk)
+	for sizeMsg < actlen {
+		// never read past this message, the next one may already be in the buffer
+		toRead := actlen - sizeMsg
+		if toRead > chunkCap {
+			toRead = chunkCap
+		}
+		size, rerr := from.Read(chunk[:toRead])
 		if rerr != nil {
 			if rerr != io.EOF {
 				return nil, rerr
@@ -52,10 +65,6 @@ func TCPRead(from *net.TCPConn, vecLogger *govec.GoLog, vecMsg string) ([]byte,
 		}
 		bytes = append(bytes, chunk[:size]...)
 		sizeMsg += size
-
-		if sizeMsg >= actlen {
-			break
-		}
 	}
 
 	if sizeMsg != actlen {
@@ -68,7 +77,7 @@ func TCPRead(from *net.TCPConn, vecLogger *govec.GoLog, vecMsg string) ([]byte,
 	return results, nil
 }
 
-func TCPWrite(to *net.TCPConn, payload []byte, vecLogger *govec.GoLog, vecMsg string) (int, error) {
+func TCPWrite(to net.Conn, payload []byte, vecLogger *govec.GoLog, vecMsg string) (int, error) {
 	loggedPayload := vecLogger.PrepareSend(vecMsg, payload, govec.GetDefaultLogOptions())
 
 	b := make([]byte, MSG_SIZE)
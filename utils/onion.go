@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"crypto/rsa"
+
+	"../keyLibrary"
+)
+
+// bytes of a marshalled layer encrypted with RSA at once
+const ONION_CHUNK_BYTES = 150
+
+// EncryptChunks encrypts raw to key in chunks small enough for RSA
+func EncryptChunks(raw []byte, key rsa.PublicKey) ([][]byte, error) {
+	var chunks [][]byte
+	for len(raw) >= ONION_CHUNK_BYTES {
+		chunk, err := keyLibrary.PubKeyEncrypt(&key, raw[:ONION_CHUNK_BYTES])
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+		raw = raw[ONION_CHUNK_BYTES:]
+	}
+	last, err := keyLibrary.PubKeyEncrypt(&key, raw)
+	if err != nil {
+		return nil, err
+	}
+	return append(chunks, last), nil
+}
+
+// SealLayer marshals an onion layer and encrypts it to the key of the relay that peels it
+func SealLayer(layer Onion, key rsa.PublicKey) ([]byte, error) {
+	marshalled, err := Marshall(layer)
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := EncryptChunks(marshalled, key)
+	if err != nil {
+		return nil, err
+	}
+	return Marshall(chunks)
+}
+
+// WrapRelayOnion wraps the layer of the last relay, which has no next hop, in the layers
+// of the relays before it. Returns the onion and the symmetric keys from T1 to Tn.
+func WrapRelayOnion(nodeOrder []string, tnMap map[string]rsa.PublicKey, innerOnion Onion) ([]byte, [][]byte, error) {
+	last := len(nodeOrder) - 1
+	symmKeys := make([][]byte, len(nodeOrder))
+	symmKeys[last] = keyLibrary.GenerateSymmKey()
+	innerOnion.SymmKey = symmKeys[last]
+	innerOnion.Digest = LayerDigest(innerOnion)
+	onionMessage, err := SealLayer(innerOnion, tnMap[nodeOrder[last]])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i := last - 1; i > -1; i-- {
+		next := tnMap[nodeOrder[i+1]]
+		symmKeys[i] = keyLibrary.GenerateSymmKey()
+		outerOnionMessage := Onion{
+			NextIpPort:      nodeOrder[i+1],
+			NextFingerprint: keyLibrary.KeyFingerprint(&next),
+			SymmKey:         symmKeys[i],
+			Payload:         onionMessage,
+		}
+		outerOnionMessage.Digest = LayerDigest(outerOnionMessage)
+		onionMessage, err = SealLayer(outerOnionMessage, tnMap[nodeOrder[i]])
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return onionMessage, symmKeys, nil
+}
@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"strings"
+
+	"../keyLibrary"
+)
+
+// onion addresses are the service key fingerprint with this suffix
+const ONION_SUFFIX = ".onion"
+
+// ServiceCommand is what a circuit ending at a relay asks the relay to be for an onion
+// service, or to connect to as an exit. The relay answers with a ServiceFrame of the
+// same command.
+type ServiceCommand uint8
+
+const (
+	ServiceEstablishIntro      ServiceCommand = iota + 1 // the service asks the relay to be an introduction point
+	ServiceIntroduce                                     // a client asks the introduction point to pass on an Introduction
+	ServiceEstablishRendezvous                           // a client asks the relay to wait for the service under a cookie
+	ServiceJoinRendezvous                                // the service joins the client's circuit at the rendezvous point
+	ServiceKeepalive                                     // a frame that keeps an idle circuit from timing out
+	ServiceConnect                                       // the client asks an exit relay to open a TCP connection to Address
+	ServiceData                                          // bytes the exit relay read from the connection it opened, or a data server response frame
+	ServiceOpen                                          // the client builds a circuit ahead of time, it sends requests for data servers on it later
+	ServiceDone                                          // the data server finished its response, the open circuit takes the next request
+)
+
+// ServiceCell is set on the last layer of an onion, in place of a next hop
+type ServiceCell struct {
+	Command      ServiceCommand
+	ServiceKey   *rsa.PublicKey // EstablishIntro: the key the service address is derived from
+	Signature    []byte         // EstablishIntro: ServiceKey's signature over IntroAuth of the relay
+	Address      string         // Introduce: the service the client wants to reach. Connect: host:port to open
+	Introduction [][]byte       // Introduce: an Introduction encrypted to the service key
+	Cookie       []byte         // EstablishRendezvous, JoinRendezvous: pairs the two circuits
+}
+
+// ServiceFrame is what a relay sends back on a circuit that ends at it
+type ServiceFrame struct {
+	Command      ServiceCommand
+	Introduction [][]byte // Introduce frames passed on to the service
+	Data         []byte   // Data frames
+}
+
+// Introduction tells the service where the client waits, only the service can read it
+type Introduction struct {
+	RendezvousIPPort string
+	RendezvousKey    rsa.PublicKey
+	Cookie           []byte
+	SymmKey          []byte // end-to-end key between the client and the service
+}
+
+// ServiceDescriptor is published to the DS, clients look it up by onion address
+type ServiceDescriptor struct {
+	ServiceKey  rsa.PublicKey
+	IntroPoints map[string]rsa.PublicKey
+	Published   int64 // unix nanoseconds, the DS only replaces a descriptor with a newer one
+	Signature   []byte
+}
+
+// ServiceAddress is the onion address of the service holding key
+func ServiceAddress(key *rsa.PublicKey) string {
+	return keyLibrary.KeyFingerprint(key) + ONION_SUFFIX
+}
+
+func IsOnionAddress(addr string) bool {
+	return strings.HasSuffix(addr, ONION_SUFFIX)
+}
+
+// IntroAuth is what a service signs to establish an introduction point at the relay
+// with the given fingerprint, the signature is useless at any other relay
+func IntroAuth(relayFingerprint string) []byte {
+	return []byte("establish-intro:" + relayFingerprint)
+}
+
+func (d *ServiceDescriptor) Sign(key *rsa.PrivateKey) error {
+	d.Signature = nil
+	raw, err := Marshall(d)
+	if err != nil {
+		return err
+	}
+	d.Signature, err = keyLibrary.Sign(key, raw)
+	return err
+}
+
+// Verify checks the descriptor was signed by the service behind address
+func (d ServiceDescriptor) Verify(address string) error {
+	if ServiceAddress(&d.ServiceKey) != address {
+		return fmt.Errorf("descriptor key does not match %s", address)
+	}
+	if len(d.IntroPoints) == 0 {
+		return errors.New("descriptor lists no introduction points")
+	}
+	signature := d.Signature
+	d.Signature = nil
+	raw, err := Marshall(d)
+	if err != nil {
+		return err
+	}
+	return keyLibrary.VerifySignature(&d.ServiceKey, raw, signature)
+}
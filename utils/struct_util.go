@@ -2,25 +2,48 @@ package utils
 
 import "crypto/rsa"
 
+// what a Request asks the data server to do
+const (
+	RequestGet  = ""     // Response.Value is the value of Key, empty when there is none
+	RequestPut  = "put"  // stores Value under Key, Response.Value is empty
+	RequestList = "list" // Response.Value is the keys, sorted and one per line
+)
+
 type Request struct {
-	Key     string
-	SymmKey []byte
+	Key      string
+	SymmKey  []byte
+	Deadline int64  // see Onion.Deadline
+	Op       string // one of the Request constants, a get when empty
+	Value    string // the value to put
 }
 
+// largest slice of a value the data server sends in one Response frame
+const RESPONSE_FRAME_SIZE = 1024
+
 type Response struct {
-	Value string
+	Value  string
+	Digest []byte // running digest of the values sent on this circuit, see RunningDigest
 }
 
 type Onion struct {
 	NextIpPort string
 	SymmKey    []byte
 	Payload    []byte
+	Cover      bool   // set on the last relay's layer of a dummy onion, which is dropped there
+	Digest     []byte // LayerDigest going forward, the hop's running digest going back
+	Deadline   int64  // unix nanoseconds the hop has to answer by, see HopDeadline. 0 for none
+
+	NextFingerprint string // identity key fingerprint the link to NextIpPort is verified against
+
+	Service *ServiceCell // set on the last relay's layer of a circuit to an onion service relay
 }
 
 type NetworkJoinRequest struct {
 	TorIpPort   string
 	FdlibIpPort string
 	PubKey      rsa.PublicKey
+	Exit        bool // the node opens connections out of the network for clients
+	ExitPorts   ExitPorts
 }
 
 type NetworkJoinResponse struct {
@@ -30,10 +53,18 @@ type NetworkJoinResponse struct {
 type DsRequest struct {
 	NumNodes uint16
 	SymmKey  []byte
+	Service  string // onion address to look up the descriptor of, instead of tor nodes
+	Publish  bool   // a ServiceDescriptor follows, encrypted with SymmKey
+	Exit     bool   // the tor nodes must include an exit
+	ExitPort int    // the exit must allow connections to this port, any port when 0
 }
 
 type DsResponse struct {
-	DnMap map[string]rsa.PublicKey
+	DnMap      map[string]rsa.PublicKey
+	Descriptor *ServiceDescriptor // nil when the DS doesn't know the requested service
+	Published  bool
+	Exits      []string             // the tor nodes in DnMap that are exits, when the request asked for one
+	ExitPorts  map[string]ExitPorts // the policy of each exit in Exits
 }
 
 type ClientConfig struct {
@@ -43,4 +74,107 @@ type ClientConfig struct {
 	MaxNumNodes         uint16
 	DSIPPort            string
 	ServerIPPort        string
+	CoverTraffic        CoverTrafficConfig
+	FlowControl         FlowControlConfig
+	Bridges             []string // bridge lines, see Bridge. When set, the first hop is one of them.
+	LinkConfig                   // transport to the first hop, a bridge line brings its own
+
+	RequestTimeoutMillis int // deadline for the whole request, 10s when 0
+
+	CircuitPool CircuitPoolConfig
+	Guards      GuardConfig
+	Retry       RetryConfig
+	Path        PathConfig
+	ControlPort ControlPortConfig
+	Timeouts    BuildTimeoutConfig
+}
+
+// Circuits the client builds ahead of time and reuses for requests to the data server.
+// The pool grows with the requests in flight at once, up to MaxCircuits.
+type CircuitPoolConfig struct {
+	Enabled      bool
+	MaxCircuits  int // circuits kept at most, idle or in use. 4 when 0
+	MaxAgeMillis int // a circuit is retired this long after it was built, 10 minutes when 0
+	MaxUses      int // requests a circuit carries before it is retired, 20 when 0
+}
+
+// Entry guards, the few relays the client enters the network through for months instead
+// of a new first hop for every circuit. Bridges take their place when they are set.
+type GuardConfig struct {
+	StateFile    string // keeps the guards across runs, in memory only when empty. The client commands default it to next to their config
+	NumGuards    int    // 3 when 0
+	LifetimeDays int    // a guard is replaced after this long and up to half as long again, 60 when 0
+}
+
+// How the client retries a request on a new circuit when a relay on the circuit failed.
+// A request gives up at its deadline whatever the policy.
+type RetryConfig struct {
+	MaxAttempts   int // circuits tried per request, until the deadline when 0. 1 turns retries off
+	BackoffMillis int // wait before the second attempt, doubling with every attempt up to 2s. 100 when 0
+	AvoidMillis   int // a relay or link that failed is left out of new circuits this long, 10 minutes when 0
+}
+
+// Timeouts the client learns from how long its circuits took, like Tor's
+// CircuitBuildTimeout. Circuits slower than Percentile of the ones before are given up on
+// and tried again on another circuit.
+type BuildTimeoutConfig struct {
+	Disabled   bool    // wait for the request deadline and the relays' timeouts only
+	StateFile  string  // keeps the learned times across runs, in memory only when empty. The client commands default it to next to their config
+	Percentile float64 // share of circuits that is fast enough, between 0 and 1. 0.8 when 0
+	MinSamples int     // circuits timed before any is given up on, 100 when 0
+	MaxSamples int     // the times of this many latest circuits are kept, 1000 when 0
+}
+
+// The client's control port, which lists and closes its circuits and streams circuit
+// events to local controllers. Controllers authenticate with the password or the cookie.
+type ControlPortConfig struct {
+	IPPort     string // listen here, off when empty. Keep it on the loopback interface
+	Password   string // controllers send AUTHENTICATE "Password"
+	CookieFile string // a new random cookie is written here on every start, controllers send it in hex
+}
+
+// How many relays the client's circuits have and which relays may go where on them.
+// The nodes lists hold relay addresses, IPs and subnets in CIDR notation.
+type PathConfig struct {
+	MaxLength    int      // relays on a circuit, MaxNumNodes when 0
+	MinLength    int      // a circuit is built shorter when too few relays meet the rules, down to this. MaxLength when 0
+	EntryNodes   []string // the first hop is one of these, any relay when empty
+	MiddleNodes  []string // the hops between the first and the exit are these, any relay when empty
+	ExitNodes    []string // the exit of a Dial and the last relay of a request are one of these, any relay when empty
+	ExcludeNodes []string // never on a circuit
+	SubnetBits   int      // no two relays of a circuit share an IPv4 subnet this big, 16 when 0. -1 turns the check off
+}
+
+// Optional settings for a tor node, loaded from the json file passed to tn/main.go
+type TorNodeConfig struct {
+	AdvertiseIPPort string // address registered with the DS, defaults to the listen address
+	IdentityKeyPath string // keeps the identity key across restarts, a new key on every start when empty
+	Bridge          bool   // stay out of the directory and print a bridge line to hand out instead
+	DSPublicKeyPath string // verifies the DS link, defaults to ./dirserver/public.pem
+	DSClientIPPort  string // the DS port that serves tor clients
+	MetricsIPPort   string // serve prometheus metrics over http here, off when empty
+	Exit            bool   // open TCP connections out of the network for clients
+	CoverTraffic    CoverTrafficConfig
+
+	ExitPorts        ExitPorts // the only ports an exit connects to, every port when empty
+	ExitAllowPrivate bool      // also connect to loopback, private and link-local addresses, which an exit refuses by default
+
+	// Load limits, 0 picks the default. Connections beyond the accept queue are rejected.
+	MaxCircuits     int
+	MaxHandshakes   int
+	AcceptQueueSize int
+
+	FlowControl FlowControlConfig
+
+	ListenTransport TransportConfig // every link into this node, peers have to use the same
+	LinkConfig                      // links to next hops
+}
+
+// Rate parameters for dummy onions sent on otherwise idle circuits.
+// Intervals between onions are exponentially distributed around MeanIntervalMillis.
+type CoverTrafficConfig struct {
+	Enabled            bool
+	MeanIntervalMillis int
+	PathLength         uint16 // number of relays on a cover circuit
+	PayloadBytes       int    // size of the dummy payload handed to the last relay
 }
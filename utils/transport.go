@@ -0,0 +1,246 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"../keyLibrary"
+)
+
+const (
+	TRANSPORT_PLAIN = "plain"
+	TRANSPORT_OBFS  = "obfs"
+)
+
+// size of the random seed an obfs link starts with
+const obfsSeedSize = 32
+
+// Transport carries the cells of one link between two hops. Both ends of a link must use
+// the same transport. TLS runs on top of it, see DialLink.
+type Transport interface {
+	Name() string
+	// Dial connects to a peer, a timeout of 0 means none
+	Dial(addr string, timeout time.Duration) (net.Conn, error)
+	// Server wraps a connection accepted by a listener of this transport
+	Server(conn net.Conn) net.Conn
+}
+
+// TransportConfig picks a transport. Secret is only used by obfs: without it the stream
+// still looks random, but anyone who knows the protocol can undo the obfuscation.
+type TransportConfig struct {
+	Name   string // "plain" or "obfs", empty means plain
+	Secret string
+}
+
+func NewTransport(config TransportConfig) (Transport, error) {
+	switch config.Name {
+	case "", TRANSPORT_PLAIN:
+		return plainTransport{}, nil
+	case TRANSPORT_OBFS:
+		return obfsTransport{secret: []byte(config.Secret)}, nil
+	}
+	return nil, fmt.Errorf("unknown transport %q", config.Name)
+}
+
+// LinkConfig selects the transport of every outgoing link of a node
+type LinkConfig struct {
+	Transport      TransportConfig            // for links not listed in LinkTransports
+	LinkTransports map[string]TransportConfig // by peer IP:port
+}
+
+func (c LinkConfig) TransportFor(addr string) (Transport, error) {
+	if config, ok := c.LinkTransports[addr]; ok {
+		return NewTransport(config)
+	}
+	return NewTransport(c.Transport)
+}
+
+// Dial opens a TLS link to addr over the transport configured for it
+func (c LinkConfig) Dial(addr string, peerFingerprint string, timeout time.Duration) (net.Conn, error) {
+	transport, err := c.TransportFor(addr)
+	if err != nil {
+		return nil, err
+	}
+	return DialLink(transport, addr, peerFingerprint, nil, timeout)
+}
+
+// DialLink connects to addr over the transport and runs TLS on top, accepting only the
+// peer whose identity key has the given fingerprint. key, when set, is our own identity.
+func DialLink(transport Transport, addr string, peerFingerprint string, key *rsa.PrivateKey, timeout time.Duration) (net.Conn, error) {
+	config, err := keyLibrary.ClientTLSConfig(peerFingerprint, key)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := transport.Dial(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, config)
+	if timeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// DialTLS opens a TLS link over plain TCP, for the DS and the data server
+func DialTLS(addr string, peerFingerprint string, key *rsa.PrivateKey, timeout time.Duration) (net.Conn, error) {
+	return DialLink(plainTransport{}, addr, peerFingerprint, key, timeout)
+}
+
+// CloseWrite half-closes the connection if its transport supports it
+func CloseWrite(conn net.Conn) error {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+	return nil
+}
+
+// plain TCP, cells are readable on the wire
+type plainTransport struct{}
+
+func (plainTransport) Name() string {
+	return TRANSPORT_PLAIN
+}
+
+func (plainTransport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+func (plainTransport) Server(conn net.Conn) net.Conn {
+	return conn
+}
+
+// obfs: the dialer sends a random seed, after which both directions are XORed with an
+// AES-CTR keystream derived from the seed and the secret. There is no fixed header,
+// so every byte on the wire looks random. It hides the protocol, not the traffic
+// pattern: packet sizes and timing stay the same.
+type obfsTransport struct {
+	secret []byte
+}
+
+func (obfsTransport) Name() string {
+	return TRANSPORT_OBFS
+}
+
+func (t obfsTransport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	seed := make([]byte, obfsSeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := conn.Write(seed); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c := &obfsConn{Conn: conn}
+	if err := c.init(t.secret, seed, true); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (t obfsTransport) Server(conn net.Conn) net.Conn {
+	return &obfsConn{Conn: conn, secret: t.secret, pending: true}
+}
+
+type obfsConn struct {
+	net.Conn
+	secret []byte
+
+	// the server side reads the seed on first use, so the read deadline set by the
+	// caller covers it
+	pending bool
+	once    sync.Once
+	initErr error
+
+	reader cipher.Stream
+	writer cipher.Stream
+}
+
+func (c *obfsConn) init(secret []byte, seed []byte, dialer bool) error {
+	upstream, err := obfsStream(secret, seed, "upstream")
+	if err != nil {
+		return err
+	}
+	downstream, err := obfsStream(secret, seed, "downstream")
+	if err != nil {
+		return err
+	}
+	if dialer {
+		c.writer, c.reader = upstream, downstream
+	} else {
+		c.writer, c.reader = downstream, upstream
+	}
+	return nil
+}
+
+func (c *obfsConn) handshake() error {
+	if !c.pending {
+		return nil
+	}
+	c.once.Do(func() {
+		seed := make([]byte, obfsSeedSize)
+		if _, err := io.ReadFull(c.Conn, seed); err != nil {
+			c.initErr = err
+			return
+		}
+		c.initErr = c.init(c.secret, seed, false)
+	})
+	return c.initErr
+}
+
+func (c *obfsConn) Read(b []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Read(b)
+	c.reader.XORKeyStream(b[:n], b[:n])
+	return n, err
+}
+
+func (c *obfsConn) Write(b []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+	obfuscated := make([]byte, len(b))
+	c.writer.XORKeyStream(obfuscated, b)
+	return c.Conn.Write(obfuscated)
+}
+
+func (c *obfsConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+// one keystream per direction, the seed is fresh for every link so the zero IV is never reused
+func obfsStream(secret []byte, seed []byte, direction string) (cipher.Stream, error) {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(seed)
+	mac.Write([]byte(direction))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewCTR(block, make([]byte, aes.BlockSize)), nil
+}